@@ -6,11 +6,22 @@ import (
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/emicklei/go-restful"
+
+	"github.com/mcluseau/autentigo/pkg/claims"
+	"github.com/mcluseau/autentigo/pkg/health"
+	"github.com/mcluseau/autentigo/pkg/lifetime"
+	"github.com/mcluseau/autentigo/pkg/rbac"
 )
 
 var (
 	// ErrInvalidAuthentication indicates an invalid authentication
 	ErrInvalidAuthentication = errors.New("invalid authentication")
+
+	// ErrRevokedToken indicates a revoked token
+	ErrRevokedToken = errors.New("revoked token")
+
+	// ErrNotIdentityToken indicates a token that doesn't authenticate a user (ie: a registry token)
+	ErrNotIdentityToken = errors.New("not an identity token")
 )
 
 // Authenticator is the interface for authn backends
@@ -18,14 +29,63 @@ type Authenticator interface {
 	Authenticate(user, password string, expiresAt time.Time) (claims jwt.Claims, err error)
 }
 
+// UserLookup is implemented by authenticators able to resolve a user's claims
+// without checking a password (ie: when the user is authenticated by other
+// means, like a client certificate).
+type UserLookup interface {
+	Lookup(user string, expiresAt time.Time) (claims jwt.Claims, err error)
+}
+
+// HealthChecker is implemented by authenticators able to check their backend is reachable.
+type HealthChecker = health.Checker
+
 // API registering with restful
 type API struct {
 	CRTData       []byte
 	Authenticator Authenticator
+	Backend       string
 	PublicKey     interface{}
 	PrivateKey    interface{}
 	SigningMethod jwt.SigningMethod
 	TokenDuration time.Duration
+
+	// TokenMaxDuration caps the duration of tokens (no limit if 0).
+	TokenMaxDuration time.Duration
+	// TokenPolicies select the duration of tokens (TokenDuration if none matches).
+	TokenPolicies []lifetime.Policy
+
+	// AuthTimeout is the maximum duration of an authentication by the backend.
+	AuthTimeout time.Duration
+
+	// Claims is the pipeline applied to the claims of emitted tokens.
+	Claims *claims.Config
+
+	// TokenReviewUsernamePrefix and TokenReviewGroupsPrefix are prepended to
+	// the user name and groups returned by Kubernetes token reviews.
+	TokenReviewUsernamePrefix string
+	TokenReviewGroupsPrefix   string
+
+	// Authorizer answers the Kubernetes subject access reviews.
+	Authorizer rbac.Authorizer
+	// Roles gives the roles of Keystone tokens.
+	Roles rbac.RoleLister
+
+	// Keystone configures the Keystone v3 emulation.
+	Keystone KeystoneConfig
+
+	// Repositories authorizes the Docker registry accesses.
+	Repositories rbac.RepositoryAuthorizer
+	// Docker configures the Docker registry token authentication.
+	Docker DockerConfig
+
+	// Dovecot configures the Dovecot passdb/userdb routes.
+	Dovecot DovecotConfig
+
+	// MTLSUsername is the certificate field giving the user name on the
+	// /mtls route (cn, email, dns or uri).
+	MTLSUsername string
+
+	revoked revocationList
 }
 
 // Register provide a restful.WebService from this API
@@ -35,6 +95,10 @@ func (api *API) Register() *restful.WebService {
 	api.registerSimple(ws)
 	api.registerKeystone(ws)
 	api.registerK8sAuthenticator(ws)
+	api.registerK8sAuthorizer(ws)
 	api.registerCertificate(ws)
+	api.registerMTLS(ws)
+	api.registerDocker(ws)
+	api.registerDovecot(ws)
 	return ws
 }
@@ -0,0 +1,51 @@
+package api
+
+import (
+	restful "github.com/emicklei/go-restful"
+
+	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/audit"
+)
+
+func (api *API) auditEvent(request *restful.Request, eventType, user string) audit.Event {
+	return audit.Event{
+		Type:     eventType,
+		Success:  true,
+		User:     user,
+		Backend:  api.Backend,
+		SourceIP: audit.SourceIP(request.Request),
+		Route:    request.Request.URL.Path,
+	}
+}
+
+func (api *API) auditLogin(request *restful.Request, user string, err error) {
+	event := api.auditEvent(request, audit.LoginSuccess, user)
+	if err != nil {
+		event.Type = audit.LoginFailure
+		event.Success = false
+		event.Reason = err.Error()
+	}
+	audit.Log(event)
+}
+
+func (api *API) auditLoginFailure(request *restful.Request, user, reason string) {
+	event := api.auditEvent(request, audit.LoginFailure, user)
+	event.Success = false
+	event.Reason = reason
+	audit.Log(event)
+}
+
+func (api *API) auditTokenRevoked(request *restful.Request, claims *auth.Claims) {
+	event := api.auditEvent(request, audit.TokenRevoked, claims.Subject)
+	event.TokenID = claims.Id
+	event.ExpiresAt = claims.ExpiresAt
+	audit.Log(event)
+}
+
+func (api *API) auditTokenIssued(request *restful.Request, claims *auth.Claims) {
+	event := api.auditEvent(request, audit.TokenIssued, claims.Subject)
+	event.TokenID = claims.Id
+	event.ExpiresAt = claims.ExpiresAt
+	event.Policy = tokenPolicy(request)
+	audit.Log(event)
+}
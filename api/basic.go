@@ -16,6 +16,7 @@ func (api *API) registerBasic(ws *restful.WebService) {
 			Param(setCookieHeader()).
 			Param(setCookieDomainHeader()).
 			Param(setCookieInsecureHeader()).
+			Param(audienceParameter()).
 			Produces("application/json").
 			Writes(AuthResponse{}))
 }
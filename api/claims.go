@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	restful "github.com/emicklei/go-restful"
+
+	"github.com/mcluseau/autentigo/pkg/claims"
+)
+
+func audienceParameter() *restful.Parameter {
+	return restful.QueryParameter(
+		"audience", "Audience of the token, selecting the claims profile to apply.")
+}
+
+// toMapClaims returns the claims as a jwt.MapClaims.
+func toMapClaims(c jwt.Claims) (jwt.MapClaims, error) {
+	return claims.ToMap(c)
+}
+
+// mapClaims applies the claims pipeline, if any, to the claims of a token.
+func (api *API) mapClaims(request *restful.Request, c jwt.Claims) (jwt.Claims, error) {
+	audience := request.QueryParameter("audience")
+
+	if api.Claims == nil {
+		if audience != "" {
+			return nil, restful.NewError(http.StatusBadRequest, claims.UnknownAudienceError{Audience: audience}.Error())
+		}
+		return c, nil
+	}
+
+	mapped, err := api.Claims.Apply(c, audience)
+	if _, ok := err.(claims.UnknownAudienceError); ok {
+		return nil, restful.NewError(http.StatusBadRequest, err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+
+	return mapped, nil
+}
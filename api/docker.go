@@ -0,0 +1,260 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	restful "github.com/emicklei/go-restful"
+	uuid "github.com/nu7hatch/gouuid"
+
+	"github.com/mcluseau/autentigo/pkg/audit"
+	"github.com/mcluseau/autentigo/pkg/rbac"
+)
+
+// DockerConfig configures the Docker registry token authentication.
+type DockerConfig struct {
+	// Issuer of the tokens, must match the registry's auth.token.issuer and
+	// differ from the issuer of other tokens.
+	Issuer string `json:"issuer"`
+
+	// Services (registries' auth.token.service) tokens can be requested for.
+	// Any service is accepted if empty.
+	Services []string `json:"services"`
+}
+
+// DockerAccess is an access granted by a Docker registry token
+type DockerAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// DockerClaims are the claims of a Docker registry token
+type DockerClaims struct {
+	jwt.StandardClaims
+	Access []DockerAccess `json:"access"`
+}
+
+// DockerTokenResponse is a Docker registry token response
+type DockerTokenResponse struct {
+	Token       string    `json:"token"`
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int64     `json:"expires_in"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+func (api *API) registerDocker(ws *restful.WebService) {
+	ws.
+		Route(ws.GET("/docker/token").
+			To(api.dockerToken).
+			Doc("Docker registry token authentication").
+			Param(restful.HeaderParameter(
+				"Authorization", "Basic authorization header (anonymous if missing)")).
+			Param(restful.QueryParameter("service", "The registry requesting the token.")).
+			Param(restful.QueryParameter("scope", "The requested access (ie: repository:foo/bar:pull,push).").
+				AllowMultiple(true)).
+			Param(restful.QueryParameter("account", "The account of the user.")).
+			Produces("application/json").
+			Writes(DockerTokenResponse{}))
+}
+
+func (api *API) dockerToken(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			WriteError(err.(error), response)
+		}
+	}()
+
+	service := request.QueryParameter("service")
+	if service == "" {
+		response.WriteErrorString(http.StatusBadRequest, "No service given.\n")
+		return
+	}
+	if !api.Docker.acceptsService(service) {
+		response.WriteErrorString(http.StatusBadRequest, "Unknown service.\n")
+		return
+	}
+
+	var user *rbac.User
+	id := &Identity{} // anonymous
+
+	if login, password, ok := request.Request.BasicAuth(); ok {
+		claims, err := api.authenticate(request, login, password)
+		if err == ErrInvalidAuthentication {
+			response.Header().Set("WWW-Authenticate", `Basic realm="Autorizo"`)
+			response.WriteErrorString(http.StatusUnauthorized, "Authentication failed.\n")
+			return
+		} else if err != nil {
+			panic(err)
+		}
+
+		if id, err = IdentityFromClaims(claims); err != nil {
+			panic(err)
+		}
+
+		user = &rbac.User{Name: id.Subject, Groups: id.Groups}
+	}
+
+	now := time.Now()
+	exp := api.tokenExpiry(request, id, now)
+
+	access := make([]DockerAccess, 0)
+	for _, scope := range request.QueryParameters("scope") {
+		requested, ok := parseDockerScope(scope)
+		if !ok {
+			response.WriteErrorString(http.StatusBadRequest, "Invalid scope.\n")
+			return
+		}
+
+		granted := api.dockerGrant(user, requested)
+		if len(granted.Actions) != 0 {
+			access = append(access, granted)
+		}
+	}
+
+	jti, err := uuid.NewV4()
+	if err != nil {
+		panic(err)
+	}
+
+	claims := DockerClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    api.Docker.issuer(),
+			Subject:   id.Subject,
+			Audience:  service,
+			ExpiresAt: exp.Unix(),
+			NotBefore: now.Unix(),
+			IssuedAt:  now.Unix(),
+			Id:        jti.String(),
+		},
+		Access: access,
+	}
+
+	token := jwt.NewWithClaims(api.SigningMethod, claims)
+	if err = api.setDockerKeyHeaders(token); err != nil {
+		panic(err)
+	}
+
+	tokenString, err := token.SignedString(api.PrivateKey)
+	if err != nil {
+		panic(err)
+	}
+
+	event := api.auditEvent(request, audit.TokenIssued, id.Subject)
+	event.TokenID = claims.Id
+	event.ExpiresAt = claims.ExpiresAt
+	event.Policy = tokenPolicy(request)
+	event.Details = map[string]interface{}{
+		"service": service,
+		"access":  access,
+	}
+	audit.Log(event)
+
+	response.WriteEntity(&DockerTokenResponse{
+		Token:       tokenString,
+		AccessToken: tokenString,
+		ExpiresIn:   claims.ExpiresAt - claims.IssuedAt,
+		IssuedAt:    now.UTC(),
+	})
+}
+
+func (dc *DockerConfig) issuer() string {
+	if dc.Issuer == "" {
+		return "autentigo-registry"
+	}
+	return dc.Issuer
+}
+
+// isService returns true if the audience is one of the configured services.
+func (dc *DockerConfig) isService(audience string) bool {
+	for _, s := range dc.Services {
+		if s == audience {
+			return true
+		}
+	}
+	return false
+}
+
+func (dc *DockerConfig) acceptsService(service string) bool {
+	return len(dc.Services) == 0 || dc.isService(service)
+}
+
+// parseDockerScope parses a scope like "repository:foo/bar:pull,push"
+func parseDockerScope(scope string) (access DockerAccess, ok bool) {
+	first := strings.Index(scope, ":")
+	last := strings.LastIndex(scope, ":")
+	if first <= 0 || first == last {
+		return
+	}
+
+	access.Type = scope[:first]
+	access.Name = scope[first+1 : last]
+	if actions := scope[last+1:]; actions != "" {
+		access.Actions = strings.Split(actions, ",")
+	}
+
+	return access, access.Name != ""
+}
+
+// dockerGrant returns the requested access, restricted to the granted actions.
+func (api *API) dockerGrant(user *rbac.User, requested DockerAccess) (granted DockerAccess) {
+	granted = DockerAccess{Type: requested.Type, Name: requested.Name, Actions: []string{}}
+
+	// ignore the resource class (ie: "repository(plugin)")
+	if t := requested.Type; api.Repositories == nil ||
+		(t != "repository" && !strings.HasPrefix(t, "repository(")) {
+		return
+	}
+
+	allowed := api.Repositories.RepositoryActions(user, requested.Name)
+
+	for _, action := range requested.Actions {
+		for _, a := range allowed {
+			if a == "*" || a == action {
+				granted.Actions = append(granted.Actions, action)
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// setDockerKeyHeaders sets the kid (libtrust key ID) and, when the signing
+// certificate is available, the x5c headers of the token.
+func (api *API) setDockerKeyHeaders(token *jwt.Token) error {
+	der, err := x509.MarshalPKIXPublicKey(api.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	token.Header["kid"] = libtrustKeyID(der)
+
+	if block, _ := pem.Decode(api.CRTData); block != nil && block.Type == "CERTIFICATE" {
+		token.Header["x5c"] = []string{base64.StdEncoding.EncodeToString(block.Bytes)}
+	}
+
+	return nil
+}
+
+// libtrustKeyID returns the key ID of a public key as computed by libtrust (used
+// by the Docker registry): the base32 of the first 240 bits of the SHA256 of
+// the DER public key, in groups of 4 characters separated by colons.
+func libtrustKeyID(der []byte) string {
+	sum := sha256.Sum256(der)
+	s := strings.TrimRight(base32.StdEncoding.EncodeToString(sum[:30]), "=")
+
+	parts := make([]string, 0, len(s)/4)
+	for i := 0; i < len(s); i += 4 {
+		parts = append(parts, s[i:i+4])
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	restful "github.com/emicklei/go-restful"
+
+	"github.com/mcluseau/autentigo/pkg/claims"
+	"github.com/mcluseau/autentigo/pkg/server"
+)
+
+// DovecotSecretHeader is the header giving the Dovecot routes' shared secret.
+const DovecotSecretHeader = "X-Dovecot-Secret"
+
+// DovecotConfig configures the Dovecot passdb/userdb routes.
+type DovecotConfig struct {
+	// Userdb fields (ie: home, uid, gid, quota_rule), as templates over the
+	// user's claims (ie: "/var/mail/{{ .sub }}").
+	Userdb map[string]claims.Template `json:"userdb"`
+
+	// Secret required in the X-Dovecot-Secret header.
+	Secret string `json:"secret"`
+
+	// ClientNames are the names (as selected by --mtls-username) of the client
+	// certificates accepted without the secret.
+	ClientNames []string `json:"client_names"`
+}
+
+// DovecotAuthReq is a Dovecot passdb request
+type DovecotAuthReq struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Service  string `json:"service,omitempty"`
+	RemoteIP string `json:"remote_ip,omitempty"`
+}
+
+// DovecotAuthResponse is a Dovecot passdb or userdb response
+type DovecotAuthResponse struct {
+	// Result is "ok" or "fail".
+	Result string            `json:"result"`
+	User   string            `json:"user,omitempty"`
+	Userdb map[string]string `json:"userdb,omitempty"`
+}
+
+func (api *API) registerDovecot(ws *restful.WebService) {
+	ws.
+		Route(ws.POST("/dovecot/passdb").
+			To(api.dovecotPassdb).
+			Filter(api.dovecotFilter).
+			Doc("Verify credentials for Dovecot (Lua passdb or checkpassword helper)").
+			Consumes("application/json").
+			Produces("application/json").
+			Reads(DovecotAuthReq{}).
+			Writes(DovecotAuthResponse{}))
+
+	ws.
+		Route(ws.GET("/dovecot/userdb/{user}").
+			To(api.dovecotUserdb).
+			Filter(api.dovecotFilter).
+			Doc("Lookup a user for Dovecot (Lua userdb)").
+			Param(ws.PathParameter("user", "The user name")).
+			Produces("application/json").
+			Writes(DovecotAuthResponse{}))
+}
+
+// dovecotFilter only lets Dovecot (or its helpers) call the routes: requests
+// must give the shared secret or a client certificate with an allowed name.
+func (api *API) dovecotFilter(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	if api.Dovecot.allows(request.HeaderParameter(DovecotSecretHeader)) {
+		chain.ProcessFilter(request, response)
+		return
+	}
+
+	if cert := server.ClientCertificate(request.Request); cert != nil {
+		name := api.certificateUser(cert)
+		for _, allowed := range api.Dovecot.ClientNames {
+			if name != "" && name == allowed {
+				chain.ProcessFilter(request, response)
+				return
+			}
+		}
+	}
+
+	response.WriteErrorString(http.StatusForbidden, "Dovecot secret or client certificate required.\n")
+}
+
+// allows returns true if the secret is the configured one.
+func (dc *DovecotConfig) allows(secret string) bool {
+	return dc.Secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(dc.Secret)) == 1
+}
+
+func (api *API) dovecotPassdb(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			WriteError(err.(error), response)
+		}
+	}()
+
+	authReq := DovecotAuthReq{}
+	if err := request.ReadEntity(&authReq); err != nil {
+		WriteError(err, response)
+		return
+	}
+
+	if authReq.User == "" || authReq.Password == "" {
+		api.auditLoginFailure(request, authReq.User, "no user or password given")
+		response.WriteHeaderAndEntity(http.StatusUnauthorized, &DovecotAuthResponse{Result: "fail"})
+		return
+	}
+
+	c, err := api.authenticate(request, authReq.User, authReq.Password)
+	if err == ErrInvalidAuthentication {
+		response.WriteHeaderAndEntity(http.StatusUnauthorized, &DovecotAuthResponse{Result: "fail"})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	api.writeDovecotResponse(response, authReq.User, c)
+}
+
+func (api *API) dovecotUserdb(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			WriteError(err.(error), response)
+		}
+	}()
+
+	lookup, ok := api.Authenticator.(UserLookup)
+	if !ok {
+		response.WriteErrorString(http.StatusNotImplemented, "The authentication backend does not support user lookups.\n")
+		return
+	}
+
+	user := request.PathParameter("user")
+
+	// not a login, so not audited
+	c, err := lookup.Lookup(user, time.Now().Add(api.TokenDuration))
+	if err == ErrInvalidAuthentication {
+		response.WriteHeaderAndEntity(http.StatusNotFound, &DovecotAuthResponse{Result: "fail"})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	api.writeDovecotResponse(response, user, c)
+}
+
+func (api *API) writeDovecotResponse(response *restful.Response, user string, c jwt.Claims) {
+	m, err := toMapClaims(c)
+	if err != nil {
+		panic(err)
+	}
+
+	userdb := make(map[string]string, len(api.Dovecot.Userdb))
+	for field, tmpl := range api.Dovecot.Userdb {
+		buf := &bytes.Buffer{}
+		if err := tmpl.Execute(buf, map[string]interface{}(m)); err != nil {
+			panic(err)
+		}
+		userdb[field] = buf.String()
+	}
+
+	response.WriteEntity(&DovecotAuthResponse{
+		Result: "ok",
+		User:   user,
+		Userdb: userdb,
+	})
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/mcluseau/autentigo/auth"
+)
+
+// RequestInfo describes an authentication request.
+type RequestInfo struct {
+	User     string
+	Password string
+	// ExpiresAt is the default expiry. The expiry of the token is given by the
+	// lifetime policies once the identity is known.
+	ExpiresAt time.Time
+
+	// SourceIP is the IP of the client.
+	SourceIP string
+	// Route is the path of the route used to authenticate (ie: /basic).
+	Route string
+	// Scopes requested by the client, if any.
+	Scopes []string
+}
+
+// Identity is an authenticated identity.
+type Identity struct {
+	Subject string `json:"sub"`
+	auth.ExtraClaims
+}
+
+// Claims returns the claims of a token for this identity.
+func (id *Identity) Claims(issuedAt, expiresAt time.Time) auth.Claims {
+	return auth.Claims{
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  issuedAt.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+			Subject:   id.Subject,
+		},
+		ExtraClaims: id.ExtraClaims,
+	}
+}
+
+// IdentityFromClaims returns the identity described by the claims.
+func IdentityFromClaims(claims jwt.Claims) (*Identity, error) {
+	ba, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	c := auth.Claims{}
+	if err = json.Unmarshal(ba, &c); err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Subject:     c.Subject,
+		ExtraClaims: c.ExtraClaims,
+	}, nil
+}
+
+// ContextAuthenticator is the context-aware interface for authn backends.
+//
+// The context is canceled when the client goes away or the authentication
+// timeout is reached.
+type ContextAuthenticator interface {
+	AuthenticateContext(ctx context.Context, req RequestInfo) (*Identity, error)
+}
+
+// Adapt returns the ContextAuthenticator implementation of the given
+// Authenticator, or wraps it if it only implements Authenticator.
+func Adapt(a Authenticator) ContextAuthenticator {
+	if ca, ok := a.(ContextAuthenticator); ok {
+		return ca
+	}
+	return authenticatorAdapter{a}
+}
+
+type authenticatorAdapter struct {
+	Authenticator
+}
+
+func (a authenticatorAdapter) AuthenticateContext(ctx context.Context, req RequestInfo) (*Identity, error) {
+	claims, err := a.Authenticate(req.User, req.Password, req.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return IdentityFromClaims(claims)
+}
+
+// Authenticate implements Authenticator.Authenticate for ContextAuthenticators.
+func Authenticate(a ContextAuthenticator, user, password string, expiresAt time.Time) (jwt.Claims, error) {
+	id, err := a.AuthenticateContext(context.Background(), RequestInfo{
+		User:      user,
+		Password:  password,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return id.Claims(time.Now(), expiresAt), nil
+}
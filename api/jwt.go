@@ -1,19 +1,47 @@
 package api
 
 import (
+	"context"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	restful "github.com/emicklei/go-restful"
+	uuid "github.com/nu7hatch/gouuid"
 
 	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/audit"
 )
 
 func (api *API) createToken(user string, claims jwt.Claims) (*jwt.Token, string, error) {
-	token := jwt.NewWithClaims(api.SigningMethod, claims)
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := jwt.NewWithClaims(api.SigningMethod, withTokenID(claims, id.String()))
 	signed, err := token.SignedString(api.PrivateKey)
 	return token, signed, err
 }
 
+// withTokenID returns the claims with their ID (jti) set
+func withTokenID(claims jwt.Claims, id string) jwt.Claims {
+	switch c := claims.(type) {
+	case auth.Claims:
+		c.Id = id
+		return c
+	case *auth.Claims:
+		c.Id = id
+	case jwt.StandardClaims:
+		c.Id = id
+		return c
+	case *jwt.StandardClaims:
+		c.Id = id
+	case jwt.MapClaims:
+		c["jti"] = id
+	}
+	return claims
+}
+
 func (api *API) keyfunc(t *jwt.Token) (interface{}, error) {
 	return api.PublicKey, nil
 }
@@ -21,18 +49,92 @@ func (api *API) keyfunc(t *jwt.Token) (interface{}, error) {
 func (api *API) checkToken(tokenString string) (*auth.Claims, error) {
 	claims := &auth.Claims{}
 
-	if _, err := jwt.ParseWithClaims(tokenString, claims, api.keyfunc); err != nil {
+	if err := api.parseToken(tokenString, claims); err != nil {
 		return nil, err
 	}
 
-	if err := claims.Valid(); err != nil {
+	if err := api.checkIdentityToken(tokenString, &claims.StandardClaims); err != nil {
 		return nil, err
 	}
 
+	if api.revoked.IsRevoked(claims.Id) {
+		return nil, ErrRevokedToken
+	}
+
 	return claims, nil
 }
 
-func (api *API) authenticate(user, password string) (jwt.Claims, error) {
-	exp := time.Now().Add(api.TokenDuration)
-	return api.Authenticator.Authenticate(user, password, exp)
+// parseToken parses and validates the token. Callers must check the token is
+// not revoked.
+func (api *API) parseToken(tokenString string, claims jwt.Claims) error {
+	if _, err := jwt.ParseWithClaims(tokenString, claims, api.keyfunc); err != nil {
+		return err
+	}
+
+	return claims.Valid()
+}
+
+// checkIdentityToken returns ErrNotIdentityToken if the token doesn't
+// authenticate a user. Registry tokens are signed with the same key but only
+// grant their access to their service.
+func (api *API) checkIdentityToken(tokenString string, claims *jwt.StandardClaims) error {
+	if claims.Subject == "" || claims.Issuer == api.Docker.issuer() || api.Docker.isService(claims.Audience) {
+		return ErrNotIdentityToken
+	}
+
+	raw := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, raw); err != nil {
+		return err
+	}
+
+	if _, ok := raw["access"]; ok {
+		return ErrNotIdentityToken
+	}
+
+	return nil
+}
+
+func (api *API) authenticate(request *restful.Request, user, password string) (jwt.Claims, error) {
+	now := time.Now()
+	exp := now.Add(api.TokenDuration)
+
+	ctx := request.Request.Context()
+	if api.AuthTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, api.AuthTimeout)
+		defer cancel()
+	}
+
+	id, err := Adapt(api.Authenticator).AuthenticateContext(ctx, RequestInfo{
+		User:      user,
+		Password:  password,
+		ExpiresAt: exp,
+		SourceIP:  audit.SourceIP(request.Request),
+		Route:     request.Request.URL.Path,
+		Scopes:    request.QueryParameters("scope"),
+	})
+
+	api.auditLogin(request, user, err)
+
+	if err != nil {
+		return nil, err
+	}
+	return id.Claims(now, api.tokenExpiry(request, id, now)), nil
+}
+
+func (api *API) lookup(request *restful.Request, lookup UserLookup, user string) (jwt.Claims, error) {
+	now := time.Now()
+	claims, err := lookup.Lookup(user, now.Add(api.TokenDuration))
+
+	api.auditLogin(request, user, err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := IdentityFromClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+	return id.Claims(now, api.tokenExpiry(request, id, now)), nil
 }
@@ -1,11 +1,15 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 
 	restful "github.com/emicklei/go-restful"
 	authv1 "k8s.io/api/authentication/v1"
+	authv1beta1 "k8s.io/api/authentication/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/mcluseau/autentigo/pkg/audit"
 )
 
 func (api *API) registerK8sAuthenticator(ws *restful.WebService) {
@@ -20,28 +24,46 @@ func (api *API) registerK8sAuthenticator(ws *restful.WebService) {
 }
 
 func (api *API) k8sTokenReview(request *restful.Request, response *restful.Response) {
+	// v1 and v1beta1 TokenReviews have the same fields
 	req := &authv1.TokenReview{}
 	if err := request.ReadEntity(req); err != nil {
 		response.WriteError(http.StatusBadRequest, err)
 		return
 	}
 
-	claims, err := api.checkToken(req.Spec.Token)
+	apiVersion := authv1.SchemeGroupVersion.String()
+	if req.APIVersion == authv1beta1.SchemeGroupVersion.String() {
+		apiVersion = req.APIVersion
+	}
 
 	tr := &authv1.TokenReview{
 		TypeMeta: metav1.TypeMeta{
-			APIVersion: req.APIVersion,
-			Kind:       req.Kind,
+			APIVersion: apiVersion,
+			Kind:       "TokenReview",
 		},
 	}
 
+	event := api.auditEvent(request, audit.TokenReview, "")
+
+	claims, err := api.checkToken(req.Spec.Token)
+
+	var audiences []string
+	if err == nil {
+		audiences, err = reviewAudiences(req.Spec.Audiences, claims.Audience)
+	}
+
 	if err != nil {
+		event.Success = false
+		event.Reason = err.Error()
+		audit.Log(event)
+
+		// the API server expects a 200 with the failure in the status
 		tr.Status = authv1.TokenReviewStatus{
 			Authenticated: false,
-			Error:         err.Error(),
+			Error:         "invalid token",
 		}
 
-		response.WriteHeaderAndEntity(http.StatusUnauthorized, tr)
+		response.WriteEntity(tr)
 		return
 	}
 
@@ -55,14 +77,55 @@ func (api *API) k8sTokenReview(request *restful.Request, response *restful.Respo
 		extra["email_verified"] = authv1.ExtraValue{"true"}
 	}
 
+	var groups []string
+	if len(claims.Groups) != 0 {
+		groups = make([]string, len(claims.Groups))
+		for i, group := range claims.Groups {
+			groups[i] = api.TokenReviewGroupsPrefix + group
+		}
+	}
+
+	event.User = claims.Subject
+	event.TokenID = claims.Id
+	event.ExpiresAt = claims.ExpiresAt
+	if len(audiences) != 0 {
+		event.Details = map[string]interface{}{"audiences": audiences}
+	}
+	audit.Log(event)
+
 	tr.Status = authv1.TokenReviewStatus{
 		Authenticated: true,
 		User: authv1.UserInfo{
-			Username: claims.Subject,
-			Groups:   claims.Groups,
+			Username: api.TokenReviewUsernamePrefix + claims.Subject,
+			UID:      claims.Subject,
+			Groups:   groups,
 			Extra:    extra,
 		},
+		Audiences: audiences,
 	}
 
 	response.WriteEntity(tr)
 }
+
+// reviewAudiences returns the audiences of the review the token is valid for.
+//
+// Tokens without audience are valid for any audience and the returned list is
+// empty, meaning the audience is compatible with the requester. Tokens with
+// an audience must match one of the requested audiences, if any.
+func reviewAudiences(requested []string, tokenAudience string) ([]string, error) {
+	if tokenAudience == "" {
+		return nil, nil
+	}
+
+	if len(requested) == 0 {
+		return []string{tokenAudience}, nil
+	}
+
+	for _, aud := range requested {
+		if aud == tokenAudience {
+			return []string{aud}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("token audience %q not in %q", tokenAudience, requested)
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	restful "github.com/emicklei/go-restful"
+	authv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/mcluseau/autentigo/auth"
+)
+
+func TestReviewAudiences(t *testing.T) {
+	for _, tc := range []struct {
+		requested []string
+		audience  string
+		expected  []string
+		err       bool
+	}{
+		{nil, "", nil, false},
+		{[]string{"api"}, "", nil, false},
+		{nil, "api", []string{"api"}, false},
+		{[]string{"other", "api"}, "api", []string{"api"}, false},
+		{[]string{"other"}, "api", nil, true},
+	} {
+		audiences, err := reviewAudiences(tc.requested, tc.audience)
+		if (err != nil) != tc.err {
+			t.Errorf("%q, %q: unexpected error: %v", tc.requested, tc.audience, err)
+		}
+		if !reflect.DeepEqual(audiences, tc.expected) {
+			t.Errorf("%q, %q: expected %q, got %q", tc.requested, tc.audience, tc.expected, audiences)
+		}
+	}
+}
+
+func testTokenReviewAPI(t *testing.T) (*API, *httptest.Server) {
+	key := []byte("test key")
+
+	api := &API{
+		PublicKey:                 key,
+		PrivateKey:                key,
+		SigningMethod:             jwt.SigningMethodHS256,
+		TokenReviewUsernamePrefix: "ag:",
+		TokenReviewGroupsPrefix:   "ag:",
+	}
+
+	ws := &restful.WebService{}
+	api.registerK8sAuthenticator(ws)
+
+	container := restful.NewContainer()
+	container.Add(ws)
+
+	server := httptest.NewServer(container)
+	t.Cleanup(server.Close)
+
+	return api, server
+}
+
+func signedToken(t *testing.T, api *API, audience string) string {
+	claims := auth.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "bob",
+			Audience:  audience,
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		ExtraClaims: auth.ExtraClaims{Groups: []string{"dev"}},
+	}
+
+	_, token, err := api.createToken("bob", claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func reviewToken(t *testing.T, server *httptest.Server, req *authv1.TokenReview) *authv1.TokenReview {
+	ba, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(server.URL+"/review-token", restful.MIME_JSON, bytes.NewReader(ba))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status: ", resp.StatusCode)
+	}
+
+	tr := &authv1.TokenReview{}
+	if err := json.NewDecoder(resp.Body).Decode(tr); err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestTokenReview(t *testing.T) {
+	api, server := testTokenReviewAPI(t)
+
+	for _, tc := range []struct {
+		name            string
+		apiVersion      string
+		tokenAudience   string
+		audiences       []string
+		expectedVersion string
+		authenticated   bool
+		expectedAuds    []string
+	}{
+		{"v1", "authentication.k8s.io/v1", "", nil, "authentication.k8s.io/v1", true, nil},
+		{"v1beta1", "authentication.k8s.io/v1beta1", "", nil, "authentication.k8s.io/v1beta1", true, nil},
+		{"unknown version", "authentication.k8s.io/v2", "", nil, "authentication.k8s.io/v1", true, nil},
+		{"no version", "", "", nil, "authentication.k8s.io/v1", true, nil},
+		{"any audience", "authentication.k8s.io/v1", "", []string{"api"}, "authentication.k8s.io/v1", true, nil},
+		{"token audience", "authentication.k8s.io/v1", "api", nil, "authentication.k8s.io/v1", true, []string{"api"}},
+		{"requested audience", "authentication.k8s.io/v1", "api", []string{"other", "api"}, "authentication.k8s.io/v1", true, []string{"api"}},
+		{"other audience", "authentication.k8s.io/v1beta1", "api", []string{"other"}, "authentication.k8s.io/v1beta1", false, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := reviewToken(t, server, &authv1.TokenReview{
+				TypeMeta: metav1.TypeMeta{APIVersion: tc.apiVersion, Kind: "TokenReview"},
+				Spec: authv1.TokenReviewSpec{
+					Token:     signedToken(t, api, tc.tokenAudience),
+					Audiences: tc.audiences,
+				},
+			})
+
+			if tr.APIVersion != tc.expectedVersion || tr.Kind != "TokenReview" {
+				t.Errorf("expected %s TokenReview, got %s %s", tc.expectedVersion, tr.APIVersion, tr.Kind)
+			}
+
+			if tr.Status.Authenticated != tc.authenticated {
+				t.Fatalf("expected authenticated %v, got %+v", tc.authenticated, tr.Status)
+			}
+
+			if !tc.authenticated {
+				if tr.Status.Error != "invalid token" {
+					t.Error("unexpected error: ", tr.Status.Error)
+				}
+				return
+			}
+
+			if !reflect.DeepEqual(tr.Status.Audiences, tc.expectedAuds) {
+				t.Errorf("expected audiences %q, got %q", tc.expectedAuds, tr.Status.Audiences)
+			}
+
+			user := tr.Status.User
+			if user.Username != "ag:bob" || user.UID != "bob" || !reflect.DeepEqual(user.Groups, []string{"ag:dev"}) {
+				t.Error("unexpected user: ", user)
+			}
+		})
+	}
+}
+
+func TestTokenReviewInvalidToken(t *testing.T) {
+	_, server := testTokenReviewAPI(t)
+
+	other := &API{PrivateKey: []byte("other key"), SigningMethod: jwt.SigningMethodHS256}
+
+	for name, token := range map[string]string{
+		"garbage":   "garbage",
+		"other key": signedToken(t, other, ""),
+	} {
+		tr := reviewToken(t, server, &authv1.TokenReview{Spec: authv1.TokenReviewSpec{Token: token}})
+		if tr.Status.Authenticated || tr.Status.Error != "invalid token" {
+			t.Errorf("%s: unexpected status: %+v", name, tr.Status)
+		}
+	}
+}
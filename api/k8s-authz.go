@@ -0,0 +1,86 @@
+package api
+
+import (
+	"net/http"
+
+	restful "github.com/emicklei/go-restful"
+	authzv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/mcluseau/autentigo/pkg/audit"
+	"github.com/mcluseau/autentigo/pkg/rbac"
+)
+
+func (api *API) registerK8sAuthorizer(ws *restful.WebService) {
+	ws.
+		Route(ws.POST("/review-access").
+			To(api.k8sAccessReview).
+			Doc("Kubernetes subject access review").
+			Consumes("application/json").
+			Produces("application/json").
+			Reads(authzv1.SubjectAccessReview{}).
+			Writes(authzv1.SubjectAccessReview{}))
+}
+
+func (api *API) k8sAccessReview(request *restful.Request, response *restful.Response) {
+	req := &authzv1.SubjectAccessReview{}
+	if err := request.ReadEntity(req); err != nil {
+		response.WriteError(http.StatusBadRequest, err)
+		return
+	}
+
+	spec := req.Spec
+
+	attrs := rbac.Attributes{
+		User: &rbac.User{
+			Name:   spec.User,
+			Groups: spec.Groups,
+		},
+	}
+
+	if ra := spec.ResourceAttributes; ra != nil {
+		attrs.ResourceRequest = true
+		attrs.Verb = ra.Verb
+		attrs.Namespace = ra.Namespace
+		attrs.APIGroup = ra.Group
+		attrs.Resource = ra.Resource
+		attrs.Subresource = ra.Subresource
+		attrs.Name = ra.Name
+	} else if nra := spec.NonResourceAttributes; nra != nil {
+		attrs.Verb = nra.Verb
+		attrs.Path = nra.Path
+	}
+
+	decision, reason := rbac.NoOpinion, "no authorization rules"
+	if api.Authorizer != nil {
+		decision, reason = api.Authorizer.Authorize(attrs)
+	}
+
+	event := api.auditEvent(request, audit.AccessReview, spec.User)
+	event.Success = decision == rbac.Allow
+	event.Reason = reason
+	event.Details = map[string]interface{}{
+		"decision": decision.String(),
+		"verb":     attrs.Verb,
+	}
+	if attrs.ResourceRequest {
+		event.Details["namespace"] = attrs.Namespace
+		event.Details["resource"] = attrs.Resource
+		event.Details["name"] = attrs.Name
+	} else {
+		event.Details["path"] = attrs.Path
+	}
+	audit.Log(event)
+
+	response.WriteEntity(&authzv1.SubjectAccessReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: authzv1.SchemeGroupVersion.String(),
+			Kind:       "SubjectAccessReview",
+		},
+		Status: authzv1.SubjectAccessReviewStatus{
+			Allowed: decision == rbac.Allow,
+			Denied:  decision == rbac.Deny,
+			Reason:  reason,
+		},
+	})
+}
@@ -2,12 +2,131 @@ package api
 
 import (
 	"net/http"
+	"strings"
 	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/emicklei/go-restful"
 	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/rbac"
 )
 
+// KeystoneConfig configures the Keystone v3 emulation.
+type KeystoneConfig struct {
+	// DefaultDomain of users and projects.
+	DefaultDomain KeystoneDomain `json:"default_domain"`
+
+	// AdminRole is the role required to validate or revoke other users' tokens.
+	AdminRole string `json:"admin_role"`
+
+	// Projects users can scope their tokens to.
+	Projects []KeystoneProjectConfig `json:"projects"`
+
+	// Catalog of services returned with project-scoped tokens.
+	Catalog []KeystoneService `json:"catalog"`
+}
+
+// KeystoneProjectConfig is a project users can scope their tokens to.
+type KeystoneProjectConfig struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Domain string `json:"domain"` // ID or name, default domain if empty
+
+	// Groups whose members can scope to this project.
+	Groups []string `json:"groups"`
+	// Roles given in this project, in addition to the RBAC roles.
+	Roles []string `json:"roles"`
+}
+
+func (kc *KeystoneConfig) defaultDomain() KeystoneDomain {
+	d := kc.DefaultDomain
+	if d.ID == "" && d.Name == "" {
+		return KeystoneDomain{ID: "default", Name: "Default"}
+	}
+	if d.ID == "" {
+		d.ID = d.Name
+	}
+	if d.Name == "" {
+		d.Name = d.ID
+	}
+	return d
+}
+
+// domain returns the domain with the given ID or name.
+func (kc *KeystoneConfig) domain(ref KeystoneDomain) KeystoneDomain {
+	def := kc.defaultDomain()
+	if (ref.ID == "" && ref.Name == "") || ref.ID == def.ID || ref.Name == def.Name {
+		return def
+	}
+
+	if ref.ID == "" {
+		ref.ID = ref.Name
+	}
+	if ref.Name == "" {
+		ref.Name = ref.ID
+	}
+	return ref
+}
+
+func (kc *KeystoneConfig) adminRole() string {
+	if kc.AdminRole == "" {
+		return "admin"
+	}
+	return kc.AdminRole
+}
+
+// project returns the project matching the scope and whether the user is a
+// member of it.
+func (kc *KeystoneConfig) project(scope *KeystoneProjectScope, groups []string) (p *KeystoneProjectConfig, member bool) {
+	domain := kc.domain(scope.Domain)
+
+	for i := range kc.Projects {
+		project := &kc.Projects[i]
+
+		if scope.ID != "" {
+			if project.ID != scope.ID {
+				continue
+			}
+		} else if project.Name != scope.Name || kc.domain(KeystoneDomain{ID: project.Domain}) != domain {
+			continue
+		}
+
+		for _, pg := range project.Groups {
+			for _, ug := range groups {
+				if pg == ug {
+					return project, true
+				}
+			}
+		}
+		return project, false
+	}
+
+	return nil, false
+}
+
+// KeystoneDomain is a Keystone domain reference
+type KeystoneDomain struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// KeystoneService is a service of the catalog
+type KeystoneService struct {
+	ID        string             `json:"id"`
+	Name      string             `json:"name"`
+	Type      string             `json:"type"`
+	Endpoints []KeystoneEndpoint `json:"endpoints"`
+}
+
+// KeystoneEndpoint is an endpoint of a service of the catalog
+type KeystoneEndpoint struct {
+	ID        string `json:"id"`
+	Interface string `json:"interface"`
+	Region    string `json:"region"`
+	RegionID  string `json:"region_id"`
+	URL       string `json:"url"`
+}
+
 // KeystoneAuthReq is a Keystone API like auth request
 type KeystoneAuthReq struct {
 	Auth *KeystoneAuth `json:"auth"`
@@ -19,30 +138,72 @@ type KeystoneAuth struct {
 		Methods  []string `json:"methods"`
 		Password struct {
 			User struct {
-				ID       string `json:"id,omitempty"`
-				Name     string `json:"name,omitempty"`
-				Password string `json:"password"`
-				Domain   struct {
-					ID   string `json:"id,omitempty"`
-					Name string `json:"name,omitempty"`
-				} `json:"domain"`
+				ID       string         `json:"id,omitempty"`
+				Name     string         `json:"name,omitempty"`
+				Password string         `json:"password"`
+				Domain   KeystoneDomain `json:"domain"`
 			} `json:"user"`
 		} `json:"password"`
+		Token struct {
+			ID string `json:"id"`
+		} `json:"token"`
 	} `json:"identity"`
+	Scope *KeystoneScope `json:"scope,omitempty"`
+}
+
+// KeystoneScope is the scope of a Keystone auth request
+type KeystoneScope struct {
+	Project *KeystoneProjectScope `json:"project,omitempty"`
+	Domain  *KeystoneDomain       `json:"domain,omitempty"`
+}
+
+// KeystoneProjectScope is a project reference
+type KeystoneProjectScope struct {
+	ID     string         `json:"id,omitempty"`
+	Name   string         `json:"name,omitempty"`
+	Domain KeystoneDomain `json:"domain"`
 }
 
 // KeystoneAuthResponse is a Keystone API like auth response
 type KeystoneAuthResponse struct {
 	Token struct {
+		Methods   []string  `json:"methods"`
+		AuditIDs  []string  `json:"audit_ids"`
 		IssuedAt  time.Time `json:"issued_at"`
 		ExpiresAt time.Time `json:"expires_at"`
 		User      struct {
-			ID   string `json:"id,omitempty"`
-			Name string `json:"name,omitempty"`
+			ID     string         `json:"id,omitempty"`
+			Name   string         `json:"name,omitempty"`
+			Domain KeystoneDomain `json:"domain"`
 		} `json:"user"`
+		Project *KeystoneProject  `json:"project,omitempty"`
+		Roles   []KeystoneRole    `json:"roles,omitempty"`
+		Catalog []KeystoneService `json:"catalog,omitempty"`
 	} `json:"token"`
 }
 
+// KeystoneProject is the project of a token
+type KeystoneProject struct {
+	ID     string         `json:"id"`
+	Name   string         `json:"name"`
+	Domain KeystoneDomain `json:"domain"`
+}
+
+// KeystoneRole is a role of a token
+type KeystoneRole struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// keystoneClaims are the claims of tokens emitted by the Keystone emulation
+type keystoneClaims struct {
+	auth.Claims
+	Methods    []string         `json:"keystone_methods,omitempty"`
+	UserDomain *KeystoneDomain  `json:"keystone_user_domain,omitempty"`
+	Project    *KeystoneProject `json:"keystone_project,omitempty"`
+	Roles      []string         `json:"keystone_roles,omitempty"`
+}
+
 func (api *API) registerKeystone(ws *restful.WebService) {
 	path := "/v3/auth/tokens"
 
@@ -52,6 +213,8 @@ func (api *API) registerKeystone(ws *restful.WebService) {
 			Doc("Authenticate using a Keystone-style request").
 			Consumes("application/json").
 			Produces("application/json").
+			Param(audienceParameter()).
+			Param(restful.QueryParameter("nocatalog", "Do not return the service catalog.")).
 			Reads(KeystoneAuthReq{}).
 			Writes(KeystoneAuthResponse{}))
 
@@ -64,6 +227,7 @@ func (api *API) registerKeystone(ws *restful.WebService) {
 				"X-Auth-Token", "A valid authentication token for an administrative user.")).
 			Param(restful.HeaderParameter(
 				"X-Subject-Token", "The authentication token.")).
+			Param(restful.QueryParameter("nocatalog", "Do not return the service catalog.")).
 			Writes(KeystoneAuthResponse{}))
 
 	ws.
@@ -74,6 +238,15 @@ func (api *API) registerKeystone(ws *restful.WebService) {
 				"X-Auth-Token", "A valid authentication token for an administrative user.")).
 			Param(restful.HeaderParameter(
 				"X-Subject-Token", "The authentication token.")))
+
+	ws.
+		Route(ws.DELETE(path).
+			To(api.keystoneRevoke).
+			Doc("Revokes a token").
+			Param(restful.HeaderParameter(
+				"X-Auth-Token", "A valid authentication token for an administrative user.")).
+			Param(restful.HeaderParameter(
+				"X-Subject-Token", "The authentication token.")))
 }
 
 func (api *API) keystoneAuthenticate(request *restful.Request, response *restful.Response) {
@@ -90,17 +263,85 @@ func (api *API) keystoneAuthenticate(request *restful.Request, response *restful
 		return
 	}
 	if authReq.Auth == nil {
+		api.auditLoginFailure(request, "", "no authentication provided")
 		response.WriteErrorString(http.StatusUnauthorized, "No authentication provided")
 		return
 	}
 
-	user := authReq.Auth.Identity.Password.User
-	login := user.ID
-	if login == "" {
-		login = user.Name
+	var (
+		login      string
+		userDomain KeystoneDomain
+		claims     auth.Claims
+		err        error
+	)
+
+	identity := authReq.Auth.Identity
+	method := ""
+	if len(identity.Methods) != 0 {
+		method = identity.Methods[0]
+	}
+
+	switch method {
+	case "password":
+		user := identity.Password.User
+		userDomain = api.Keystone.domain(user.Domain)
+
+		login = user.ID
+		if login == "" {
+			login = user.Name
+			if userDomain != api.Keystone.defaultDomain() {
+				// domain-qualified user name
+				login += "@" + userDomain.Name
+			}
+		}
+
+		var c jwt.Claims
+		c, err = api.authenticate(request, login, user.Password)
+		if err == nil {
+			claims = c.(auth.Claims)
+		}
+
+	case "token":
+		// re-scope an existing token
+		orig, tokenErr := api.keystoneToken(identity.Token.ID)
+		if tokenErr != nil || orig.Methods == nil {
+			// only tokens issued by this endpoint can be re-scoped
+			api.auditLoginFailure(request, "", "invalid token")
+			err = ErrInvalidAuthentication
+			break
+		}
+
+		// the token only holds mapped claims: the user is looked up again
+		lookup, ok := api.Authenticator.(UserLookup)
+		if !ok {
+			api.auditLoginFailure(request, orig.Subject, "user lookups not supported")
+			response.WriteErrorString(http.StatusNotImplemented, "The authentication backend does not support user lookups.")
+			return
+		}
+
+		login = orig.Subject
+		if orig.UserDomain != nil {
+			userDomain = *orig.UserDomain
+		} else {
+			userDomain = api.Keystone.defaultDomain()
+		}
+
+		var c jwt.Claims
+		c, err = api.lookup(request, lookup, login)
+		if err == nil {
+			claims = c.(auth.Claims)
+			if claims.ExpiresAt > orig.ExpiresAt {
+				// a re-scoped token can't outlive the original one
+				claims.ExpiresAt = orig.ExpiresAt
+			}
+		}
+
+	default:
+		api.auditLoginFailure(request, "", "unsupported method: "+method)
+		response.WriteErrorString(http.StatusUnauthorized, "Unsupported authentication method")
+		return
 	}
 
-	claims, err := api.authenticate(login, user.Password)
 	if err == ErrInvalidAuthentication {
 		response.WriteErrorString(http.StatusUnauthorized, "Authentication failed")
 		return
@@ -108,34 +349,135 @@ func (api *API) keystoneAuthenticate(request *restful.Request, response *restful
 		panic(err)
 	}
 
-	_, tokenString, err := api.createToken(login, claims)
+	var project *KeystoneProject
+	roles := api.rolesOf(claims.Subject, claims.Groups)
 
+	if scope := authReq.Auth.Scope; scope != nil {
+		if scope.Project == nil {
+			response.WriteErrorString(http.StatusBadRequest, "Only project scopes are supported")
+			return
+		}
+
+		p, member := api.Keystone.project(scope.Project, claims.Groups)
+		if !member {
+			api.auditLoginFailure(request, login, "not a member of the requested project")
+			response.WriteErrorString(http.StatusUnauthorized, "Not authorized for the requested project")
+			return
+		}
+
+		project = &KeystoneProject{
+			ID:     p.ID,
+			Name:   p.Name,
+			Domain: api.Keystone.domain(KeystoneDomain{ID: p.Domain}),
+		}
+		roles = append(roles, p.Roles...)
+	}
+
+	mapped, err := api.mapClaims(request, claims)
 	if err != nil {
 		panic(err)
 	}
 
-	stdClaims, err := api.checkToken(tokenString)
+	m, err := toMapClaims(mapped)
 	if err != nil {
 		panic(err)
 	}
 
-	authResp := newKeystoneAuthRespFromClaims(stdClaims)
+	m["keystone_methods"] = []string{method}
+	m["keystone_user_domain"] = userDomain
+	if project != nil {
+		m["keystone_project"] = project
+	}
+	if len(roles) != 0 {
+		m["keystone_roles"] = roles
+	}
+
+	_, tokenString, err := api.createToken(login, m)
+	if err != nil {
+		panic(err)
+	}
+
+	kClaims, err := api.keystoneToken(tokenString)
+	if err != nil {
+		panic(err)
+	}
+
+	api.auditTokenIssued(request, &kClaims.Claims)
 
 	response.Header().Set("X-Subject-Token", tokenString)
-	response.WriteHeaderAndEntity(http.StatusCreated, authResp)
+	response.WriteHeaderAndEntity(http.StatusCreated, api.newKeystoneAuthResp(request, kClaims))
+}
+
+// keystoneToken parses a token, including its Keystone claims.
+func (api *API) keystoneToken(tokenString string) (*keystoneClaims, error) {
+	claims := &keystoneClaims{}
+
+	if err := api.parseToken(tokenString, claims); err != nil {
+		return nil, err
+	}
+
+	if err := api.checkIdentityToken(tokenString, &claims.StandardClaims); err != nil {
+		return nil, err
+	}
+
+	if api.revoked.IsRevoked(claims.Id) {
+		return nil, ErrRevokedToken
+	}
+
+	return claims, nil
+}
+
+// rolesOf returns the RBAC roles of the user.
+func (api *API) rolesOf(user string, groups []string) []string {
+	if api.Roles == nil {
+		return nil
+	}
+	return api.Roles.RolesOf(&rbac.User{Name: user, Groups: groups})
 }
 
-func newKeystoneAuthRespFromClaims(claims *auth.Claims) *KeystoneAuthResponse {
+func (api *API) newKeystoneAuthResp(request *restful.Request, claims *keystoneClaims) *KeystoneAuthResponse {
 	authResp := &KeystoneAuthResponse{}
-	authResp.Token.IssuedAt = time.Unix(claims.IssuedAt, 0)
-	authResp.Token.ExpiresAt = time.Unix(claims.ExpiresAt, 0)
-	authResp.Token.User.ID = claims.Subject
-	authResp.Token.User.Name = claims.Subject
+
+	token := &authResp.Token
+	token.Methods = claims.Methods
+	if len(token.Methods) == 0 {
+		token.Methods = []string{"password"}
+	}
+	if claims.Id != "" {
+		token.AuditIDs = []string{claims.Id}
+	}
+	token.IssuedAt = time.Unix(claims.IssuedAt, 0)
+	token.ExpiresAt = time.Unix(claims.ExpiresAt, 0)
+	token.User.ID = claims.Subject
+	token.User.Name = claims.Subject
+	if claims.UserDomain != nil {
+		token.User.Domain = *claims.UserDomain
+		token.User.Name = strings.TrimSuffix(claims.Subject, "@"+claims.UserDomain.Name)
+	} else {
+		token.User.Domain = api.Keystone.defaultDomain()
+	}
+
+	roles := claims.Roles
+	if claims.Methods == nil {
+		// not emitted by the Keystone emulation
+		roles = api.rolesOf(claims.Subject, claims.Groups)
+	}
+	for _, role := range roles {
+		token.Roles = append(token.Roles, KeystoneRole{ID: role, Name: role})
+	}
+
+	token.Project = claims.Project
+	if token.Project != nil && request.QueryParameter("nocatalog") == "" {
+		token.Catalog = api.Keystone.Catalog
+	}
+
 	return authResp
 }
 
 func (api *API) keystoneCheck(request *restful.Request, response *restful.Response) {
-	api.keystoneCheckClaims(request, response)
+	if api.keystoneCheckClaims(request, response) == nil {
+		return
+	}
 	response.Header().Set("Content-Length", "0")
 	response.WriteHeader(http.StatusOK)
 }
@@ -147,23 +489,55 @@ func (api *API) keystoneShow(request *restful.Request, response *restful.Respons
 		return
 	}
 
-	response.WriteHeaderAndEntity(http.StatusOK, newKeystoneAuthRespFromClaims(claims))
+	response.WriteHeaderAndEntity(http.StatusOK, api.newKeystoneAuthResp(request, claims))
+}
+
+func (api *API) keystoneRevoke(request *restful.Request, response *restful.Response) {
+	claims := api.keystoneCheckClaims(request, response)
+
+	if claims == nil {
+		return
+	}
+
+	api.revoked.Revoke(claims.Id, claims.ExpiresAt)
+	api.auditTokenRevoked(request, &claims.Claims)
+
+	response.WriteHeader(http.StatusNoContent)
 }
 
 // return nil iff check fails (response already filled)
-func (api *API) keystoneCheckClaims(request *restful.Request, response *restful.Response) *auth.Claims {
-	authToken := request.HeaderParameter("X-Auth-Token")
-	if _, err := api.checkToken(authToken); err != nil {
+func (api *API) keystoneCheckClaims(request *restful.Request, response *restful.Response) *keystoneClaims {
+	authClaims, err := api.keystoneToken(request.HeaderParameter("X-Auth-Token"))
+	if err != nil {
 		response.WriteError(http.StatusUnauthorized, err)
 		return nil
 	}
 
-	subjectToken := request.HeaderParameter("X-Subject-Token")
-	claims, err := api.checkToken(subjectToken)
+	subjectClaims, err := api.keystoneToken(request.HeaderParameter("X-Subject-Token"))
 	if err != nil {
-		response.WriteError(http.StatusBadRequest, err)
+		response.WriteErrorString(http.StatusNotFound, "Could not find token")
+		return nil
+	}
+
+	// users can check their own tokens, admins can check any token
+	if authClaims.Subject != subjectClaims.Subject && !api.keystoneIsAdmin(authClaims) {
+		response.WriteErrorString(http.StatusForbidden, "You are not authorized to perform the requested action")
 		return nil
 	}
 
-	return claims
+	return subjectClaims
+}
+
+func (api *API) keystoneIsAdmin(claims *keystoneClaims) bool {
+	roles := claims.Roles
+	if claims.Methods == nil {
+		roles = api.rolesOf(claims.Subject, claims.Groups)
+	}
+
+	for _, role := range roles {
+		if role == api.Keystone.adminRole() {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+
+	"github.com/mcluseau/autentigo/pkg/lifetime"
+)
+
+const tokenPolicyAttribute = "autentigo.token-policy"
+
+// tokenExpiry returns the expiry of a token emitted at now for the identity,
+// and records the chosen policy in the request for the audit.
+func (api *API) tokenExpiry(request *restful.Request, id *Identity, now time.Time) time.Time {
+	policy, d := lifetime.Config{
+		Default:  api.TokenDuration,
+		Max:      api.TokenMaxDuration,
+		Policies: api.TokenPolicies,
+	}.Lifetime(lifetime.Request{
+		User:    id.Subject,
+		Groups:  id.Groups,
+		Backend: api.Backend,
+		Route:   request.Request.URL.Path,
+	})
+
+	request.SetAttribute(tokenPolicyAttribute, policy)
+	return now.Add(d)
+}
+
+// tokenPolicy returns the policy chosen for the token emitted by the request.
+func tokenPolicy(request *restful.Request) string {
+	policy, _ := request.Attribute(tokenPolicyAttribute).(string)
+	return policy
+}
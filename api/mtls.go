@@ -0,0 +1,85 @@
+package api
+
+import (
+	"crypto/x509"
+	"net/http"
+
+	restful "github.com/emicklei/go-restful"
+
+	"github.com/mcluseau/autentigo/pkg/server"
+)
+
+func (api *API) registerMTLS(ws *restful.WebService) {
+	ws.
+		Route(ws.GET("/mtls").
+			To(api.mtlsAuthenticate).
+			Doc("Authenticate using the TLS client certificate").
+			Param(setCookieHeader()).
+			Param(setCookieDomainHeader()).
+			Param(setCookieInsecureHeader()).
+			Param(audienceParameter()).
+			Produces("application/json").
+			Writes(AuthResponse{}))
+}
+
+func (api *API) mtlsAuthenticate(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			WriteError(err.(error), response)
+		}
+	}()
+
+	cert := server.ClientCertificate(request.Request)
+	if cert == nil {
+		api.auditLoginFailure(request, "", "no verified client certificate")
+		response.WriteErrorString(http.StatusUnauthorized, "No verified client certificate.\n")
+		return
+	}
+
+	user := api.certificateUser(cert)
+	if user == "" {
+		api.auditLoginFailure(request, "", "no "+api.MTLSUsername+" in client certificate")
+		response.WriteErrorString(http.StatusUnauthorized, "No user name found in the client certificate.\n")
+		return
+	}
+
+	lookup, ok := api.Authenticator.(UserLookup)
+	if !ok {
+		response.WriteErrorString(http.StatusNotImplemented, "The authentication backend does not support user lookups.\n")
+		return
+	}
+
+	claims, err := api.lookup(request, lookup, user)
+	if err == ErrInvalidAuthentication {
+		response.WriteErrorString(http.StatusUnauthorized, "Authentication failed.\n")
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	api.writeToken(request, response, user, claims)
+}
+
+// certificateUser returns the user name given by the certificate
+func (api *API) certificateUser(cert *x509.Certificate) string {
+	var values []string
+
+	switch api.MTLSUsername {
+	case "", "cn":
+		values = []string{cert.Subject.CommonName}
+	case "email":
+		values = cert.EmailAddresses
+	case "dns":
+		values = cert.DNSNames
+	case "uri":
+		for _, u := range cert.URIs {
+			values = append(values, u.String())
+		}
+	}
+
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
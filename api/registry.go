@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/mcluseau/autentigo/pkg/settings"
+)
+
+// AuthenticatorFactory creates the Authenticators of a backend.
+type AuthenticatorFactory struct {
+	// Description of the backend.
+	Description string
+
+	// NewConfig returns a pointer to the configuration struct of the backend,
+	// filled with its default values (see the settings package for tags).
+	NewConfig func() interface{}
+
+	// New creates an Authenticator from a configuration given by NewConfig.
+	New func(config interface{}) (Authenticator, error)
+}
+
+var authenticators = map[string]AuthenticatorFactory{}
+
+// RegisterAuthenticator registers a backend factory under the given name.
+func RegisterAuthenticator(name string, factory AuthenticatorFactory) {
+	if _, exists := authenticators[name]; exists {
+		panic("authenticator already registered: " + name)
+	}
+	authenticators[name] = factory
+}
+
+// AuthenticatorNames returns the sorted names of the registered backends.
+func AuthenticatorNames() (names []string) {
+	for name := range authenticators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// AuthenticatorFactoryFor returns the factory registered under the given name.
+func AuthenticatorFactoryFor(name string) (factory AuthenticatorFactory, ok bool) {
+	factory, ok = authenticators[name]
+	return
+}
+
+// AuthenticatorConfig returns the configuration of the named backend, read
+// from its raw configuration section then from the environment.
+func AuthenticatorConfig(name string, raw json.RawMessage) (config interface{}, err error) {
+	factory, ok := authenticators[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown authenticator: %q", name)
+	}
+
+	config = factory.NewConfig()
+	if err = settings.Load(config, raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return
+}
+
+// NewAuthenticator creates an Authenticator of the named backend.
+func NewAuthenticator(name string, config interface{}) (Authenticator, error) {
+	factory, ok := authenticators[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown authenticator: %q", name)
+	}
+	return factory.New(config)
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// revocationList holds the IDs of revoked tokens until they expire.
+type revocationList struct {
+	mutex   sync.Mutex
+	revoked map[string]int64
+}
+
+// Revoke the token with the given ID (jti) and expiry.
+func (l *revocationList) Revoke(id string, expiresAt int64) {
+	if id == "" {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.revoked == nil {
+		l.revoked = map[string]int64{}
+	}
+
+	// forget expired tokens, as they are rejected anyway
+	now := time.Now().Unix()
+	for revokedID, exp := range l.revoked {
+		if exp < now {
+			delete(l.revoked, revokedID)
+		}
+	}
+
+	l.revoked[id] = expiresAt
+}
+
+// IsRevoked returns true if the token with the given ID (jti) is revoked.
+func (l *revocationList) IsRevoked(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, revoked := l.revoked[id]
+	return revoked
+}
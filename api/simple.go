@@ -17,6 +17,7 @@ func (api *API) registerSimple(ws *restful.WebService) {
 			Param(setCookieHeader()).
 			Param(setCookieDomainHeader()).
 			Param(setCookieInsecureHeader()).
+			Param(audienceParameter()).
 			Reads(AuthReq{}).
 			Writes(AuthResponse{}))
 }
@@ -48,11 +49,13 @@ func (api *API) simpleAuthenticate(request *restful.Request, response *restful.R
 	}
 
 	if authReq.User == "" {
+		api.auditLoginFailure(request, "", "no user given")
 		response.WriteErrorString(http.StatusUnauthorized, "No user given.")
 		return
 	}
 
 	if authReq.Password == "" {
+		api.auditLoginFailure(request, authReq.User, "no password given")
 		response.WriteErrorString(http.StatusUnauthorized, "No password given.")
 		return
 	}
@@ -76,7 +79,7 @@ func setCookieDomainHeader() *restful.Parameter {
 }
 
 func (api *API) writeAuthResponse(request *restful.Request, response *restful.Response, user, password string) {
-	claims, err := api.authenticate(user, password)
+	claims, err := api.authenticate(request, user, password)
 	if err == ErrInvalidAuthentication {
 		response.WriteErrorString(http.StatusUnauthorized, "Authentication failed.\n")
 		return
@@ -84,17 +87,30 @@ func (api *API) writeAuthResponse(request *restful.Request, response *restful.Re
 		panic(err)
 	}
 
-	_, tokenString, err := api.createToken(user, claims)
+	api.writeToken(request, response, user, claims)
+}
+
+func (api *API) writeToken(request *restful.Request, response *restful.Response, user string, claims jwt.Claims) {
+	claims, err := api.mapClaims(request, claims)
+	if err != nil {
+		panic(err)
+	}
+
+	token, tokenString, err := api.createToken(user, claims)
 
 	if err != nil {
 		panic(err)
 	}
 
-	_, err = api.checkToken(tokenString)
+	stdClaims, err := api.checkToken(tokenString)
 	if err != nil {
 		panic(err)
 	}
 
+	api.auditTokenIssued(request, stdClaims)
+
+	claims = token.Claims
+
 	if cookieName := request.HeaderParameter("X-Set-Cookie"); cookieName != "" {
 		// with only set the cookie
 		isSecure := true
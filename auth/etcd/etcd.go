@@ -5,8 +5,9 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
-	"os"
 	"path"
 	"time"
 
@@ -15,10 +16,31 @@ import (
 
 	"github.com/mcluseau/autentigo/api"
 	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/settings"
 )
 
+// Config of the etcd backend
+type Config struct {
+	Prefix    string            `json:"prefix" env:"ETCD_PREFIX" required:"true" desc:"etcd prefix"`
+	Endpoints []string          `json:"endpoints" env:"ETCD_ENDPOINTS" required:"true" desc:"etcd endpoints"`
+	Timeout   settings.Duration `json:"timeout" env:"ETCD_TIMEOUT" desc:"lookup timeout"`
+}
+
+func init() {
+	api.RegisterAuthenticator("etcd", api.AuthenticatorFactory{
+		Description: "Looks up the user in etcd, with a key like prefix/user-name",
+		NewConfig: func() interface{} {
+			return &Config{Timeout: settings.Duration{Duration: 5 * time.Second}}
+		},
+		New: func(config interface{}) (api.Authenticator, error) {
+			c := config.(*Config)
+			return New(c.Prefix, c.Endpoints, c.Timeout.Duration), nil
+		},
+	})
+}
+
 // New Authenticator with etcd backend
-func New(prefix string, endpoints []string) api.Authenticator {
+func New(prefix string, endpoints []string, timeout time.Duration) api.Authenticator {
 	client, err := clientv3.New(clientv3.Config{
 		Endpoints: endpoints,
 	})
@@ -27,14 +49,6 @@ func New(prefix string, endpoints []string) api.Authenticator {
 		log.Fatal("failed to connect to etcd: ", err)
 	}
 
-	timeout := 5 * time.Second
-	if timeoutEnv := os.Getenv("ETCD_TIMEOUT"); timeoutEnv != "" {
-		timeout, err = time.ParseDuration(timeoutEnv)
-		if err != nil {
-			log.Fatalf("invalid ETCD_TIMEOUT %q: %v", timeoutEnv, timeout)
-		}
-	}
-
 	return &etcdAuth{
 		prefix:  prefix,
 		client:  client,
@@ -49,6 +63,10 @@ type etcdAuth struct {
 }
 
 var _ api.Authenticator = &etcdAuth{}
+var _ io.Closer = &etcdAuth{}
+var _ api.HealthChecker = &etcdAuth{}
+var _ api.UserLookup = &etcdAuth{}
+var _ api.ContextAuthenticator = &etcdAuth{}
 
 // User describe an user stored in etcd
 type User struct {
@@ -57,40 +75,74 @@ type User struct {
 }
 
 func (a *etcdAuth) Authenticate(user, password string, expiresAt time.Time) (claims jwt.Claims, err error) {
+	return api.Authenticate(a, user, password, expiresAt)
+}
 
-	ba := sha256.Sum256([]byte(password))
+func (a *etcdAuth) AuthenticateContext(ctx context.Context, req api.RequestInfo) (id *api.Identity, err error) {
+	ba := sha256.Sum256([]byte(req.Password))
 	passwordHash := hex.EncodeToString(ba[:])
 
-	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
-	defer cancel()
-
-	resp, err := a.client.Get(ctx, path.Join(a.prefix, user))
+	u, err := a.getUser(ctx, req.User)
 	if err != nil {
 		return
 	}
 
-	if len(resp.Kvs) == 0 {
+	if u.PasswordHash != passwordHash {
 		err = api.ErrInvalidAuthentication
 		return
 	}
 
-	u := User{}
-	if err = json.Unmarshal(resp.Kvs[0].Value, &u); err != nil {
+	return &api.Identity{Subject: req.User, ExtraClaims: u.ExtraClaims}, nil
+}
+
+func (a *etcdAuth) Lookup(user string, expiresAt time.Time) (claims jwt.Claims, err error) {
+	u, err := a.getUser(context.Background(), user)
+	if err != nil {
 		return
 	}
 
-	if u.PasswordHash != passwordHash {
+	id := &api.Identity{Subject: user, ExtraClaims: u.ExtraClaims}
+	return id.Claims(time.Now(), expiresAt), nil
+}
+
+func (a *etcdAuth) getUser(ctx context.Context, user string) (u *User, err error) {
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+
+	resp, err := a.client.Get(ctx, path.Join(a.prefix, user))
+	if err != nil {
+		return
+	}
+
+	if len(resp.Kvs) == 0 {
 		err = api.ErrInvalidAuthentication
 		return
 	}
 
-	claims = auth.Claims{
-		StandardClaims: jwt.StandardClaims{
-			IssuedAt:  time.Now().Unix(),
-			ExpiresAt: expiresAt.Unix(),
-			Subject:   user,
-		},
-		ExtraClaims: u.ExtraClaims,
+	u = &User{}
+	err = json.Unmarshal(resp.Kvs[0].Value, u)
+	return
+}
+
+// CheckHealth checks that at least one etcd endpoint answers.
+func (a *etcdAuth) CheckHealth(ctx context.Context) (err error) {
+	endpoints := a.client.Endpoints()
+	if len(endpoints) == 0 {
+		return errors.New("no etcd endpoint configured")
+	}
+
+	for _, endpoint := range endpoints {
+		if _, err = a.client.Status(ctx, endpoint); err == nil {
+			return
+		}
 	}
 	return
 }
+
+// Close the etcd client.
+func (a *etcdAuth) Close() error {
+	return a.client.Close()
+}
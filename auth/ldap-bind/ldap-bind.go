@@ -1,9 +1,11 @@
 package ldapbind
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/url"
 	"time"
 
@@ -12,6 +14,23 @@ import (
 	"gopkg.in/ldap.v2"
 )
 
+// Config of the ldap-bind backend
+type Config struct {
+	Server       string `json:"server" env:"LDAP_SERVER" required:"true" desc:"LDAP server URL"`
+	UserTemplate string `json:"user_template" env:"LDAP_USER" required:"true" desc:"LDAP user template (%s is substituted)"`
+}
+
+func init() {
+	api.RegisterAuthenticator("ldap-bind", api.AuthenticatorFactory{
+		Description: "Tries to bind to an LDAP server with the given credentials",
+		NewConfig:   func() interface{} { return &Config{} },
+		New: func(config interface{}) (api.Authenticator, error) {
+			c := config.(*Config)
+			return New(c.Server, c.UserTemplate), nil
+		},
+	})
+}
+
 // New Authenticator with ldap backend
 func New(server, userTemplate string) api.Authenticator {
 	u, err := url.Parse(server)
@@ -30,37 +49,71 @@ type auth struct {
 }
 
 var _ api.Authenticator = auth{}
+var _ api.HealthChecker = auth{}
+var _ api.ContextAuthenticator = auth{}
 
-func (a auth) Authenticate(user, password string, expiresAt time.Time) (jwt.Claims, error) {
-	var (
-		l   *ldap.Conn
-		err error
-	)
+func (a auth) dial(ctx context.Context) (l *ldap.Conn, err error) {
+	d := net.Dialer{}
 
+	var conn net.Conn
 	switch a.url.Scheme {
 	case "ldaps":
-		l, err = ldap.DialTLS("tcp", a.url.Host, &tls.Config{
+		conn, err = d.DialContext(ctx, "tcp", a.url.Host)
+		if err != nil {
+			return
+		}
+		conn = tls.Client(conn, &tls.Config{
 			InsecureSkipVerify: true,
 		})
 	case "ldap":
-		l, err = ldap.Dial("tcp", a.url.Host)
+		conn, err = d.DialContext(ctx, "tcp", a.url.Host)
+		if err != nil {
+			return
+		}
 	default:
-		log.Fatal("ldap: bad protocol: ", a.url.Scheme)
+		return nil, fmt.Errorf("ldap: bad protocol: %q", a.url.Scheme)
 	}
 
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	l = ldap.NewConn(conn, a.url.Scheme == "ldaps")
+	l.Start()
+	return
+}
+
+func (a auth) Authenticate(user, password string, expiresAt time.Time) (jwt.Claims, error) {
+	return api.Authenticate(a, user, password, expiresAt)
+}
+
+func (a auth) AuthenticateContext(ctx context.Context, req api.RequestInfo) (*api.Identity, error) {
+	l, err := a.dial(ctx)
 	if err != nil {
 		log.Print("LDAP dial error: ", err)
 		return nil, err
 	}
 
-	if err := l.Bind(fmt.Sprintf(a.userTemplate, user), password); err != nil {
+	defer l.Close()
+
+	if err := l.Bind(fmt.Sprintf(a.userTemplate, req.User), req.Password); err != nil {
 		log.Print("LDAP bind error: ", err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, api.ErrInvalidAuthentication
 	}
 
-	return jwt.StandardClaims{
-		IssuedAt:  time.Now().Unix(),
-		ExpiresAt: expiresAt.Unix(),
-		Subject:   user,
-	}, nil
+	return &api.Identity{Subject: req.User}, nil
+}
+
+// CheckHealth checks the LDAP server accepts connections.
+func (a auth) CheckHealth(ctx context.Context) error {
+	l, err := a.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	l.Close()
+	return nil
 }
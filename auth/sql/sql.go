@@ -1,10 +1,12 @@
 package sql
 
 import (
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"strings"
 	"time"
 
@@ -27,7 +29,25 @@ type sqlAuth struct {
 	table string
 }
 
-// New Authenticator with no backend
+// Config of the sql backend
+type Config struct {
+	Driver    string `json:"driver" env:"SQL_DRIVER" required:"true" desc:"SQL driver (ex: postgres)"`
+	DSN       string `json:"dsn" env:"SQL_DSN" required:"true" desc:"SQL destination"`
+	UserTable string `json:"user_table" env:"SQL_USER_TABLE" required:"true" desc:"SQL table with stored users"`
+}
+
+func init() {
+	api.RegisterAuthenticator("sql", api.AuthenticatorFactory{
+		Description: "Looks up the user in an SQL database",
+		NewConfig:   func() interface{} { return &Config{} },
+		New: func(config interface{}) (api.Authenticator, error) {
+			c := config.(*Config)
+			return New(c.Driver, c.DSN, c.UserTable), nil
+		},
+	})
+}
+
+// New Authenticator with sql backend
 func New(driver, dsn, table string) api.Authenticator {
 	db, err := sql.Open(driver, dsn)
 	if err != nil {
@@ -41,36 +61,66 @@ func New(driver, dsn, table string) api.Authenticator {
 }
 
 var _ api.Authenticator = sqlAuth{}
+var _ api.HealthChecker = sqlAuth{}
+var _ api.UserLookup = sqlAuth{}
+var _ api.ContextAuthenticator = sqlAuth{}
+var _ io.Closer = sqlAuth{}
 
 func (sa sqlAuth) Authenticate(user, password string, expiresAt time.Time) (claims jwt.Claims, err error) {
-	ba := sha256.Sum256([]byte(password))
-	passwordHash := hex.EncodeToString(ba[:])
+	return api.Authenticate(sa, user, password, expiresAt)
+}
 
-	u := User{}
-	groups := ""
-	query := fmt.Sprintf("select id, password_hash, display_name, email, email_verified, groups from %s where id=$1;", sa.table)
+func (sa sqlAuth) AuthenticateContext(ctx context.Context, req api.RequestInfo) (id *api.Identity, err error) {
+	ba := sha256.Sum256([]byte(req.Password))
+	passwordHash := hex.EncodeToString(ba[:])
 
-	err = sa.db.
-		QueryRow(query, user).
-		Scan(&u.Id, &u.PasswordHash, &u.DisplayName, &u.Email, &u.EmailVerified, &groups)
+	u, err := sa.getUser(ctx, req.User)
 	if err != nil {
 		return
 	}
-	u.Groups = strings.Split(groups, ",")
 
 	if u.PasswordHash != passwordHash {
 		err = api.ErrInvalidAuthentication
 		return
 	}
 
-	claims = auth.Claims{
-		StandardClaims: jwt.StandardClaims{
-			IssuedAt:  time.Now().Unix(),
-			ExpiresAt: expiresAt.Unix(),
-			Subject:   user,
-		},
-		ExtraClaims: u.ExtraClaims,
+	return &api.Identity{Subject: req.User, ExtraClaims: u.ExtraClaims}, nil
+}
+
+func (sa sqlAuth) Lookup(user string, expiresAt time.Time) (claims jwt.Claims, err error) {
+	u, err := sa.getUser(context.Background(), user)
+	if err != nil {
+		return
+	}
+
+	id := &api.Identity{Subject: user, ExtraClaims: u.ExtraClaims}
+	return id.Claims(time.Now(), expiresAt), nil
+}
+
+func (sa sqlAuth) getUser(ctx context.Context, user string) (u *User, err error) {
+	u = &User{}
+	groups := ""
+	query := fmt.Sprintf("select id, password_hash, display_name, email, email_verified, groups from %s where id=$1;", sa.table)
+
+	err = sa.db.
+		QueryRowContext(ctx, query, user).
+		Scan(&u.Id, &u.PasswordHash, &u.DisplayName, &u.Email, &u.EmailVerified, &groups)
+	if err == sql.ErrNoRows {
+		return nil, api.ErrInvalidAuthentication
+	} else if err != nil {
+		return nil, err
 	}
+	u.Groups = strings.Split(groups, ",")
 
 	return
 }
+
+// CheckHealth checks the database connection.
+func (sa sqlAuth) CheckHealth(ctx context.Context) error {
+	return sa.db.PingContext(ctx)
+}
+
+// Close the database.
+func (sa sqlAuth) Close() error {
+	return sa.db.Close()
+}
@@ -7,6 +7,16 @@ import (
 	"github.com/mcluseau/autentigo/api"
 )
 
+func init() {
+	api.RegisterAuthenticator("stupid", api.AuthenticatorFactory{
+		Description: "Always accepts the given credentials",
+		NewConfig:   func() interface{} { return &struct{}{} },
+		New: func(config interface{}) (api.Authenticator, error) {
+			return New(), nil
+		},
+	})
+}
+
 // New Authenticator with no backend
 func New() api.Authenticator {
 	return stupidAuth{}
@@ -15,8 +25,13 @@ func New() api.Authenticator {
 type stupidAuth struct{}
 
 var _ api.Authenticator = stupidAuth{}
+var _ api.UserLookup = stupidAuth{}
 
 func (sa stupidAuth) Authenticate(user, password string, expiresAt time.Time) (jwt.Claims, error) {
+	return sa.Lookup(user, expiresAt)
+}
+
+func (sa stupidAuth) Lookup(user string, expiresAt time.Time) (jwt.Claims, error) {
 	return jwt.StandardClaims{
 		IssuedAt:  time.Now().Unix(),
 		ExpiresAt: expiresAt.Unix(),
@@ -1,6 +1,7 @@
 package usersfile
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/csv"
 	"encoding/hex"
@@ -21,6 +22,21 @@ var yesValues = map[string]bool{
 	"1":    true,
 }
 
+// Config of the file backend
+type Config struct {
+	Path string `json:"path" env:"AUTH_FILE" required:"true" desc:"file containing the users"`
+}
+
+func init() {
+	api.RegisterAuthenticator("file", api.AuthenticatorFactory{
+		Description: "Reads users from a file (user:sha256 hash:display name:email:email verified:groups)",
+		NewConfig:   func() interface{} { return &Config{} },
+		New: func(config interface{}) (api.Authenticator, error) {
+			return New(config.(*Config).Path), nil
+		},
+	})
+}
+
 // New Authenticator with csv file backend
 func New(filePath string) api.Authenticator {
 	return &usersFileAuth{
@@ -33,11 +49,22 @@ type usersFileAuth struct {
 }
 
 var _ api.Authenticator = usersFileAuth{}
+var _ api.HealthChecker = usersFileAuth{}
+var _ api.UserLookup = usersFileAuth{}
 
 func (a usersFileAuth) Authenticate(user, password string, expiresAt time.Time) (jwt.Claims, error) {
 	ba := sha256.Sum256([]byte(password))
 	passwordHash := hex.EncodeToString(ba[:])
 
+	return a.find(user, func(hash string) bool { return hash == passwordHash }, expiresAt)
+}
+
+func (a usersFileAuth) Lookup(user string, expiresAt time.Time) (jwt.Claims, error) {
+	return a.find(user, func(string) bool { return true }, expiresAt)
+}
+
+// find the user's claims, if the user's hash is accepted
+func (a usersFileAuth) find(user string, acceptHash func(hash string) bool, expiresAt time.Time) (jwt.Claims, error) {
 	f, err := os.Open(a.filePath)
 	if err != nil {
 		return nil, err
@@ -47,6 +74,7 @@ func (a usersFileAuth) Authenticate(user, password string, expiresAt time.Time)
 
 	r := csv.NewReader(f)
 	r.Comma = ':'
+	r.FieldsPerRecord = -1
 
 	for {
 		record, err := r.Read()
@@ -63,7 +91,7 @@ func (a usersFileAuth) Authenticate(user, password string, expiresAt time.Time)
 
 		fileUser, hash := record[0], record[1]
 
-		if user != fileUser || hash != passwordHash {
+		if user != fileUser || !acceptHash(hash) {
 			continue
 		}
 
@@ -96,3 +124,12 @@ func (a usersFileAuth) Authenticate(user, password string, expiresAt time.Time)
 
 	return nil, api.ErrInvalidAuthentication
 }
+
+// CheckHealth checks the users file is readable.
+func (a usersFileAuth) CheckHealth(ctx context.Context) error {
+	f, err := os.Open(a.filePath)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -3,6 +3,9 @@ package client
 type Client struct {
 	ServerURL string
 
+	// DovecotSecret is sent to the Dovecot routes.
+	DovecotSecret string
+
 	validationCrt []byte
 }
 
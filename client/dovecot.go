@@ -0,0 +1,55 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type DovecotResult struct {
+	Result string            `json:"result"`
+	User   string            `json:"user"`
+	Userdb map[string]string `json:"userdb"`
+}
+
+// DovecotPassdb verifies the credentials with the server's Dovecot passdb route.
+// ok is false if the credentials are invalid.
+func (c *Client) DovecotPassdb(username, password string) (result DovecotResult, ok bool, err error) {
+	body, err := json.Marshal(map[string]string{
+		"user":     username,
+		"password": password,
+	})
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest("POST", c.ServerURL+"/dovecot/passdb", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Dovecot-Secret", c.DovecotSecret)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return
+	default:
+		err = fmt.Errorf("passdb request failed: %s", res.Status)
+		return
+	}
+
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return
+	}
+
+	ok = result.Result == "ok"
+	return
+}
@@ -0,0 +1,104 @@
+// ag-checkpassword is a checkpassword helper (as used by Dovecot) verifying
+// credentials with an autentigo server.
+//
+// It reads "user\0password\0" from the file descriptor 3 and, if the
+// credentials are valid, executes the program given as arguments with USER,
+// HOME and the other userdb fields in the environment.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/mcluseau/autentigo/client"
+)
+
+// checkpassword exit codes
+const (
+	exitInvalid   = 1
+	exitTemporary = 111
+)
+
+var (
+	serverURL = flag.String("server", envOr("AUTENTIGO_URL", "http://localhost:8080"), "autentigo server URL (env AUTENTIGO_URL)")
+	secret    = flag.String("secret", os.Getenv("AUTENTIGO_DOVECOT_SECRET"), "secret of the Dovecot routes (env AUTENTIGO_DOVECOT_SECRET)")
+)
+
+func main() {
+	log.SetPrefix("ag-checkpassword: ")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		log.Print("usage: ag-checkpassword [flags] <program> [args...]")
+		os.Exit(2)
+	}
+
+	input, err := ioutil.ReadAll(os.NewFile(3, "input"))
+	if err != nil {
+		log.Print("failed to read fd 3: ", err)
+		os.Exit(exitTemporary)
+	}
+
+	parts := bytes.Split(input, []byte{0})
+	if len(parts) < 2 || len(parts[0]) == 0 {
+		log.Print("invalid input")
+		os.Exit(exitInvalid)
+	}
+
+	user, password := string(parts[0]), string(parts[1])
+
+	c := client.New(*serverURL)
+	c.DovecotSecret = *secret
+
+	result, ok, err := c.DovecotPassdb(user, password)
+	if err != nil {
+		log.Print(err)
+		os.Exit(exitTemporary)
+	}
+	if !ok {
+		os.Exit(exitInvalid)
+	}
+
+	env := append(os.Environ(), "USER="+result.User)
+
+	fields := make([]string, 0, len(result.Userdb))
+	for field, value := range result.Userdb {
+		if field == "home" {
+			env = append(env, "HOME="+value)
+			continue
+		}
+
+		field = "userdb_" + field
+		env = append(env, field+"="+value)
+		fields = append(fields, field)
+	}
+
+	if len(fields) != 0 {
+		sort.Strings(fields)
+		env = append(env, "EXTRA="+strings.Join(fields, " "))
+	}
+
+	program, err := exec.LookPath(flag.Arg(0))
+	if err != nil {
+		log.Print(err)
+		os.Exit(exitTemporary)
+	}
+
+	err = syscall.Exec(program, flag.Args(), env)
+	log.Print("exec failed: ", err)
+	os.Exit(exitTemporary)
+}
+
+func envOr(name, defaultValue string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return defaultValue
+}
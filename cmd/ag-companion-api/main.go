@@ -1,24 +1,38 @@
 package main
 
 import (
+	"crypto/rand"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"net"
-	"net/http"
 	"os"
-	"os/signal"
-	"strings"
-	"syscall"
+	"time"
 
 	restful "github.com/emicklei/go-restful"
 	restfulspec "github.com/emicklei/go-restful-openapi"
 
+	"github.com/mcluseau/autentigo/api"
+	"github.com/mcluseau/autentigo/pkg/audit"
 	companionapi "github.com/mcluseau/autentigo/pkg/companion-api/api"
 	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
-	"github.com/mcluseau/autentigo/pkg/companion-api/backend/etcd"
-	"github.com/mcluseau/autentigo/pkg/companion-api/backend/users-file"
+	"github.com/mcluseau/autentigo/pkg/health"
+	"github.com/mcluseau/autentigo/pkg/mail"
+	passwordpolicy "github.com/mcluseau/autentigo/pkg/password-policy"
 	"github.com/mcluseau/autentigo/pkg/rbac"
+	"github.com/mcluseau/autentigo/pkg/server"
+	"github.com/mcluseau/autentigo/pkg/settings"
+
+	// backends
+	_ "github.com/mcluseau/autentigo/pkg/companion-api/backend/etcd"
+	_ "github.com/mcluseau/autentigo/pkg/companion-api/backend/sql"
+	_ "github.com/mcluseau/autentigo/pkg/companion-api/backend/users-file"
+
+	// authentication backends, to verify passwords
+	_ "github.com/mcluseau/autentigo/auth/etcd"
+	_ "github.com/mcluseau/autentigo/auth/sql"
+	_ "github.com/mcluseau/autentigo/auth/users-file"
 )
 
 var (
@@ -27,11 +41,29 @@ var (
 	disableCORS       = flag.Bool("no-cors", false, "Disable CORS support")
 	rbacFile          = flag.String("rbac-file", "/etc/autentigo/rbac.yaml", "HTTP bind specification")
 	adminToken        = flag.String("admin-token", "", "Administration token, useful when no users are defined")
+	policyFile        = flag.String("password-policy", "", "Password policy file (any non-empty password if not set)")
+
+	tokenKeyFile         = flag.String("token-key-file", "", "Key signing the tokens sent by mail (random if not set, so tokens are invalid after a restart)")
+	passwordResetURL     = flag.String("password-reset-url", "", "URL of the password reset page, the token being appended to it (ie: https://example.com/reset-password?token=)")
+	passwordResetTTL     = flag.Duration("password-reset-ttl", time.Hour, "Validity of the password reset links")
+	emailVerificationURL = flag.String("email-verification-url", "", "URL of the email verification page, the token being appended to it (no verification mails if not set)")
+	emailVerificationTTL = flag.Duration("email-verification-ttl", 24*time.Hour, "Validity of the email verification links")
+
+	auditSpec       = flag.String("audit", "", "Audit sinks (comma-separated list of stdout, stderr, file:<path>, syslog[:<tag>])")
+	auditMaxSize    = flag.Int64("audit-file-max-size", 100<<20, "Size (in bytes) of audit files triggering a rotation")
+	auditMaxBackups = flag.Int("audit-file-max-backups", 5, "Number of rotated audit files to keep")
+
+	serverOptions = server.Options{}
 
 	validationCrt []byte
 )
 
+func init() {
+	serverOptions.BindFlags(flag.CommandLine)
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
 	var err error
@@ -44,9 +76,64 @@ func main() {
 		log.Fatal("failed to read validation certificate: ", err)
 	}
 
+	audit.Default, err = audit.FromSpec(*auditSpec, audit.FileOptions{
+		MaxSize:    *auditMaxSize,
+		MaxBackups: *auditMaxBackups,
+	})
+	if err != nil {
+		log.Fatal("failed to setup audit: ", err)
+	}
+
+	var policy *passwordpolicy.Policy
+	if *policyFile != "" {
+		if policy, err = passwordpolicy.FromFile(*policyFile); err != nil {
+			log.Fatal("failed to load the password policy: ", err)
+		}
+	}
+
+	mailConfig := mail.DefaultConfig()
+	if err = settings.Load(mailConfig, nil); err != nil {
+		log.Fatal("invalid mail configuration: ", err)
+	}
+
+	mailer, err := mail.New(mailConfig)
+	if err != nil {
+		log.Fatal("failed to setup mails: ", err)
+	}
+
+	tokenKey, err := getTokenKey()
+	if err != nil {
+		log.Fatal("failed to read the token key: ", err)
+	}
+
+	backendName := os.Getenv("AUTH_BACKEND")
+
+	client, err := getBackEndClient(backendName)
+	if err != nil {
+		log.Fatal("failed to setup the backend: ", err)
+	}
+
+	authenticator, err := getAuthenticator(backendName)
+	if err != nil {
+		log.Print("no authenticator, users won't be able to change their password: ", err)
+	}
+
 	cAPI := &companionapi.CompanionAPI{
-		Client:     getBackEndClient(),
-		AdminToken: *adminToken,
+		Client:         client,
+		Backend:        backendName,
+		AdminToken:     *adminToken,
+		Authenticator:  authenticator,
+		PasswordPolicy: policy,
+		Mailer:         mailer,
+		TokenKey:       tokenKey,
+		PasswordReset: companionapi.MailLinkConfig{
+			URL: *passwordResetURL,
+			TTL: *passwordResetTTL,
+		},
+		EmailVerification: companionapi.MailLinkConfig{
+			URL: *emailVerificationURL,
+			TTL: *emailVerificationTTL,
+		},
 	}
 
 	restful.DefaultRequestContentType(restful.MIME_JSON)
@@ -57,6 +144,14 @@ func main() {
 		restful.Add(ws)
 	}
 
+	checks := &health.Checks{Components: map[string]health.Checker{}}
+	if hc, ok := client.(backend.HealthChecker); ok {
+		checks.Components["backend"] = hc
+	}
+	healthWS := &restful.WebService{}
+	checks.Register(healthWS)
+	restful.Add(healthWS)
+
 	config := restfulspec.Config{
 		WebServices: restful.RegisteredWebServices(),
 		APIPath:     "/apidocs.json",
@@ -65,54 +160,72 @@ func main() {
 
 	if !*disableCORS {
 		restful.Filter(restful.CrossOriginResourceSharing{
+			ExposeHeaders:  []string{"ETag"},
 			CookiesAllowed: true,
 			Container:      restful.DefaultContainer,
 		}.Filter)
 	}
 
-	l, err := net.Listen("tcp", *bind)
-	if err != nil {
+	servers := []*server.Server{
+		serverOptions.New(*bind, restful.DefaultContainer),
+	}
+
+	closers := []io.Closer{}
+	if c, ok := client.(io.Closer); ok {
+		closers = append(closers, c)
+	}
+	if c, ok := authenticator.(io.Closer); ok {
+		closers = append(closers, c)
+	}
+
+	if err := server.Run(serverOptions, servers, closers...); err != nil {
 		log.Fatal(err)
 	}
+}
 
-	log.Print("listening on ", *bind)
+func getBackEndClient(name string) (backend.Client, error) {
+	config, err := backend.Config(name, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	go func() {
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, os.Kill, os.Interrupt, syscall.SIGTERM)
-		<-sig
+	return backend.New(name, config)
+}
 
-		log.Print("closing listener")
-		l.Close()
-	}()
+// getAuthenticator returns the authenticator of the backend, as used by autentigo
+func getAuthenticator(name string) (api.Authenticator, error) {
+	config, err := api.AuthenticatorConfig(name, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	log.Fatal(http.Serve(l, restful.DefaultContainer))
+	return api.NewAuthenticator(name, config)
 }
 
-func getBackEndClient() backend.Client {
-	switch v := os.Getenv("AUTH_BACKEND"); v {
-	case "stupid":
-		log.Fatal("Stupid backend does not need the companion-api")
-		return nil
-	case "ldap-bind":
-		log.Fatal("Please feel free to use a ldap client instead of the companion-api")
-		return nil
-	case "file":
-		return usersfile.New(requireEnv("AUTH_FILE", "File containings users when using file auth"))
-	case "etcd":
-		return etcd.New(
-			requireEnv("ETCD_PREFIX", "etcd prefix"),
-			strings.Split(requireEnv("ETCD_ENDPOINTS", "etcd endpoints"), ","))
-	default:
-		log.Fatal("Unknown authenticator: ", v)
-		return nil
+// getTokenKey returns the key signing the tokens sent by mail
+func getTokenKey() ([]byte, error) {
+	if *tokenKeyFile != "" {
+		return ioutil.ReadFile(*tokenKeyFile)
 	}
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	return key, err
 }
 
-func requireEnv(name, description string) string {
-	v := os.Getenv(name)
-	if v == "" {
-		log.Fatal("Env ", name, " is required: ", description)
+func usage() {
+	out := flag.CommandLine.Output()
+
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+
+	fmt.Fprintln(out, "\nBackends (env AUTH_BACKEND):")
+	for _, name := range backend.Names() {
+		factory, _ := backend.FactoryFor(name)
+		fmt.Fprintf(out, "\n  %s: %s\n", name, factory.Description)
+		settings.Fprint(out, "", settings.Describe(factory.NewConfig()))
 	}
-	return v
+
+	fmt.Fprintln(out, "\nMails:")
+	settings.Fprint(out, "", settings.Describe(mail.DefaultConfig()))
 }
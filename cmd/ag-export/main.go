@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/mcluseau/autentigo/pkg/exporter"
+
+	// SQL drivers
+	_ "github.com/lib/pq"
+)
+
+var (
+	configFile  = flag.String("config", "/etc/autentigo/export.yaml", "Exporter configuration file")
+	checkConfig = flag.Bool("check-config", false, "Only check the configuration")
+	once        = flag.Bool("once", false, "Export once then exit (ie: from cron)")
+)
+
+func main() {
+	flag.Parse()
+
+	config, err := exporter.ConfigFromFile(*configFile)
+	if err != nil {
+		log.Fatal("failed to load the configuration: ", err)
+	}
+
+	if err = config.Validate(); err != nil {
+		log.Fatal("invalid configuration: ", err)
+	}
+
+	if *checkConfig {
+		log.Print("configuration is valid")
+		return
+	}
+
+	e, closer, err := config.New()
+	if err != nil {
+		log.Fatal("failed to setup the exporter: ", err)
+	}
+	defer closer.Close()
+
+	ctx := signalContext()
+
+	if *once {
+		err = e.Once(ctx)
+	} else {
+		err = e.Run(ctx)
+	}
+
+	if err != nil && err != context.Canceled {
+		log.Fatal("export failed: ", err)
+	}
+}
+
+// signalContext returns a context cancelled on termination signals.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		s := <-sig
+		log.Print("got signal ", s, ", stopping")
+		cancel()
+	}()
+
+	return ctx
+}
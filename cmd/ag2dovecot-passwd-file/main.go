@@ -1,131 +1,65 @@
+// ag2dovecot-passwd-file mirrors etcd users to a Dovecot passwd file.
+//
+// It's a shortcut for ag-export with an etcd source and a dovecot sink.
 package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"log"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/coreos/etcd/clientv3"
-	"github.com/coreos/etcd/clientv3/mirror"
+
+	"github.com/mcluseau/autentigo/pkg/exporter"
 )
 
 var (
-	etcd *clientv3.Client
-
 	etcdURL    = flag.String("etcd", "http://localhost:2379", "etcd URL")
 	etcdPrefix = flag.String("etcd-prefix", "/users", "Prefix of etcd keys")
 	passwdFile = flag.String("passwd-file", "passwd", "Dovecot passwd file")
-
-	values = map[string]string{}
+	hook       = flag.String("hook", "", "Command to run after the passwd file is written")
+	debounce   = flag.Duration("debounce", time.Second, "Delay writes after a change, to batch changes")
+	once       = flag.Bool("once", false, "Write the passwd file once then exit (ie: from cron)")
+	_          = flag.String("state-file", "", "Deprecated, ignored (the file is rebuilt from etcd on start)")
 )
 
 func main() {
 	flag.Parse()
 
-	// connect to etcd
-	var err error
-	etcd, err = clientv3.NewFromURL(*etcdURL)
+	etcd, err := clientv3.NewFromURL(*etcdURL)
 	if err != nil {
 		log.Fatal("failed to connect to etcd: ", err)
 	}
-
-	if len(*etcdPrefix) != 0 && !strings.HasSuffix(*etcdPrefix, "/") {
-		*etcdPrefix += "/"
+	defer etcd.Close()
+
+	e := &exporter.Exporter{
+		Source: &exporter.EtcdSource{Client: etcd, Prefix: *etcdPrefix},
+		Sinks: []*exporter.Sink{
+			{Type: "dovecot", Path: *passwdFile, Hook: *hook},
+		},
+		Debounce: *debounce,
 	}
 
-	log.Print("connected to etcd with prefix ", *etcdPrefix)
+	ctx, cancel := context.WithCancel(context.Background())
 
-	// prepare mirror
-	rev := loadState()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
 
-	if rev == 0 {
-		rev = initializeFromScratch()
+	if *once {
+		err = e.Once(ctx)
 	} else {
-		loadFile()
-	}
-
-	followChanges(rev)
-}
-
-func initializeFromScratch() (rev int64) {
-	log.Print("initializing from scratch")
-	sync := mirror.NewSyncer(etcd, *etcdPrefix, 0)
-
-	gets, errors := sync.SyncBase(context.Background())
-
-	for get := range gets {
-		rev = get.Header.Revision
-		for _, kv := range get.Kvs {
-			setValue(kv.Key, kv.Value)
-		}
-	}
-
-	if err := <-errors; err != nil {
-		log.Fatal("failed to read from etcd: ", err)
-	}
-
-	save(rev)
-	return
-}
-
-func followChanges(rev int64) {
-	log.Print("following changes")
-
-	ctx := context.Background()
-
-	for {
-		sync := mirror.NewSyncer(etcd, *etcdPrefix, rev)
-		for update := range sync.SyncUpdates(ctx) {
-			if err := update.Err(); err != nil {
-				log.Print("syncer error: ", err)
-				continue
-			}
-
-			for _, event := range update.Events {
-				if event.Kv == nil {
-					delValue(event.Kv.Key)
-				} else {
-					setValue(event.Kv.Key, event.Kv.Value)
-				}
-			}
-
-			rev = update.Header.Revision
-			save(rev)
-		}
-
-		log.Print("sync updates ended, restarting")
-	}
-}
-
-func keyFrom(key []byte) string {
-	return string(key[len(*etcdPrefix):])
-}
-
-func setValue(fullKey []byte, value []byte) {
-	key := keyFrom(fullKey)
-	log.Print("update on ", key)
-
-	v := struct {
-		PasswordHash string `json:"password_hash"`
-	}{}
-
-	if err := json.Unmarshal(value, &v); err != nil {
-		log.Fatal("failed to parse value at key ", string(fullKey), ": ", err)
+		err = e.Run(ctx)
 	}
 
-	h := v.PasswordHash
-	if !strings.HasPrefix(h, "{") {
-		h = "{SHA256.HEX}" + h
+	if err != nil && err != context.Canceled {
+		log.Fatal("export failed: ", err)
 	}
-
-	values[key] = h
-}
-
-func delValue(fullKey []byte) {
-	key := keyFrom(fullKey)
-	log.Print("delete on ", key)
-
-	delete(values, key)
 }
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	yaml "github.com/projectcalico/go-yaml-wrapper"
+
+	"github.com/mcluseau/autentigo/api"
+	"github.com/mcluseau/autentigo/pkg/claims"
+	"github.com/mcluseau/autentigo/pkg/lifetime"
+)
+
+// Config is the configuration file of the server.
+//
+// Values from the file are overridden by the environment, then by the flags
+// given on the command line.
+type Config struct {
+	Listen  ListenConfig  `json:"listen"`
+	Keys    KeysConfig    `json:"keys"`
+	Token   TokenConfig   `json:"token"`
+	Audit   AuditConfig   `json:"audit"`
+	Backend BackendConfig `json:"backend"`
+	Claims  claims.Config `json:"claims"`
+
+	TokenReview   TokenReviewConfig   `json:"token_review"`
+	Authorization AuthorizationConfig `json:"authorization"`
+	Keystone      api.KeystoneConfig  `json:"keystone"`
+	Docker        api.DockerConfig    `json:"docker"`
+	Dovecot       api.DovecotConfig   `json:"dovecot"`
+}
+
+// ListenConfig configures the listeners.
+type ListenConfig struct {
+	Bind          string `json:"bind"`
+	TLSBind       string `json:"tls_bind"`
+	TLSCert       string `json:"tls_cert"`
+	TLSKey        string `json:"tls_key"`
+	TLSClientCA   string `json:"tls_client_ca"`
+	MTLSUsername  string `json:"mtls_username"`
+	NoCORS        bool   `json:"no_cors"`
+	ReadTimeout   string `json:"read_timeout"`
+	WriteTimeout  string `json:"write_timeout"`
+	IdleTimeout   string `json:"idle_timeout"`
+	ShutdownGrace string `json:"shutdown_grace"`
+}
+
+// KeysConfig configures the keys used to sign tokens. The certificate and
+// key can be given inline (PEM) or as files.
+type KeysConfig struct {
+	Certificate     string `json:"certificate"`
+	CertificateFile string `json:"certificate_file"`
+	Key             string `json:"key"`
+	KeyFile         string `json:"key_file"`
+	SigningMethod   string `json:"signing_method"`
+}
+
+// TokenConfig configures the emitted tokens.
+type TokenConfig struct {
+	Duration    string            `json:"duration"`
+	MaxDuration string            `json:"max_duration"`
+	Policies    []lifetime.Policy `json:"policies"`
+}
+
+// AuditConfig configures the audit log.
+type AuditConfig struct {
+	Sinks          []string `json:"sinks"`
+	FileMaxSize    int64    `json:"file_max_size"`
+	FileMaxBackups int      `json:"file_max_backups"`
+}
+
+// TokenReviewConfig configures the authentication webhook (/review-token).
+type TokenReviewConfig struct {
+	UsernamePrefix string `json:"username_prefix"`
+	GroupsPrefix   string `json:"groups_prefix"`
+}
+
+// AuthorizationConfig configures the authorization webhook (/review-access)
+// the roles of Keystone tokens and the Docker repositories accesses.
+type AuthorizationConfig struct {
+	RBACFile string `json:"rbac_file"`
+}
+
+// BackendConfig selects and configures the authentication backend.
+//
+// Each backend reads its own section, named after it:
+//
+//	backend:
+//	  type: etcd
+//	  timeout: 5s
+//	  etcd:
+//	    prefix: /users
+type BackendConfig struct {
+	Type     string
+	Timeout  string
+	Sections map[string]json.RawMessage
+}
+
+// UnmarshalJSON reads the type, the timeout and the backend sections.
+func (b *BackendConfig) UnmarshalJSON(ba []byte) (err error) {
+	sections := map[string]json.RawMessage{}
+	if err = json.Unmarshal(ba, &sections); err != nil {
+		return
+	}
+
+	for key, value := range map[string]*string{
+		"type":    &b.Type,
+		"timeout": &b.Timeout,
+	} {
+		if raw, ok := sections[key]; ok {
+			if err = json.Unmarshal(raw, value); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			delete(sections, key)
+		}
+	}
+
+	b.Sections = sections
+	return
+}
+
+// loadConfig loads the configuration file (if any), then applies the
+// environment and flags.
+func loadConfig(path string) (config *Config, err error) {
+	config = &Config{}
+
+	if path != "" {
+		var ba []byte
+		ba, err = ioutil.ReadFile(path)
+		if err != nil {
+			return
+		}
+
+		if err = yaml.UnmarshalStrict(ba, config); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	config.applyEnv()
+
+	if err = config.applyToFlags(); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// applyEnv overrides the configuration with the environment.
+func (c *Config) applyEnv() {
+	env := func(name string, value *string) {
+		if v := os.Getenv(name); v != "" {
+			*value = v
+		}
+	}
+
+	env("TLS_CRT", &c.Keys.Certificate)
+	env("TLS_KEY", &c.Keys.Key)
+	env("SIGNING_METHOD", &c.Keys.SigningMethod)
+	env("AUTH_BACKEND", &c.Backend.Type)
+
+	if c.Backend.Type == "" {
+		c.Backend.Type = "stupid"
+	}
+}
+
+// applyToFlags uses the configuration values as defaults for flags not set
+// on the command line, and updates the configuration from the flags' values.
+func (c *Config) applyToFlags() (err error) {
+	setOnCLI := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setOnCLI[f.Name] = true
+	})
+
+	strs := map[string]*string{
+		"bind":                   &c.Listen.Bind,
+		"tls-bind":               &c.Listen.TLSBind,
+		"tls-bind-cert":          &c.Listen.TLSCert,
+		"tls-bind-key":           &c.Listen.TLSKey,
+		"tls-client-ca":          &c.Listen.TLSClientCA,
+		"mtls-username":          &c.Listen.MTLSUsername,
+		"read-timeout":           &c.Listen.ReadTimeout,
+		"write-timeout":          &c.Listen.WriteTimeout,
+		"idle-timeout":           &c.Listen.IdleTimeout,
+		"shutdown-grace":         &c.Listen.ShutdownGrace,
+		"token-duration":         &c.Token.Duration,
+		"token-max-duration":     &c.Token.MaxDuration,
+		"auth-timeout":           &c.Backend.Timeout,
+		"review-username-prefix": &c.TokenReview.UsernamePrefix,
+		"review-groups-prefix":   &c.TokenReview.GroupsPrefix,
+		"rbac-file":              &c.Authorization.RBACFile,
+	}
+
+	for name, value := range strs {
+		if err = applyToFlag(name, value, setOnCLI[name]); err != nil {
+			return
+		}
+	}
+
+	noCORS := strconv.FormatBool(c.Listen.NoCORS)
+	auditSinks := strings.Join(c.Audit.Sinks, ",")
+	auditMaxSize := ""
+	if c.Audit.FileMaxSize != 0 {
+		auditMaxSize = strconv.FormatInt(c.Audit.FileMaxSize, 10)
+	}
+	auditMaxBackups := ""
+	if c.Audit.FileMaxBackups != 0 {
+		auditMaxBackups = strconv.Itoa(c.Audit.FileMaxBackups)
+	}
+
+	for name, value := range map[string]*string{
+		"no-cors":                &noCORS,
+		"audit":                  &auditSinks,
+		"audit-file-max-size":    &auditMaxSize,
+		"audit-file-max-backups": &auditMaxBackups,
+	} {
+		if err = applyToFlag(name, value, setOnCLI[name]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func applyToFlag(name string, value *string, setOnCLI bool) error {
+	if !setOnCLI && *value != "" {
+		if err := flag.Set(name, *value); err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+
+	*value = flag.Lookup(name).Value.String()
+	return nil
+}
+
+// Validate checks the configuration is complete.
+func (c *Config) Validate() error {
+	required := func(value, name, description string) error {
+		if value == "" {
+			return fmt.Errorf("%s is required: %s", name, description)
+		}
+		return nil
+	}
+
+	keys := c.Keys
+	for _, err := range []error{
+		required(keys.Certificate+keys.CertificateFile, "keys.certificate (or TLS_CRT)", "certificate used to sign/verify tokens"),
+		required(keys.Key+keys.KeyFile, "keys.key (or TLS_KEY)", "key used to sign tokens"),
+		required(keys.SigningMethod, "keys.signing_method (or SIGNING_METHOD)", "signature method to use (must match the key)"),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	switch *mtlsUsername {
+	case "cn", "email", "dns", "uri":
+	default:
+		return fmt.Errorf("invalid mtls-username: %q", *mtlsUsername)
+	}
+
+	if (*tlsKeyFile == "") != (*tlsCertFile == "") {
+		return fmt.Errorf("please specify both tls-key and tls-cert, or none")
+	}
+
+	if err := lifetime.Validate(c.Token.Policies); err != nil {
+		return fmt.Errorf("token.policies: %v", err)
+	}
+
+	if err := c.Claims.Validate(); err != nil {
+		return fmt.Errorf("claims.%v", err)
+	}
+
+	if _, ok := api.AuthenticatorFactoryFor(c.Backend.Type); !ok {
+		return fmt.Errorf("unknown authentication backend: %q", c.Backend.Type)
+	}
+
+	// check all the sections, not only the selected one, so switching
+	// backends doesn't reveal an invalid configuration
+	for name, raw := range c.Backend.Sections {
+		if _, ok := api.AuthenticatorFactoryFor(name); !ok {
+			return fmt.Errorf("backend.%s: unknown authentication backend", name)
+		}
+		if _, err := api.AuthenticatorConfig(name, raw); err != nil {
+			return fmt.Errorf("backend.%v", err)
+		}
+	}
+
+	if _, ok := c.Backend.Sections[c.Backend.Type]; !ok {
+		if _, err := api.AuthenticatorConfig(c.Backend.Type, nil); err != nil {
+			return fmt.Errorf("backend.%v", err)
+		}
+	}
+
+	return nil
+}
@@ -2,13 +2,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
-	"net"
-	"net/http"
 	"os"
-	"os/signal"
-	"strings"
-	"syscall"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
@@ -16,47 +14,140 @@ import (
 	restfulspec "github.com/emicklei/go-restful-openapi"
 
 	"github.com/mcluseau/autentigo/api"
-	"github.com/mcluseau/autentigo/auth/etcd"
-	ldapbind "github.com/mcluseau/autentigo/auth/ldap-bind"
-	"github.com/mcluseau/autentigo/auth/sql"
-	stupidauth "github.com/mcluseau/autentigo/auth/stupid-auth"
-	usersfile "github.com/mcluseau/autentigo/auth/users-file"
+	"github.com/mcluseau/autentigo/pkg/audit"
+	"github.com/mcluseau/autentigo/pkg/health"
+	"github.com/mcluseau/autentigo/pkg/rbac"
+	"github.com/mcluseau/autentigo/pkg/server"
+	"github.com/mcluseau/autentigo/pkg/settings"
+
+	// authentication backends
+	_ "github.com/mcluseau/autentigo/auth/etcd"
+	_ "github.com/mcluseau/autentigo/auth/ldap-bind"
+	_ "github.com/mcluseau/autentigo/auth/sql"
+	_ "github.com/mcluseau/autentigo/auth/stupid-auth"
+	_ "github.com/mcluseau/autentigo/auth/users-file"
 )
 
 var (
-	tokenDuration = flag.Duration("token-duration", 1*time.Hour, "Duration of emitted tokens")
-	bind          = flag.String("bind", ":8080", "HTTP bind specification")
-	tlsBind       = flag.String("tls-bind", ":8443", "HTTPS bind specification")
-	tlsKeyFile    = flag.String("tls-bind-key", "", "File containing the TLS listener's key")
-	tlsCertFile   = flag.String("tls-bind-cert", "", "File containing the TLS listener's certificate")
-	disableCORS   = flag.Bool("no-cors", false, "Disable CORS support")
+	tokenDuration    = flag.Duration("token-duration", 1*time.Hour, "Duration of emitted tokens")
+	tokenMaxDuration = flag.Duration("token-max-duration", 0, "Maximum duration of emitted tokens, whatever the policies (no limit if 0). It also bounds the validity of revoked tokens after a restart or on other replicas, as revocations are kept in memory")
+	bind             = flag.String("bind", ":8080", "HTTP bind specification")
+	tlsBind          = flag.String("tls-bind", ":8443", "HTTPS bind specification")
+	tlsKeyFile       = flag.String("tls-bind-key", "", "File containing the TLS listener's key")
+	tlsCertFile      = flag.String("tls-bind-cert", "", "File containing the TLS listener's certificate")
+	tlsClientCA      = flag.String("tls-client-ca", "", "File containing the CAs to verify client certificates (enables mutual TLS)")
+	mtlsUsername     = flag.String("mtls-username", "cn", "Client certificate field giving the user name on /mtls (cn, email, dns or uri)")
+	disableCORS      = flag.Bool("no-cors", false, "Disable CORS support")
+	reviewUserPrefix = flag.String("review-username-prefix", "", "Prefix of user names returned by /review-token")
+	reviewGrpPrefix  = flag.String("review-groups-prefix", "", "Prefix of groups returned by /review-token")
+	rbacFile         = flag.String("rbac-file", "", "RBAC file with the access rules of /review-access, the Keystone roles and the Docker repositories rules")
+	authTimeout      = flag.Duration("auth-timeout", 10*time.Second, "Maximum duration of an authentication by the backend")
+
+	auditSpec       = flag.String("audit", "", "Audit sinks (comma-separated list of stdout, stderr, file:<path>, syslog[:<tag>])")
+	auditMaxSize    = flag.Int64("audit-file-max-size", 100<<20, "Size (in bytes) of audit files triggering a rotation")
+	auditMaxBackups = flag.Int("audit-file-max-backups", 5, "Number of rotated audit files to keep")
+
+	serverOptions = server.Options{}
+
+	configFile  = flag.String("config", "", "YAML configuration file")
+	checkConfig = flag.Bool("check-config", false, "Validate the configuration and exit")
 )
 
+func init() {
+	serverOptions.BindFlags(flag.CommandLine)
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
-	key, pubKey, sm, crtData := initJWT()
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatal("invalid configuration: ", err)
+	}
+
+	if err = cfg.Validate(); err != nil {
+		log.Fatal("invalid configuration: ", err)
+	}
+
+	key, pubKey, sm, crtData, err := initJWT(cfg.Keys)
+	if err != nil {
+		log.Fatal("invalid configuration: ", err)
+	}
+
+	var rbacConfig *rbac.Config
+	if *rbacFile != "" {
+		if rbacConfig, err = rbac.FromFile(*rbacFile); err != nil {
+			log.Fatal("invalid configuration: rbac-file: ", err)
+		}
+	}
+
+	if *checkConfig {
+		log.Print("configuration is valid")
+		return
+	}
+
+	audit.Default, err = audit.FromSpec(*auditSpec, audit.FileOptions{
+		MaxSize:    *auditMaxSize,
+		MaxBackups: *auditMaxBackups,
+	})
+	if err != nil {
+		log.Fatal("failed to setup audit: ", err)
+	}
+
+	backendName := cfg.Backend.Type
+
+	authenticator, err := getAuthenticator(cfg.Backend)
+	if err != nil {
+		log.Fatal("failed to setup the authentication backend: ", err)
+	}
 
 	hAPI := &api.API{
-		CRTData:       []byte(crtData),
-		Authenticator: getAuthenticator(),
-		PrivateKey:    key,
-		PublicKey:     pubKey,
-		SigningMethod: sm,
-		TokenDuration: *tokenDuration,
+		CRTData:          []byte(crtData),
+		Authenticator:    authenticator,
+		Backend:          backendName,
+		PrivateKey:       key,
+		PublicKey:        pubKey,
+		SigningMethod:    sm,
+		TokenDuration:    *tokenDuration,
+		TokenMaxDuration: *tokenMaxDuration,
+		TokenPolicies:    cfg.Token.Policies,
+		AuthTimeout:      *authTimeout,
+		Claims:           &cfg.Claims,
+		Keystone:         cfg.Keystone,
+		Docker:           cfg.Docker,
+		Dovecot:          cfg.Dovecot,
+
+		TokenReviewUsernamePrefix: *reviewUserPrefix,
+		TokenReviewGroupsPrefix:   *reviewGrpPrefix,
+		MTLSUsername:              *mtlsUsername,
+	}
+
+	if rbacConfig != nil {
+		hAPI.Authorizer = rbacConfig
+		hAPI.Roles = rbacConfig
+		hAPI.Repositories = rbacConfig
 	}
 
 	restful.DefaultRequestContentType(restful.MIME_JSON)
 	restful.DefaultResponseContentType(restful.MIME_JSON)
 	restful.DefaultContainer.Router(restful.CurlyRouter{})
 
-	restful.Add(hAPI.Register())
+	ws := hAPI.Register()
 
-	config := restfulspec.Config{
+	checks := &health.Checks{Components: map[string]health.Checker{}}
+	if hc, ok := authenticator.(api.HealthChecker); ok {
+		checks.Components["backend"] = hc
+	}
+	checks.Register(ws)
+
+	restful.Add(ws)
+
+	specConfig := restfulspec.Config{
 		WebServices: restful.RegisteredWebServices(),
 		APIPath:     "/apidocs.json",
 	}
-	restful.DefaultContainer.Add(restfulspec.NewOpenAPIService(config))
+	restful.DefaultContainer.Add(restfulspec.NewOpenAPIService(specConfig))
 
 	if !*disableCORS {
 		restful.Filter(restful.CrossOriginResourceSharing{
@@ -65,113 +156,110 @@ func main() {
 		}.Filter)
 	}
 
-	l, err := net.Listen("tcp", *bind)
-	if err != nil {
-		log.Fatal(err)
+	servers := []*server.Server{
+		serverOptions.New(*bind, restful.DefaultContainer),
 	}
 
-	log.Print("listening on ", *bind)
-
-	go func() {
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, os.Kill, os.Interrupt, syscall.SIGTERM)
-		<-sig
+	if *tlsKeyFile != "" && *tlsCertFile != "" {
+		tlsConfig, err := server.TLSConfig(*tlsCertFile, *tlsKeyFile, *tlsClientCA)
+		if err != nil {
+			log.Fatal("failed to setup TLS: ", err)
+		}
 
-		log.Print("closing listener")
-		l.Close()
-	}()
+		tlsServer := serverOptions.New(*tlsBind, restful.DefaultContainer)
+		tlsServer.TLSConfig = tlsConfig
 
-	if *tlsKeyFile != "" && *tlsCertFile != "" {
-		go func() {
-			log.Print("TLS listening on ", *bind)
-			log.Fatal(http.ListenAndServeTLS(
-				*tlsBind, *tlsKeyFile, *tlsCertFile,
-				restful.DefaultContainer))
-		}()
+		servers = append(servers, tlsServer)
+	}
 
-	} else if *tlsKeyFile != "" || *tlsCertFile != "" {
-		log.Fatal("please specify both tls-key and tls-cert, or none.")
+	closers := []io.Closer{}
+	if c, ok := authenticator.(io.Closer); ok {
+		closers = append(closers, c)
 	}
 
-	log.Fatal(http.Serve(l, restful.DefaultContainer))
+	if err := server.Run(serverOptions, servers, closers...); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func initJWT() (key interface{}, cert interface{}, method jwt.SigningMethod, crtData string) {
-	crtData = requireEnv("TLS_CRT", "certificate used to sign/verify tokens")
-	keyData := requireEnv("TLS_KEY", "key used to sign tokens")
-	sm := requireEnv("SIGNING_METHOD", "signature method to use (must match the key)")
+func initJWT(keys KeysConfig) (key interface{}, cert interface{}, method jwt.SigningMethod, crtData string, err error) {
+	crtData, err = pemValue(keys.Certificate, keys.CertificateFile)
+	if err != nil {
+		return
+	}
+
+	keyData, err := pemValue(keys.Key, keys.KeyFile)
+	if err != nil {
+		return
+	}
+
+	sm := keys.SigningMethod
 
 	method = jwt.GetSigningMethod(sm)
 
 	if method == nil {
-		log.Fatal("unknown signing method: ", sm)
+		err = fmt.Errorf("unknown signing method: %s", sm)
+		return
 	}
 
 	switch sm[:2] {
 	case "RS":
-		if x, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(keyData)); err == nil {
-			key = x
-		} else {
-			log.Fatal("Failed to load private key: ", err)
+		if key, err = jwt.ParseRSAPrivateKeyFromPEM([]byte(keyData)); err != nil {
+			err = fmt.Errorf("failed to load private key: %v", err)
+			return
 		}
-		if x, err := jwt.ParseRSAPublicKeyFromPEM([]byte(crtData)); err == nil {
-			cert = x
-		} else {
-			log.Fatal("Failed to load public key: ", err)
+		if cert, err = jwt.ParseRSAPublicKeyFromPEM([]byte(crtData)); err != nil {
+			err = fmt.Errorf("failed to load public key: %v", err)
+			return
 		}
 
 	case "ES":
-		if x, err := jwt.ParseECPrivateKeyFromPEM([]byte(keyData)); err == nil {
-			key = x
-		} else {
-			log.Fatal("Failed to load private key: ", err)
+		if key, err = jwt.ParseECPrivateKeyFromPEM([]byte(keyData)); err != nil {
+			err = fmt.Errorf("failed to load private key: %v", err)
+			return
 		}
-		if x, err := jwt.ParseECPublicKeyFromPEM([]byte(crtData)); err == nil {
-			cert = x
-		} else {
-			log.Fatal("Failed to load public key: ", err)
+		if cert, err = jwt.ParseECPublicKeyFromPEM([]byte(crtData)); err != nil {
+			err = fmt.Errorf("failed to load public key: %v", err)
+			return
 		}
 
 	default:
-		log.Fatal("Invalid SIGNING_METHOD: ", sm)
+		err = fmt.Errorf("invalid signing method: %s", sm)
 	}
 
 	return
 }
 
-func requireEnv(name, description string) string {
-	v := os.Getenv(name)
-	if v == "" {
-		log.Fatal("Env ", name, " is required: ", description)
+// pemValue returns the inline value if set, or the content of the file.
+func pemValue(inline, file string) (string, error) {
+	if inline != "" {
+		return inline, nil
 	}
-	return v
+
+	ba, err := ioutil.ReadFile(file)
+	return string(ba), err
 }
 
-func getAuthenticator() api.Authenticator {
-
-	switch v := os.Getenv("AUTH_BACKEND"); v {
-	case "", "stupid":
-		return stupidauth.New()
-
-	case "file":
-		return usersfile.New(requireEnv("AUTH_FILE", "File containings users when using file auth"))
-
-	case "ldap-bind":
-		return ldapbind.New(
-			requireEnv("LDAP_SERVER", "LDAP server"),
-			requireEnv("LDAP_USER", "LDAP user template (%s is substituted)"))
-
-	case "etcd":
-		return etcd.New(
-			requireEnv("ETCD_PREFIX", "etcd prefix"),
-			strings.Split(requireEnv("ETCD_ENDPOINTS", "etcd endpoints"), ","))
-	case "sql":
-		return sql.New(
-			requireEnv("SQL_DRIVER", "SQL driver (ex: postgres)"),
-			requireEnv("SQL_DSN", "SQL destination"),
-			requireEnv("SQL_USER_TABLE", "sql table with stored users"))
-	default:
-		log.Fatal("Unknown authenticator: ", v)
-		return nil
+func getAuthenticator(config BackendConfig) (api.Authenticator, error) {
+	backendConfig, err := api.AuthenticatorConfig(config.Type, config.Sections[config.Type])
+	if err != nil {
+		return nil, err
+	}
+
+	return api.NewAuthenticator(config.Type, backendConfig)
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+
+	fmt.Fprintln(out, "\nAuthentication backends (backend.type in the configuration file, or env AUTH_BACKEND):")
+	for _, name := range api.AuthenticatorNames() {
+		factory, _ := api.AuthenticatorFactoryFor(name)
+		fmt.Fprintf(out, "\n  %s: %s\n", name, factory.Description)
+
+		settings.Fprint(out, "backend."+name+".", settings.Describe(factory.NewConfig()))
 	}
 }
@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriterSink writes events as JSON lines to an io.Writer.
+type WriterSink struct {
+	W io.Writer
+}
+
+var _ Sink = WriterSink{}
+
+func (s WriterSink) Write(event []byte) (err error) {
+	_, err = s.W.Write(append(event, '\n'))
+	return
+}
+
+// FileSink writes events as JSON lines to a file, rotating it when it grows
+// over MaxSize bytes. Rotated files are named <path>.1 to <path>.<MaxBackups>.
+type FileSink struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	file *os.File
+	size int64
+}
+
+var _ Sink = &FileSink{}
+
+// NewFileSink opens (or creates) the file at path for appending.
+func NewFileSink(path string, maxSize int64, maxBackups int) (s *FileSink, err error) {
+	s = &FileSink{
+		Path:       path,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}
+
+	if err = s.open(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (s *FileSink) open() (err error) {
+	if err = os.MkdirAll(filepath.Dir(s.Path), 0750); err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	s.file = f
+	s.size = stat.Size()
+	return
+}
+
+func (s *FileSink) Write(event []byte) (err error) {
+	line := append(event, '\n')
+
+	if s.MaxSize > 0 && s.size+int64(len(line)) > s.MaxSize && s.size > 0 {
+		if err = s.rotate(); err != nil {
+			return
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return
+}
+
+func (s *FileSink) rotate() (err error) {
+	if err = s.file.Close(); err != nil {
+		return
+	}
+
+	if s.MaxBackups > 0 {
+		for i := s.MaxBackups - 1; i > 0; i-- {
+			src := fmt.Sprintf("%s.%d", s.Path, i)
+			if _, err := os.Stat(src); err != nil {
+				continue
+			}
+			if err = os.Rename(src, fmt.Sprintf("%s.%d", s.Path, i+1)); err != nil {
+				return err
+			}
+		}
+
+		if err = os.Rename(s.Path, s.Path+".1"); err != nil {
+			return
+		}
+	} else if err = os.Remove(s.Path); err != nil {
+		return
+	}
+
+	return s.open()
+}
+
+// Close the underlying file.
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
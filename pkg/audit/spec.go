@@ -0,0 +1,67 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// FileOptions are the rotation options of file sinks.
+type FileOptions struct {
+	MaxSize    int64
+	MaxBackups int
+}
+
+// FromSpec builds a Logger from a comma-separated list of sinks:
+//
+//	stdout, stderr, file:<path>, syslog or syslog:<tag>
+//
+// An empty spec gives a Logger discarding every event.
+func FromSpec(spec string, fileOpts FileOptions) (*Logger, error) {
+	sinks := make([]Sink, 0)
+
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		kind, arg := s, ""
+		if idx := strings.IndexByte(s, ':'); idx >= 0 {
+			kind, arg = s[:idx], s[idx+1:]
+		}
+
+		switch kind {
+		case "stdout":
+			sinks = append(sinks, WriterSink{os.Stdout})
+
+		case "stderr":
+			sinks = append(sinks, WriterSink{os.Stderr})
+
+		case "file":
+			if arg == "" {
+				return nil, fmt.Errorf("audit: file sink needs a path")
+			}
+			sink, err := NewFileSink(arg, fileOpts.MaxSize, fileOpts.MaxBackups)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+
+		case "syslog":
+			if arg == "" {
+				arg = "autentigo"
+			}
+			sink, err := NewSyslogSink(arg)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+
+		default:
+			return nil, fmt.Errorf("audit: unknown sink: %q", kind)
+		}
+	}
+
+	return NewLogger(sinks...), nil
+}
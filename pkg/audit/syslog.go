@@ -0,0 +1,27 @@
+package audit
+
+import (
+	"log/syslog"
+)
+
+// SyslogSink sends events to the local syslog daemon.
+type SyslogSink struct {
+	w *syslog.Writer
+}
+
+var _ Sink = SyslogSink{}
+
+// NewSyslogSink connects to the local syslog daemon with the given tag.
+func NewSyslogSink(tag string) (s SyslogSink, err error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return
+	}
+
+	s.w = w
+	return
+}
+
+func (s SyslogSink) Write(event []byte) error {
+	return s.w.Info(string(event))
+}
@@ -0,0 +1,352 @@
+// Package claims transforms the claims of emitted tokens to the shape
+// expected by their consumers.
+package claims
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"text/template"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Config of the claims pipeline.
+//
+// The base mapping is applied to every token, then the mapping of the
+// profile named after the requested audience, if any.
+type Config struct {
+	Mapping
+
+	// Profiles are mappings applied to tokens requested for an audience.
+	Profiles map[string]Mapping `json:"profiles"`
+}
+
+// Reserved claims are set by the server and can't be set or renamed by a mapping.
+var Reserved = map[string]bool{
+	"sub": true,
+	"exp": true,
+	"iat": true,
+	"nbf": true,
+	"jti": true,
+	"iss": true,
+	"aud": true,
+	// marks registry tokens, that are not accepted as identity tokens
+	"access": true,
+}
+
+// Validate checks the mappings are complete and don't set reserved claims.
+func (c *Config) Validate() error {
+	if err := c.Mapping.Validate(); err != nil {
+		return err
+	}
+
+	for name, profile := range c.Profiles {
+		if err := profile.Validate(); err != nil {
+			return fmt.Errorf("profiles.%s.%v", name, err)
+		}
+	}
+	return nil
+}
+
+// UnknownAudienceError is returned when the requested audience has no profile.
+type UnknownAudienceError struct {
+	Audience string
+}
+
+func (e UnknownAudienceError) Error() string {
+	return fmt.Sprintf("unknown audience: %q", e.Audience)
+}
+
+// Apply the pipeline to the claims. When audience is not empty, the profile
+// with that name must exist and the audience is set in the aud claim.
+func (c *Config) Apply(claims jwt.Claims, audience string) (jwt.MapClaims, error) {
+	m, err := ToMap(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.Mapping.Apply(m); err != nil {
+		return nil, err
+	}
+
+	if audience == "" {
+		return m, nil
+	}
+
+	profile, ok := c.Profiles[audience]
+	if !ok {
+		return nil, UnknownAudienceError{audience}
+	}
+
+	if err = profile.Apply(m); err != nil {
+		return nil, fmt.Errorf("profile %s: %v", audience, err)
+	}
+
+	m["aud"] = audience
+	return m, nil
+}
+
+// Mapping describes transformations of claims. They are applied in this
+// order: groups, group_claims, static, templates and then rename. Templates
+// and renames are applied in the order of their names.
+type Mapping struct {
+	// Groups transforms the groups claim.
+	Groups GroupsMapping `json:"groups"`
+
+	// GroupClaims set claims from the user's groups.
+	GroupClaims []GroupClaim `json:"group_claims"`
+
+	// Static claims to add.
+	Static map[string]interface{} `json:"static"`
+
+	// Templates of claims to add (text/template, with the claims as data).
+	Templates map[string]Template `json:"templates"`
+
+	// Rename claims (from: to).
+	Rename map[string]string `json:"rename"`
+}
+
+// GroupsMapping transforms the groups claim. Groups are filtered, then
+// rewritten, then prefixed.
+type GroupsMapping struct {
+	// Include only groups matching one of these expressions (all if empty).
+	Include []Regexp `json:"include"`
+	// Exclude groups matching one of these expressions.
+	Exclude []Regexp `json:"exclude"`
+	// Rewrite groups matching an expression.
+	Rewrite []Rewrite `json:"rewrite"`
+	// Prefix to add to every group (ie: "oidc:").
+	Prefix string `json:"prefix"`
+}
+
+// Rewrite replaces a group matching Match with Replace ($1 expands to the
+// first submatch).
+type Rewrite struct {
+	Match   Regexp `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// GroupClaim sets Claim to Value when the user has a group matching Group.
+// For a given claim, the first matching entry wins.
+type GroupClaim struct {
+	Group Regexp      `json:"group"`
+	Claim string      `json:"claim"`
+	Value interface{} `json:"value"`
+}
+
+// Validate checks the expressions are given and no reserved claim is set or
+// renamed. Errors are prefixed with the path of the invalid field.
+func (m *Mapping) Validate() error {
+	for i, re := range m.Groups.Include {
+		if re.Regexp == nil {
+			return fmt.Errorf("groups.include[%d]: expression is required", i)
+		}
+	}
+	for i, re := range m.Groups.Exclude {
+		if re.Regexp == nil {
+			return fmt.Errorf("groups.exclude[%d]: expression is required", i)
+		}
+	}
+	for i, rw := range m.Groups.Rewrite {
+		if rw.Match.Regexp == nil {
+			return fmt.Errorf("groups.rewrite[%d]: match is required", i)
+		}
+	}
+
+	for i, gc := range m.GroupClaims {
+		switch {
+		case gc.Group.Regexp == nil:
+			return fmt.Errorf("group_claims[%d]: group is required", i)
+		case gc.Claim == "":
+			return fmt.Errorf("group_claims[%d]: claim is required", i)
+		case Reserved[gc.Claim]:
+			return fmt.Errorf("group_claims[%d]: %q is a reserved claim", i, gc.Claim)
+		}
+	}
+
+	for name := range m.Static {
+		if Reserved[name] {
+			return fmt.Errorf("static: %q is a reserved claim", name)
+		}
+	}
+
+	for name, tmpl := range m.Templates {
+		if Reserved[name] {
+			return fmt.Errorf("templates: %q is a reserved claim", name)
+		}
+		if tmpl.Template == nil {
+			return fmt.Errorf("templates.%s: template is required", name)
+		}
+	}
+
+	for from, to := range m.Rename {
+		if Reserved[from] {
+			return fmt.Errorf("rename: %q is a reserved claim", from)
+		}
+		if Reserved[to] {
+			return fmt.Errorf("rename.%s: %q is a reserved claim", from, to)
+		}
+	}
+
+	return nil
+}
+
+// Apply the mapping to the claims.
+func (m *Mapping) Apply(claims jwt.MapClaims) error {
+	if groups, ok := claims["groups"]; ok {
+		mapped := m.Groups.apply(toStrings(groups))
+		if len(mapped) == 0 {
+			delete(claims, "groups")
+		} else {
+			claims["groups"] = mapped
+		}
+	}
+
+	set := map[string]bool{}
+	groups := toStrings(claims["groups"])
+	for _, gc := range m.GroupClaims {
+		if set[gc.Claim] {
+			continue
+		}
+		for _, group := range groups {
+			if gc.Group.MatchString(group) {
+				claims[gc.Claim] = gc.Value
+				set[gc.Claim] = true
+				break
+			}
+		}
+	}
+
+	for name, value := range m.Static {
+		claims[name] = value
+	}
+
+	for _, name := range sortedKeys(m.Templates) {
+		tmpl := m.Templates[name]
+		buf := &bytes.Buffer{}
+		if err := tmpl.Execute(buf, map[string]interface{}(claims)); err != nil {
+			return fmt.Errorf("template %s: %v", name, err)
+		}
+		claims[name] = buf.String()
+	}
+
+	for _, from := range sortedKeys(m.Rename) {
+		to := m.Rename[from]
+		if value, ok := claims[from]; ok {
+			delete(claims, from)
+			claims[to] = value
+		}
+	}
+
+	return nil
+}
+
+func (g GroupsMapping) apply(groups []string) (mapped []string) {
+	mapped = make([]string, 0, len(groups))
+
+	for _, group := range groups {
+		if len(g.Include) != 0 && !matchAny(g.Include, group) {
+			continue
+		}
+		if matchAny(g.Exclude, group) {
+			continue
+		}
+
+		for _, rw := range g.Rewrite {
+			if rw.Match.MatchString(group) {
+				group = rw.Match.ReplaceAllString(group, rw.Replace)
+				break
+			}
+		}
+
+		if group == "" {
+			continue
+		}
+
+		mapped = append(mapped, g.Prefix+group)
+	}
+
+	return
+}
+
+// sortedKeys returns the keys of the map (of templates or renames) in order.
+func sortedKeys(m interface{}) (keys []string) {
+	switch m := m.(type) {
+	case map[string]Template:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+func matchAny(res []Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// ToMap returns the claims as a jwt.MapClaims.
+func ToMap(claims jwt.Claims) (m jwt.MapClaims, err error) {
+	if m, ok := claims.(jwt.MapClaims); ok {
+		return m, nil
+	}
+
+	ba, err := json.Marshal(claims)
+	if err != nil {
+		return
+	}
+
+	m = jwt.MapClaims{}
+	err = json.Unmarshal(ba, &m)
+	return
+}
+
+func toStrings(v interface{}) (values []string) {
+	switch v := v.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		values = make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return
+}
+
+// Regexp is a regular expression read from a string. It is anchored to match
+// the whole value.
+type Regexp struct {
+	*regexp.Regexp
+}
+
+// UnmarshalText compiles the expression.
+func (re *Regexp) UnmarshalText(text []byte) (err error) {
+	re.Regexp, err = regexp.Compile("^(?:" + string(text) + ")$")
+	return
+}
+
+// Template is a text/template read from a string.
+type Template struct {
+	*template.Template
+}
+
+// UnmarshalText parses the template.
+func (t *Template) UnmarshalText(text []byte) (err error) {
+	t.Template, err = template.New("").Parse(string(text))
+	return
+}
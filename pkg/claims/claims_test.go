@@ -0,0 +1,188 @@
+package claims
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	yaml "github.com/projectcalico/go-yaml-wrapper"
+)
+
+func parseConfig(t *testing.T, text string) *Config {
+	t.Helper()
+
+	c := &Config{}
+	if err := yaml.UnmarshalStrict([]byte(text), c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestApply(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   string
+		audience string
+		claims   jwt.MapClaims
+		expected jwt.MapClaims
+	}{
+		{
+			name:     "empty mapping",
+			config:   `{}`,
+			claims:   jwt.MapClaims{"sub": "bob", "groups": []string{"a"}},
+			expected: jwt.MapClaims{"sub": "bob", "groups": []string{"a"}},
+		},
+		{
+			name: "groups",
+			config: `
+groups:
+  include: [ "team-.*", admins ]
+  exclude: [ team-internal ]
+  rewrite:
+  - { match: "team-(.*)", replace: "$1" }
+  prefix: "oidc:"`,
+			claims:   jwt.MapClaims{"groups": []interface{}{"team-dev", "team-internal", "admins", "other", "admins-x"}},
+			expected: jwt.MapClaims{"groups": []string{"oidc:dev", "oidc:admins"}},
+		},
+		{
+			name:     "no group left",
+			config:   `groups: { include: [ admins ] }`,
+			claims:   jwt.MapClaims{"sub": "bob", "groups": []string{"dev"}},
+			expected: jwt.MapClaims{"sub": "bob"},
+		},
+		{
+			name:     "rewrite to nothing drops the group",
+			config:   `groups: { rewrite: [ { match: "tmp-.*", replace: "" } ] }`,
+			claims:   jwt.MapClaims{"groups": []string{"tmp-1", "dev"}},
+			expected: jwt.MapClaims{"groups": []string{"dev"}},
+		},
+		{
+			name: "group claims, first match wins",
+			config: `
+groups: { prefix: "x:" }
+group_claims:
+- { group: "x:admins", claim: role, value: Admin }
+- { group: ".*", claim: role, value: Viewer }
+- { group: "x:ops", claim: oncall, value: true }`,
+			claims:   jwt.MapClaims{"groups": []string{"dev", "admins"}},
+			expected: jwt.MapClaims{"groups": []string{"x:dev", "x:admins"}, "role": "Admin"},
+		},
+		{
+			name: "static, templates then rename",
+			config: `
+static: { org: main }
+templates:
+  preferred_username: "{{ .sub }}@{{ .org }}"
+rename:
+  display_name: name`,
+			claims: jwt.MapClaims{"sub": "bob", "display_name": "Bob"},
+			expected: jwt.MapClaims{
+				"sub":                "bob",
+				"name":               "Bob",
+				"org":                "main",
+				"preferred_username": "bob@main",
+			},
+		},
+		{
+			name: "chained templates and renames apply in name order",
+			config: `
+templates:
+  b: "{{ .a }}-b"
+  a: "a"
+rename:
+  one: two
+  two: zero`,
+			claims:   jwt.MapClaims{"one": 1},
+			expected: jwt.MapClaims{"a": "a", "b": "a-b", "zero": 1},
+		},
+		{
+			name: "profile",
+			config: `
+static: { org: main }
+profiles:
+  grafana:
+    static: { org: grafana }
+    rename: { email: login }`,
+			audience: "grafana",
+			claims:   jwt.MapClaims{"sub": "bob", "email": "bob@example.com"},
+			expected: jwt.MapClaims{"sub": "bob", "login": "bob@example.com", "org": "grafana", "aud": "grafana"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := parseConfig(t, tc.config)
+			if err := c.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := c.Apply(tc.claims, tc.audience)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(m, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, m)
+			}
+		})
+	}
+}
+
+func TestApplyUnknownAudience(t *testing.T) {
+	c := parseConfig(t, `profiles: { grafana: {} }`)
+
+	_, err := c.Apply(jwt.MapClaims{"sub": "bob"}, "other")
+	if _, ok := err.(UnknownAudienceError); !ok {
+		t.Error("expected an UnknownAudienceError, got ", err)
+	}
+}
+
+func TestApplyStructClaims(t *testing.T) {
+	c := parseConfig(t, `rename: { sub2: copy }`)
+
+	m, err := c.Apply(jwt.StandardClaims{Subject: "bob", ExpiresAt: 10}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// numbers are decoded from JSON
+	if m["sub"] != "bob" || m["exp"] != float64(10) {
+		t.Error("unexpected claims: ", m)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		err    string
+	}{
+		{`groups: { include: [ "a", null ] }`, "groups.include[1]: expression is required"},
+		{`groups: { exclude: [ null ] }`, "groups.exclude[0]: expression is required"},
+		{`groups: { rewrite: [ { replace: x } ] }`, "groups.rewrite[0]: match is required"},
+		{`group_claims: [ { claim: role, value: x } ]`, "group_claims[0]: group is required"},
+		{`group_claims: [ { group: x, value: x } ]`, "group_claims[0]: claim is required"},
+		{`group_claims: [ { group: x, claim: aud, value: x } ]`, `group_claims[0]: "aud" is a reserved claim`},
+		{`static: { exp: 0 }`, `static: "exp" is a reserved claim`},
+		{`static: { access: [] }`, `static: "access" is a reserved claim`},
+		{`templates: { iss: "x" }`, `templates: "iss" is a reserved claim`},
+		{`rename: { sub: user }`, `rename: "sub" is a reserved claim`},
+		{`rename: { user: jti }`, `rename.user: "jti" is a reserved claim`},
+		{`profiles: { p: { static: { nbf: 0 } } }`, `profiles.p.static: "nbf" is a reserved claim`},
+		{`profiles: { p: { groups: { rewrite: [ {} ] } } }`, "profiles.p.groups.rewrite[0]: match is required"},
+	} {
+		err := parseConfig(t, tc.config).Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error %q, got %v", tc.config, tc.err, err)
+		}
+	}
+
+	valid := parseConfig(t, `
+groups: { include: [ ".*" ], rewrite: [ { match: "a", replace: b } ] }
+group_claims: [ { group: x, claim: role, value: x } ]
+static: { org: x }
+templates: { username: "{{ .sub }}" }
+rename: { display_name: name }`)
+
+	if err := valid.Validate(); err != nil {
+		t.Error("unexpected error: ", err)
+	}
+}
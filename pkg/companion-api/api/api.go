@@ -4,27 +4,54 @@ import (
 	"net/http"
 
 	restful "github.com/emicklei/go-restful"
+	agapi "github.com/mcluseau/autentigo/api"
 	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
+	"github.com/mcluseau/autentigo/pkg/mail"
+	passwordpolicy "github.com/mcluseau/autentigo/pkg/password-policy"
 	"github.com/mcluseau/autentigo/pkg/rbac"
 )
 
 var (
 	// ErrMissingContent indicates an inexistent user.
-	ErrMissingUser = restful.NewError(http.StatusConflict, "Missing user")
+	ErrMissingUser = backend.ErrMissingUser
+	// ErrUnknownUser indicates a requested user that doesn't exist.
+	ErrUnknownUser = restful.NewError(http.StatusNotFound, "Unknown user")
 	// ErrMissingUserId indicates an user without an id.
 	ErrMissingUserId = restful.NewError(http.StatusUnprocessableEntity, "No user id given")
 	// ErrMissingUserPassword indicates an user without a password.
 	ErrMissingUserPassword = restful.NewError(http.StatusUnprocessableEntity, "No user password given.")
 	// ErrUserAlreadyExist indicates an existing user that should not be.
 	ErrUserAlreadyExist = restful.NewError(http.StatusConflict, "User already exist")
+	// ErrVersionMismatch indicates the user has been modified since the version given by the client.
+	ErrVersionMismatch = restful.NewError(http.StatusPreconditionFailed, "User version mismatch")
+	// ErrNoGroupStore indicates a backend not configured to store groups metadata.
+	ErrNoGroupStore = restful.NewError(http.StatusNotImplemented, "The backend doesn't store groups metadata")
 	// ErrPatchFail indicates the json-patch update fails.
 	ErrPatchFail = restful.NewError(http.StatusConflict, "Patch update fails")
+	// ErrPasswordNotPatchable indicates a patch of the password, that must be set through its route.
+	ErrPasswordNotPatchable = restful.NewError(http.StatusUnprocessableEntity, "The password can't be patched")
 )
 
 // CompanionAPI registering with restful
 type CompanionAPI struct {
 	Client     backend.Client
+	Backend    string
 	AdminToken string
+
+	// Authenticator verifies the current password of users changing it.
+	Authenticator agapi.Authenticator
+
+	// PasswordPolicy new passwords must comply with (passwordpolicy.Default if nil).
+	PasswordPolicy *passwordpolicy.Policy
+
+	// Mailer sends the password reset and email verification mails (disabled if nil).
+	Mailer *mail.Mailer
+	// TokenKey signs the password reset and email verification tokens.
+	TokenKey []byte
+	// PasswordReset configures the password reset links.
+	PasswordReset MailLinkConfig
+	// EmailVerification configures the email verification links.
+	EmailVerification MailLinkConfig
 }
 
 // Register provide a restful.WebService from this API
@@ -32,12 +59,16 @@ func (cApi *CompanionAPI) WebServices() []*restful.WebService {
 	return []*restful.WebService{
 		cApi.meWS(),
 		cApi.usersWS(),
+		cApi.groupsWS(),
+		cApi.passwordResetWS(),
+		cApi.emailVerificationWS(),
 	}
 }
 
 func requireRole(bypass, role string) restful.FilterFunction {
 	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
 		if len(bypass) != 0 && req.HeaderParameter("Authorization") == "Bearer "+bypass {
+			req.SetAttribute("admin-token", true)
 			chain.ProcessFilter(req, resp)
 			return
 		}
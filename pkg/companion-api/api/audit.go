@@ -0,0 +1,52 @@
+package api
+
+import (
+	restful "github.com/emicklei/go-restful"
+
+	"github.com/mcluseau/autentigo/pkg/audit"
+	"github.com/mcluseau/autentigo/pkg/rbac"
+)
+
+// actorOf returns the name of the user doing the request
+func actorOf(request *restful.Request) string {
+	if u, ok := request.Attribute("user").(*rbac.User); ok && u != nil {
+		return u.Name
+	}
+	if request.Attribute("admin-token") == true {
+		return "<admin-token>"
+	}
+	return "<anonymous>"
+}
+
+func (cApi *CompanionAPI) audit(request *restful.Request, eventType, userID string, err error) {
+	audit.Log(cApi.auditEvent(request, eventType, userID, err))
+}
+
+func (cApi *CompanionAPI) auditGroup(request *restful.Request, eventType, group string, details map[string]interface{}, err error) {
+	event := cApi.auditEvent(request, eventType, "", err)
+
+	event.Details = map[string]interface{}{"group": group}
+	for k, v := range details {
+		event.Details[k] = v
+	}
+
+	audit.Log(event)
+}
+
+func (cApi *CompanionAPI) auditEvent(request *restful.Request, eventType, userID string, err error) audit.Event {
+	event := audit.Event{
+		Type:     eventType,
+		Success:  err == nil,
+		User:     userID,
+		Actor:    actorOf(request),
+		Backend:  cApi.Backend,
+		SourceIP: audit.SourceIP(request.Request),
+		Route:    request.Request.URL.Path,
+	}
+
+	if err != nil {
+		event.Reason = err.Error()
+	}
+
+	return event
+}
@@ -10,6 +10,11 @@ import (
 
 // write error in good http format with error stack in it
 func writeError(err error, response *restful.Response) {
+	if policyErr, ok := err.(PolicyError); ok {
+		writePolicyError(policyErr, response)
+		return
+	}
+
 	response.AddHeader("Content-Type", "text/plain")
 
 	if rfErr, ok := err.(restful.ServiceError); ok {
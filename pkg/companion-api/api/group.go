@@ -0,0 +1,457 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	restful "github.com/emicklei/go-restful"
+
+	"github.com/mcluseau/autentigo/pkg/audit"
+	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
+)
+
+var (
+	// ErrUnknownGroup indicates a group without members nor metadata.
+	ErrUnknownGroup = restful.NewError(http.StatusNotFound, "Unknown group")
+	// ErrGroupAlreadyExist indicates an existing group that should not be.
+	ErrGroupAlreadyExist = restful.NewError(http.StatusConflict, "Group already exist")
+	// ErrInvalidGroupName indicates an empty group name or with a comma.
+	ErrInvalidGroupName = restful.NewError(http.StatusUnprocessableEntity, "Invalid group name")
+)
+
+// GroupInfo is a group with its members count and metadata
+type GroupInfo struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+	backend.GroupMeta
+}
+
+// GroupMembersReq is a request to add and remove members of a group
+type GroupMembersReq struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// GroupRenameReq is a request to rename a group
+type GroupRenameReq struct {
+	Name string `json:"name"`
+}
+
+// Register provide a restful.WebService from this API
+func (cApi *CompanionAPI) groupsWS() (ws *restful.WebService) {
+	ws = &restful.WebService{}
+	ws.Path("/groups")
+	ws.Consumes(restful.MIME_JSON)
+	ws.Produces(restful.MIME_JSON)
+	ws.Filter(requireRole(cApi.AdminToken, "admin"))
+	ws.Doc("Requires the admin role")
+
+	groupParam := ws.PathParameter("group", "name of the group").DataType("string")
+
+	ws.
+		Route(ws.GET("").
+			To(cApi.listGroups).
+			Doc("List groups, with their members count.").
+			Writes([]GroupInfo{}))
+
+	ws.
+		Route(ws.GET("/{group}").
+			To(cApi.getGroup).
+			Doc("Get a group.").
+			Param(groupParam).
+			Writes(GroupInfo{}))
+
+	ws.
+		Route(ws.PUT("/{group}").
+			To(cApi.putGroup).
+			Doc("Set the metadata of a group.").
+			Param(groupParam).
+			Reads(backend.GroupMeta{}))
+
+	ws.
+		Route(ws.DELETE("/{group}").
+			To(cApi.deleteGroup).
+			Doc("Delete a group, removing it from all its members.").
+			Param(groupParam))
+
+	ws.
+		Route(ws.GET("/{group}/members").
+			To(cApi.listGroupMembers).
+			Doc("List the members of a group.").
+			Param(groupParam).
+			Writes([]string{}))
+
+	ws.
+		Route(ws.POST("/{group}/members").
+			To(cApi.updateGroupMembers).
+			Doc("Add and remove members of a group.").
+			Param(groupParam).
+			Reads(GroupMembersReq{}))
+
+	ws.
+		Route(ws.POST("/{group}/rename").
+			To(cApi.renameGroup).
+			Doc("Rename a group in all its members.").
+			Param(groupParam).
+			Reads(GroupRenameReq{}))
+
+	return
+}
+
+func (cApi *CompanionAPI) listGroups(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	groups := map[string]*GroupInfo{}
+	group := func(name string) *GroupInfo {
+		g, ok := groups[name]
+		if !ok {
+			g = &GroupInfo{Name: name}
+			groups[name] = g
+		}
+		return g
+	}
+
+	cApi.eachUser(backend.ListOptions{}, func(u backend.User) {
+		for _, name := range u.ExtraClaims.Groups {
+			group(name).Members++
+		}
+	})
+
+	if gs, ok := cApi.Client.(backend.GroupStore); ok {
+		metas, err := gs.ListGroups()
+		if err != nil && err != ErrNoGroupStore {
+			panic(err)
+		}
+
+		for name, meta := range metas {
+			group(name).GroupMeta = meta
+		}
+	}
+
+	result := make([]GroupInfo, 0, len(groups))
+	for _, g := range groups {
+		result = append(result, *g)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	response.WriteEntity(result)
+}
+
+func (cApi *CompanionAPI) getGroup(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	name := request.PathParameter("group")
+
+	members := cApi.groupMembers(name)
+	meta := cApi.groupMeta(name)
+
+	if len(members) == 0 && meta == nil {
+		panic(ErrUnknownGroup)
+	}
+
+	g := GroupInfo{Name: name, Members: len(members)}
+	if meta != nil {
+		g.GroupMeta = *meta
+	}
+
+	response.WriteEntity(g)
+}
+
+func (cApi *CompanionAPI) putGroup(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	name := request.PathParameter("group")
+	checkGroupName(name)
+
+	meta := &backend.GroupMeta{}
+	if err := request.ReadEntity(meta); err != nil {
+		panic(restful.NewError(http.StatusBadRequest, err.Error()))
+	}
+
+	gs, ok := cApi.Client.(backend.GroupStore)
+	if !ok {
+		panic(ErrNoGroupStore)
+	}
+
+	err := gs.PutGroup(name, meta)
+	cApi.auditGroup(request, audit.GroupUpdated, name, nil, err)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (cApi *CompanionAPI) deleteGroup(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	name := request.PathParameter("group")
+
+	found := cApi.groupMeta(name) != nil
+
+	err := backend.UpdateUsers(cApi.Client, func(id string, user *backend.UserData) (bool, error) {
+		groups, removed := withoutGroup(user.ExtraClaims.Groups, name)
+		user.ExtraClaims.Groups = groups
+		found = found || removed
+		return removed, nil
+	})
+
+	if err == nil && !found {
+		panic(ErrUnknownGroup)
+	}
+
+	if gs, ok := cApi.Client.(backend.GroupStore); ok && err == nil {
+		if err = gs.DeleteGroup(name); err == ErrNoGroupStore {
+			err = nil
+		}
+	}
+
+	cApi.auditGroup(request, audit.GroupDeleted, name, nil, err)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (cApi *CompanionAPI) listGroupMembers(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	name := request.PathParameter("group")
+
+	members := cApi.groupMembers(name)
+	if len(members) == 0 && cApi.groupMeta(name) == nil {
+		panic(ErrUnknownGroup)
+	}
+
+	response.WriteEntity(members)
+}
+
+func (cApi *CompanionAPI) updateGroupMembers(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	name := request.PathParameter("group")
+	checkGroupName(name)
+
+	req := &GroupMembersReq{}
+	if err := request.ReadEntity(req); err != nil {
+		panic(restful.NewError(http.StatusBadRequest, err.Error()))
+	}
+
+	// check the added users exist
+	unknown := make([]string, 0)
+	for _, id := range req.Add {
+		if _, _, err := cApi.Client.GetUser(id); err == ErrMissingUser {
+			unknown = append(unknown, id)
+		} else if err != nil {
+			panic(err)
+		}
+	}
+
+	if len(unknown) != 0 {
+		panic(restful.NewError(http.StatusUnprocessableEntity, "Unknown users: "+strings.Join(unknown, ", ")))
+	}
+
+	add := setOf(req.Add)
+	remove := setOf(req.Remove)
+
+	err := backend.UpdateUsers(cApi.Client, func(id string, user *backend.UserData) (modified bool, err error) {
+		c := &user.ExtraClaims
+
+		switch {
+		case add[id] && !remove[id]:
+			if !hasGroup(c.Groups, name) {
+				c.Groups = append(c.Groups, name)
+				modified = true
+			}
+
+		case remove[id] && !add[id]:
+			c.Groups, modified = withoutGroup(c.Groups, name)
+		}
+
+		return
+	})
+
+	cApi.auditGroup(request, audit.GroupMembers, name, map[string]interface{}{
+		"add":    req.Add,
+		"remove": req.Remove,
+	}, err)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (cApi *CompanionAPI) renameGroup(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	name := request.PathParameter("group")
+
+	req := &GroupRenameReq{}
+	if err := request.ReadEntity(req); err != nil {
+		panic(restful.NewError(http.StatusBadRequest, err.Error()))
+	}
+
+	newName := req.Name
+	checkGroupName(newName)
+
+	if newName == name {
+		return
+	}
+
+	if len(cApi.groupMembers(newName)) != 0 || cApi.groupMeta(newName) != nil {
+		panic(ErrGroupAlreadyExist)
+	}
+
+	meta := cApi.groupMeta(name)
+	found := meta != nil
+
+	err := backend.UpdateUsers(cApi.Client, func(id string, user *backend.UserData) (modified bool, err error) {
+		c := &user.ExtraClaims
+
+		for i, g := range c.Groups {
+			if g == name {
+				c.Groups[i] = newName
+				modified = true
+			}
+		}
+
+		found = found || modified
+		return
+	})
+
+	if err == nil && !found {
+		panic(ErrUnknownGroup)
+	}
+
+	if meta != nil && err == nil {
+		gs := cApi.Client.(backend.GroupStore)
+		if err = gs.PutGroup(newName, meta); err == nil {
+			err = gs.DeleteGroup(name)
+		}
+	}
+
+	cApi.auditGroup(request, audit.GroupRenamed, name, map[string]interface{}{"new_name": newName}, err)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+// eachUser calls f on each user matching the options.
+func (cApi *CompanionAPI) eachUser(opts backend.ListOptions, f func(u backend.User)) {
+	opts.Limit = backend.MaxListLimit
+	if err := opts.Validate(); err != nil {
+		panic(err)
+	}
+
+	for {
+		list, err := cApi.Client.ListUsers(opts)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, u := range list.Users {
+			f(u)
+		}
+
+		if list.Continue == "" {
+			return
+		}
+		opts.Continue = list.Continue
+	}
+}
+
+// groupMembers returns the ids of the group's members.
+func (cApi *CompanionAPI) groupMembers(name string) (members []string) {
+	members = make([]string, 0)
+	cApi.eachUser(backend.ListOptions{Group: name}, func(u backend.User) {
+		members = append(members, u.ID)
+	})
+	return
+}
+
+// groupMeta returns the group's metadata, or nil if it has none or they're not stored.
+func (cApi *CompanionAPI) groupMeta(name string) *backend.GroupMeta {
+	gs, ok := cApi.Client.(backend.GroupStore)
+	if !ok {
+		return nil
+	}
+
+	meta, err := gs.GetGroup(name)
+	if err == ErrNoGroupStore {
+		return nil
+	} else if err != nil {
+		panic(err)
+	}
+	return meta
+}
+
+func checkGroupName(name string) {
+	if name == "" || strings.Contains(name, ",") {
+		panic(ErrInvalidGroupName)
+	}
+}
+
+func hasGroup(groups []string, name string) bool {
+	for _, g := range groups {
+		if g == name {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutGroup(groups []string, name string) (result []string, removed bool) {
+	for _, g := range groups {
+		if g == name {
+			removed = true
+		} else {
+			result = append(result, g)
+		}
+	}
+	return
+}
+
+func setOf(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
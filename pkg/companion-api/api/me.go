@@ -1,77 +1,222 @@
 package api
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"log"
+	"encoding/json"
 	"net/http"
+	"time"
 
 	restful "github.com/emicklei/go-restful"
+	agapi "github.com/mcluseau/autentigo/api"
+	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/audit"
 	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
 	"github.com/mcluseau/autentigo/pkg/rbac"
 )
 
+var (
+	// ErrInvalidCurrentPassword indicates a password change with a wrong current password.
+	ErrInvalidCurrentPassword = restful.NewError(http.StatusForbidden, "Invalid current password")
+	// ErrNoAuthenticator indicates the current password can't be verified.
+	ErrNoAuthenticator = restful.NewError(http.StatusNotImplemented, "No authenticator to verify the current password")
+)
+
 // Register provide a restful.WebService from this API
 func (cApi *CompanionAPI) meWS() (ws *restful.WebService) {
 	ws = &restful.WebService{}
+	ws.Path("/me")
 	ws.Consumes(restful.MIME_JSON)
 	ws.Produces(restful.MIME_JSON)
 	ws.Filter(requireRole("", "self-service"))
 	ws.Doc("Requires the self-service role")
 
 	ws.
-		Route(ws.PUT("/me").
+		Route(ws.GET("").
 			To(cApi.getMe).
-			Doc("Get informations on the authenticated user.").
+			Doc("Get the profile of the authenticated user.").
 			Writes(&MeResponse{}))
 
 	ws.
-		Route(ws.PUT("/me/password").
+		Route(ws.PATCH("").
+			To(cApi.updateMe).
+			Doc("Update the profile of the authenticated user (display_name and email only).").
+			Param(ws.HeaderParameter("If-Match", "ETag of the profile's version to modify")).
+			Reads(MeUpdateReq{}))
+
+	ws.
+		Route(ws.PUT("/password").
 			To(cApi.updateMyPassword).
 			Doc("Update the authenticated user's password.").
-			Reads(UpdatePasswordReq{}))
+			Reads(UpdateMyPasswordReq{}))
+
+	ws.
+		Route(ws.POST("/email-verification").
+			To(cApi.resendMyEmailVerification).
+			Doc("Send again the verification link of the authenticated user's email."))
 
 	return ws
 }
 
+// MeResponse is the profile of the authenticated user
 type MeResponse struct {
-	Sub string
+	Sub string `json:"sub"`
+	auth.ExtraClaims
+}
+
+// MeUpdateReq is an update of the authenticated user's profile. Only the given
+// fields are updated.
+type MeUpdateReq struct {
+	DisplayName *string `json:"display_name"`
+	// Email of the user. Changing it resets email_verified.
+	Email *string `json:"email"`
 }
 
 func (cApi *CompanionAPI) getMe(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
 	u := request.Attribute("user").(*rbac.User)
-	response.WriteEntity(MeResponse{u.Name})
+
+	user, version, err := cApi.Client.GetUser(u.Name)
+	if err == ErrMissingUser {
+		panic(ErrUnknownUser)
+	} else if err != nil {
+		panic(err)
+	}
+
+	setETag(response, version)
+	response.WriteEntity(MeResponse{Sub: u.Name, ExtraClaims: user.ExtraClaims})
 }
 
-type UpdatePasswordReq struct {
-	NewPassword string
+func (cApi *CompanionAPI) updateMe(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	u := request.Attribute("user").(*rbac.User)
+
+	// only allowed fields
+	req := MeUpdateReq{}
+
+	dec := json.NewDecoder(request.Request.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		panic(restful.NewError(http.StatusBadRequest, err.Error()))
+	}
+
+	var verify *backend.UserData
+
+	err := cApi.Client.UpdateUser(u.Name, cApi.ifMatch(request, u.Name), func(user *backend.UserData) error {
+		previous := user.ExtraClaims
+		c := &user.ExtraClaims
+
+		if req.DisplayName != nil {
+			c.DisplayName = *req.DisplayName
+		}
+
+		if req.Email != nil && *req.Email != c.Email {
+			c.Email = *req.Email
+			c.EmailVerified = false
+		}
+
+		verify = nil
+		if emailToVerify(previous, user) {
+			updated := *user
+			verify = &updated
+		}
+
+		return nil
+	})
+	cApi.audit(request, audit.UserUpdated, u.Name, err)
+
+	if err != nil {
+		panic(err)
+	}
+
+	if verify != nil {
+		cApi.sendEmailVerification(request, u.Name, *verify)
+	}
+}
+
+// UpdateMyPasswordReq is a password change by the authenticated user
+type UpdateMyPasswordReq struct {
+	CurrentPassword string
+	NewPassword     string
 }
 
 func (cApi *CompanionAPI) updateMyPassword(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
 	u := request.Attribute("user").(*rbac.User)
 
-	cApi.updatePassword(u.Name, request, response)
+	r := &UpdateMyPasswordReq{}
+	if err := request.ReadEntity(r); err != nil {
+		response.WriteError(http.StatusBadRequest, err)
+		return
+	}
+
+	if cApi.Authenticator == nil {
+		panic(ErrNoAuthenticator)
+	}
+
+	// the token is not enough, verify the user knows the current password
+	_, err := cApi.Authenticator.Authenticate(u.Name, r.CurrentPassword, time.Now().Add(time.Minute))
+	if err == agapi.ErrInvalidAuthentication {
+		cApi.audit(request, audit.PasswordChanged, u.Name, err)
+		panic(ErrInvalidCurrentPassword)
+	} else if err != nil {
+		panic(err)
+	}
+
+	cApi.setPassword(u.Name, r.NewPassword, request, response)
+}
+
+// UpdatePasswordReq is a password change by an admin
+type UpdatePasswordReq struct {
+	NewPassword string
 }
 
 func (cApi *CompanionAPI) updatePassword(userName string, request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
 	r := &UpdatePasswordReq{}
 	if err := request.ReadEntity(r); err != nil {
 		response.WriteError(http.StatusBadRequest, err)
 		return
 	}
 
-	h := sha256.Sum256([]byte(r.NewPassword))
-	passwordHash := hex.EncodeToString(h[:])
+	cApi.setPassword(userName, r.NewPassword, request, response)
+}
+
+// setPassword sets the password of the user, if it complies with the password policy.
+func (cApi *CompanionAPI) setPassword(userName, password string, request *restful.Request, response *restful.Response) {
+	passwordHash := hashPassword(password)
 
-	err := cApi.Client.UpdateUser(userName, func(user *backend.UserData) error {
-		user.PasswordHash = passwordHash
-		return nil
+	err := cApi.Client.UpdateUser(userName, "", func(user *backend.UserData) error {
+		if err := cApi.checkPassword(password, userName, user); err != nil {
+			return err
+		}
+		return cApi.setPasswordHash(user, passwordHash)
 	})
+	cApi.audit(request, audit.PasswordChanged, userName, err)
 
 	if err != nil {
-		log.Print("update error on user ", userName, ": ", err)
-		sc := http.StatusInternalServerError
-		response.WriteErrorString(sc, http.StatusText(sc))
-		return
+		panic(err)
 	}
 }
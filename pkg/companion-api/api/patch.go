@@ -0,0 +1,157 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	restful "github.com/emicklei/go-restful"
+	jsonpatch "github.com/evanphx/json-patch"
+
+	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/audit"
+	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
+)
+
+const (
+	// MimeJSONPatch is the content type of JSON patches (RFC 6902)
+	MimeJSONPatch = "application/json-patch+json"
+	// MimeMergePatch is the content type of JSON merge patches (RFC 7396)
+	MimeMergePatch = "application/merge-patch+json"
+)
+
+// patchDocument is the document patches apply to: the user without its
+// password, with all the fields present, so they can be replaced or tested.
+type patchDocument struct {
+	Claims patchClaims `json:"claims"`
+}
+
+// patchClaims are auth.ExtraClaims without omitempty
+type patchClaims struct {
+	DisplayName   string   `json:"display_name"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Groups        []string `json:"groups"`
+}
+
+func (cApi *CompanionAPI) patchUser(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	id := request.PathParameter("user-id")
+
+	body, err := ioutil.ReadAll(request.Request.Body)
+	if err != nil {
+		panic(err)
+	}
+
+	apply, err := patchFunc(request.HeaderParameter("Content-Type"), body)
+	if err != nil {
+		panic(err)
+	}
+
+	var verify *backend.UserData
+
+	err = cApi.Client.UpdateUser(id, cApi.ifMatch(request, id), func(user *backend.UserData) error {
+		doc := patchDocument{Claims: patchClaims(user.ExtraClaims)}
+		if doc.Claims.Groups == nil {
+			// allow adding with /claims/groups/-
+			doc.Claims.Groups = []string{}
+		}
+
+		ba, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+
+		if ba, err = apply(ba); err != nil {
+			return ErrPatchFail
+		}
+
+		patched := patchDocument{}
+
+		dec := json.NewDecoder(bytes.NewReader(ba))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(&patched); err != nil {
+			return ErrPatchFail
+		}
+
+		if len(patched.Claims.Groups) == 0 {
+			patched.Claims.Groups = nil
+		}
+
+		previous := user.ExtraClaims
+		user.ExtraClaims = auth.ExtraClaims(patched.Claims)
+
+		verify = nil
+		if emailToVerify(previous, user) {
+			updated := *user
+			verify = &updated
+		}
+
+		return nil
+	})
+	cApi.audit(request, audit.UserUpdated, id, err)
+
+	if err != nil {
+		panic(err)
+	}
+
+	if verify != nil {
+		cApi.sendEmailVerification(request, id, *verify)
+	}
+
+	response.WriteHeader(http.StatusOK)
+}
+
+// patchFunc returns the function applying the patch, given its content type.
+func patchFunc(contentType string, patch []byte) (apply func(doc []byte) ([]byte, error), err error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch mediaType {
+	case MimeJSONPatch:
+		p, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, restful.NewError(http.StatusBadRequest, "Invalid JSON patch: "+err.Error())
+		}
+
+		for _, op := range p {
+			path, _ := op.Path()
+			from, _ := op.From()
+
+			if isPasswordPath(path) || isPasswordPath(from) {
+				return nil, ErrPasswordNotPatchable
+			}
+		}
+
+		return p.Apply, nil
+
+	case MimeMergePatch:
+		m := map[string]interface{}{}
+		if err := json.Unmarshal(patch, &m); err != nil {
+			return nil, restful.NewError(http.StatusBadRequest, "Invalid merge patch: "+err.Error())
+		}
+
+		if _, ok := m["password"]; ok {
+			return nil, ErrPasswordNotPatchable
+		}
+
+		return func(doc []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(doc, patch)
+		}, nil
+
+	default:
+		return nil, restful.NewError(http.StatusUnsupportedMediaType, "Unsupported patch type")
+	}
+}
+
+func isPasswordPath(path string) bool {
+	return path == "/password" || strings.HasPrefix(path, "/password/")
+}
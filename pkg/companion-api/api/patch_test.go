@@ -0,0 +1,184 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	restful "github.com/emicklei/go-restful"
+
+	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
+)
+
+func TestPatchFunc(t *testing.T) {
+	doc := `{"claims":{"display_name":"Bob","email":"bob@example.com","email_verified":true,"groups":["dev"]}}`
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		patch       string
+		expected    string
+		err         error
+	}{
+		{
+			name:        "json patch",
+			contentType: MimeJSONPatch,
+			patch:       `[{"op":"replace","path":"/claims/display_name","value":"Bobby"},{"op":"add","path":"/claims/groups/-","value":"ops"}]`,
+			expected:    `{"claims":{"display_name":"Bobby","email":"bob@example.com","email_verified":true,"groups":["dev","ops"]}}`,
+		},
+		{
+			name:        "json patch with charset",
+			contentType: MimeJSONPatch + "; charset=utf-8",
+			patch:       `[{"op":"remove","path":"/claims/groups/0"}]`,
+			expected:    `{"claims":{"display_name":"Bob","email":"bob@example.com","email_verified":true,"groups":[]}}`,
+		},
+		{
+			name:        "merge patch",
+			contentType: MimeMergePatch,
+			patch:       `{"claims":{"email":"new@example.com","groups":null}}`,
+			expected:    `{"claims":{"display_name":"Bob","email":"new@example.com","email_verified":true}}`,
+		},
+		{name: "replace password", contentType: MimeJSONPatch, patch: `[{"op":"replace","path":"/password","value":"x"}]`, err: ErrPasswordNotPatchable},
+		{name: "add in password", contentType: MimeJSONPatch, patch: `[{"op":"add","path":"/password/x","value":"x"}]`, err: ErrPasswordNotPatchable},
+		{name: "copy password", contentType: MimeJSONPatch, patch: `[{"op":"copy","from":"/password","path":"/claims/display_name"}]`, err: ErrPasswordNotPatchable},
+		{name: "move password", contentType: MimeJSONPatch, patch: `[{"op":"move","from":"/password","path":"/x"}]`, err: ErrPasswordNotPatchable},
+		{name: "merge password", contentType: MimeMergePatch, patch: `{"password":"x"}`, err: ErrPasswordNotPatchable},
+		{name: "merge null password", contentType: MimeMergePatch, patch: `{"password":null}`, err: ErrPasswordNotPatchable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			apply, err := patchFunc(tc.contentType, []byte(tc.patch))
+			if err != tc.err {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+			if err != nil {
+				return
+			}
+
+			patched, err := apply([]byte(doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(patched) != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, patched)
+			}
+		})
+	}
+}
+
+func TestPatchFuncInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		contentType string
+		patch       string
+		status      int
+	}{
+		{MimeJSONPatch, `{"op":"add"}`, http.StatusBadRequest},
+		{MimeMergePatch, `[]`, http.StatusBadRequest},
+		{"application/json", `{}`, http.StatusUnsupportedMediaType},
+		{"", `{}`, http.StatusUnsupportedMediaType},
+	} {
+		_, err := patchFunc(tc.contentType, []byte(tc.patch))
+		if err == nil {
+			t.Errorf("%s %s: expected an error", tc.contentType, tc.patch)
+		} else if status := statusOf(err); status != tc.status {
+			t.Errorf("%s %s: expected status %d, got %d", tc.contentType, tc.patch, tc.status, status)
+		}
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	bob := backend.UserData{
+		PasswordHash:    hashPassword("secret"),
+		PasswordHistory: []string{hashPassword("old secret")},
+		ExtraClaims:     auth.ExtraClaims{DisplayName: "Bob", Email: "bob@example.com", EmailVerified: true, Groups: []string{"dev"}},
+	}
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		patch       string
+		status      int
+		expected    auth.ExtraClaims
+	}{
+		{
+			name:        "json patch",
+			contentType: MimeJSONPatch,
+			patch:       `[{"op":"test","path":"/claims/display_name","value":"Bob"},{"op":"add","path":"/claims/groups/-","value":"ops"}]`,
+			status:      http.StatusOK,
+			expected:    auth.ExtraClaims{DisplayName: "Bob", Email: "bob@example.com", EmailVerified: true, Groups: []string{"dev", "ops"}},
+		},
+		{
+			name:        "merge patch",
+			contentType: MimeMergePatch,
+			patch:       `{"claims":{"display_name":"Bobby","groups":[]}}`,
+			status:      http.StatusOK,
+			expected:    auth.ExtraClaims{DisplayName: "Bobby", Email: "bob@example.com", EmailVerified: true},
+		},
+		{
+			name:        "failed test",
+			contentType: MimeJSONPatch,
+			patch:       `[{"op":"test","path":"/claims/display_name","value":"Alice"},{"op":"remove","path":"/claims/groups"}]`,
+			status:      http.StatusConflict,
+			expected:    bob.ExtraClaims,
+		},
+		{
+			name:        "unknown field",
+			contentType: MimeMergePatch,
+			patch:       `{"claims":{"role":"admin"}}`,
+			status:      http.StatusConflict,
+			expected:    bob.ExtraClaims,
+		},
+		{
+			name:        "password",
+			contentType: MimeJSONPatch,
+			patch:       `[{"op":"add","path":"/password","value":"x"}]`,
+			status:      http.StatusUnprocessableEntity,
+			expected:    bob.ExtraClaims,
+		},
+		{
+			name:        "merged password",
+			contentType: MimeMergePatch,
+			patch:       `{"password":"x","claims":{"display_name":"Bobby"}}`,
+			status:      http.StatusUnprocessableEntity,
+			expected:    bob.ExtraClaims,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := testUsersAPI(t, map[string]backend.UserData{"bob": bob})
+
+			header := http.Header{"Content-Type": {tc.contentType}}
+			resp, body := adminRequest(t, server, "PATCH", "/users/bob", header, []byte(tc.patch))
+			if resp.StatusCode != tc.status {
+				t.Fatalf("expected status %d, got %d %s", tc.status, resp.StatusCode, body)
+			}
+
+			user, _, _ := client.GetUser("bob")
+			if !reflect.DeepEqual(user.ExtraClaims, tc.expected) {
+				t.Errorf("expected claims %+v, got %+v", tc.expected, user.ExtraClaims)
+			}
+
+			// the password is never changed by a patch
+			if user.PasswordHash != bob.PasswordHash || !reflect.DeepEqual(user.PasswordHistory, bob.PasswordHistory) {
+				t.Error("password changed")
+			}
+		})
+	}
+}
+
+func TestPatchUnknownUser(t *testing.T) {
+	server, _ := testUsersAPI(t, map[string]backend.UserData{})
+
+	header := http.Header{"Content-Type": {MimeMergePatch}}
+	if resp, _ := adminRequest(t, server, "PATCH", "/users/bob", header, []byte(`{}`)); resp.StatusCode != http.StatusConflict {
+		t.Error("unexpected status: ", resp.StatusCode)
+	}
+}
+
+// statusOf returns the HTTP status of a restful error.
+func statusOf(err error) int {
+	if rfErr, ok := err.(restful.ServiceError); ok {
+		return rfErr.Code
+	}
+	return 0
+}
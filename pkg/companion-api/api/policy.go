@@ -0,0 +1,86 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	restful "github.com/emicklei/go-restful"
+	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
+	passwordpolicy "github.com/mcluseau/autentigo/pkg/password-policy"
+)
+
+// PolicyError indicates a password violating the password policy.
+type PolicyError struct {
+	Violations []passwordpolicy.Violation
+}
+
+func (e PolicyError) Error() string {
+	return fmt.Sprintf("password policy violated (%d rule(s))", len(e.Violations))
+}
+
+// PolicyErrorResponse is the response to a password violating the policy
+type PolicyErrorResponse struct {
+	Message    string                     `json:"message"`
+	Violations []passwordpolicy.Violation `json:"violations"`
+}
+
+func writePolicyError(err PolicyError, response *restful.Response) {
+	response.WriteHeaderAndJson(http.StatusUnprocessableEntity, PolicyErrorResponse{
+		Message:    "The password doesn't comply with the password policy",
+		Violations: err.Violations,
+	}, restful.MIME_JSON)
+}
+
+func (cApi *CompanionAPI) passwordPolicy() *passwordpolicy.Policy {
+	if cApi.PasswordPolicy == nil {
+		return passwordpolicy.Default
+	}
+	return cApi.PasswordPolicy
+}
+
+// checkPassword returns a PolicyError if the password of the user violates the policy.
+func (cApi *CompanionAPI) checkPassword(password, id string, user *backend.UserData) error {
+	violations := cApi.passwordPolicy().Check(password, passwordpolicy.User{
+		ID:    id,
+		Email: user.ExtraClaims.Email,
+	})
+
+	if len(violations) != 0 {
+		return PolicyError{violations}
+	}
+	return nil
+}
+
+// checkHashAllowed returns a PolicyError if the policy doesn't allow clients to give password hashes.
+func (cApi *CompanionAPI) checkHashAllowed() error {
+	if cApi.passwordPolicy().AllowHashed {
+		return nil
+	}
+
+	return PolicyError{[]passwordpolicy.Violation{{
+		Rule:    passwordpolicy.RuleHashed,
+		Message: "must be given in clear text to be checked",
+	}}}
+}
+
+// setPasswordHash replaces the user's password hash, keeping the history
+// required by the policy. It returns a PolicyError if the password was used
+// recently.
+func (cApi *CompanionAPI) setPasswordHash(user *backend.UserData, hash string) error {
+	policy := cApi.passwordPolicy()
+
+	if violations := policy.CheckReuse(hash, user.PasswordHash, user.PasswordHistory); len(violations) != 0 {
+		return PolicyError{violations}
+	}
+
+	user.PasswordHistory = policy.PushHistory(user.PasswordHistory, user.PasswordHash)
+	user.PasswordHash = hash
+	return nil
+}
+
+func hashPassword(password string) string {
+	h := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(h[:])
+}
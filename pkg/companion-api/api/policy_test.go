@@ -0,0 +1,140 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
+	passwordpolicy "github.com/mcluseau/autentigo/pkg/password-policy"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := &passwordpolicy.Policy{
+		MinLength:      8,
+		MinClasses:     2,
+		History:        2,
+		ForbidUserInfo: true,
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		rules  []string
+	}{
+		{
+			name:   "create",
+			method: "POST",
+			path:   "/users",
+			body:   CreateUserReq{ID: "alice", Password: "alice"},
+			rules:  []string{passwordpolicy.RuleMinLength, passwordpolicy.RuleCharacterClasses, passwordpolicy.RuleUserInfo},
+		},
+		{
+			name:   "create with a hash",
+			method: "POST",
+			path:   "/users",
+			body:   CreateUserReq{ID: "alice", User: backend.UserData{PasswordHash: hashPassword("x")}},
+			rules:  []string{passwordpolicy.RuleHashed},
+		},
+		{
+			name:   "update with a hash",
+			method: "PUT",
+			path:   "/users/bob",
+			body:   backend.UserData{PasswordHash: hashPassword("new-password-1")},
+			rules:  []string{passwordpolicy.RuleHashed},
+		},
+		{
+			name:   "set",
+			method: "PUT",
+			path:   "/users/bob/password",
+			body:   UpdatePasswordReq{NewPassword: "short"},
+			rules:  []string{passwordpolicy.RuleMinLength, passwordpolicy.RuleCharacterClasses},
+		},
+		{
+			name:   "reuse the current password",
+			method: "PUT",
+			path:   "/users/bob/password",
+			body:   UpdatePasswordReq{NewPassword: "current-password-1"},
+			rules:  []string{passwordpolicy.RuleReuse},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bob := backend.UserData{
+				PasswordHash: hashPassword("current-password-1"),
+				ExtraClaims:  auth.ExtraClaims{Email: "bob@example.com"},
+			}
+
+			client := &memClient{users: map[string]backend.UserData{"bob": bob}}
+			server := serve(t, &CompanionAPI{Client: client, AdminToken: testAdminToken, PasswordPolicy: policy})
+
+			ba, err := json.Marshal(tc.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			header := http.Header{"Content-Type": {"application/json"}}
+			resp, body := adminRequest(t, server, tc.method, tc.path, header, ba)
+			if resp.StatusCode != http.StatusUnprocessableEntity {
+				t.Fatalf("expected status 422, got %d %s", resp.StatusCode, body)
+			}
+
+			r := PolicyErrorResponse{}
+			if err := json.Unmarshal([]byte(body), &r); err != nil {
+				t.Fatal(err)
+			}
+
+			rules := []string{}
+			for _, v := range r.Violations {
+				rules = append(rules, v.Rule)
+			}
+			if !reflect.DeepEqual(rules, tc.rules) {
+				t.Errorf("expected violations %q, got %q", tc.rules, rules)
+			}
+
+			// nothing changed
+			if _, _, err := client.GetUser("alice"); err != ErrMissingUser {
+				t.Error("user created")
+			}
+			if user, _, _ := client.GetUser("bob"); !reflect.DeepEqual(*user, bob) {
+				t.Error("user modified: ", user)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyHistory(t *testing.T) {
+	policy := &passwordpolicy.Policy{History: 2}
+
+	client := &memClient{users: map[string]backend.UserData{
+		"bob": {PasswordHash: hashPassword("p1")},
+	}}
+	server := serve(t, &CompanionAPI{Client: client, AdminToken: testAdminToken, PasswordPolicy: policy})
+
+	header := http.Header{"Content-Type": {"application/json"}}
+
+	for _, step := range []struct {
+		password string
+		status   int
+	}{
+		{"p2", http.StatusOK},
+		{"p1", http.StatusUnprocessableEntity}, // in the history
+		{"p2", http.StatusUnprocessableEntity}, // current
+		{"p3", http.StatusOK},
+		{"p1", http.StatusOK}, // out of the history
+	} {
+		ba, _ := json.Marshal(UpdatePasswordReq{NewPassword: step.password})
+
+		if resp, body := adminRequest(t, server, "PUT", "/users/bob/password", header, ba); resp.StatusCode != step.status {
+			t.Fatalf("%s: expected status %d, got %d %s", step.password, step.status, resp.StatusCode, body)
+		}
+	}
+
+	user, _, _ := client.GetUser("bob")
+	if user.PasswordHash != hashPassword("p1") || !reflect.DeepEqual(user.PasswordHistory, []string{hashPassword("p3")}) {
+		t.Errorf("unexpected password and history: %+v", user)
+	}
+}
@@ -0,0 +1,246 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/audit"
+	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
+	"github.com/mcluseau/autentigo/pkg/mail"
+	passwordpolicy "github.com/mcluseau/autentigo/pkg/password-policy"
+)
+
+const actionPasswordReset = "password-reset"
+
+// maxResetUsers is the maximum number of users sharing an email that receive a reset mail.
+const maxResetUsers = 10
+
+var (
+	// ErrNoMailer indicates mails are not configured.
+	ErrNoMailer = restful.NewError(http.StatusNotImplemented, "Mails are not configured")
+
+	errUnknownUser = errors.New("unknown user")
+	errNoEmail     = errors.New("the user has no email")
+)
+
+// MailLinkConfig configures the links sent by mail.
+type MailLinkConfig struct {
+	// URL of the page handling the link, the token being appended to it
+	// (ie: "https://example.com/reset-password?token=").
+	URL string
+	// TTL of the tokens.
+	TTL time.Duration
+}
+
+// MailData is given to the mail templates.
+type MailData struct {
+	ID      string
+	Claims  auth.ExtraClaims
+	Token   string
+	Link    string
+	Expires time.Time
+}
+
+// PasswordResetReq is a request to reset a forgotten password, given the user's id or email
+type PasswordResetReq struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+}
+
+// PasswordResetConfirmReq sets a new password with a reset token
+type PasswordResetConfirmReq struct {
+	Token       string
+	NewPassword string
+}
+
+// Register provide a restful.WebService from this API
+func (cApi *CompanionAPI) passwordResetWS() (ws *restful.WebService) {
+	ws = &restful.WebService{}
+	ws.Path("/password-reset")
+	ws.Consumes(restful.MIME_JSON)
+	ws.Produces(restful.MIME_JSON)
+	ws.Doc("Public")
+
+	ws.
+		Route(ws.POST("").
+			To(cApi.requestPasswordReset).
+			Doc("Send a password reset link to the user's email. The response is the same whether the user exists or not.").
+			Reads(PasswordResetReq{}))
+
+	ws.
+		Route(ws.POST("/confirm").
+			To(cApi.confirmPasswordReset).
+			Doc("Set a new password with the token of a reset link.").
+			Reads(PasswordResetConfirmReq{}))
+
+	return
+}
+
+func (cApi *CompanionAPI) requestPasswordReset(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	if cApi.Mailer == nil || cApi.PasswordReset.URL == "" {
+		panic(ErrNoMailer)
+	}
+
+	r := &PasswordResetReq{}
+	if err := request.ReadEntity(r); err != nil {
+		response.WriteError(http.StatusBadRequest, err)
+		return
+	}
+
+	if r.ID == "" && r.Email == "" {
+		panic(restful.NewError(http.StatusBadRequest, "No id or email given"))
+	}
+
+	event := cApi.auditEvent(request, audit.PasswordReset, r.ID, nil)
+
+	// lookup and send in the background, so the response doesn't tell if the user exists
+	go cApi.sendPasswordResets(r, event)
+
+	response.WriteHeader(http.StatusAccepted)
+}
+
+func (cApi *CompanionAPI) sendPasswordResets(r *PasswordResetReq, event audit.Event) {
+	users, err := cApi.passwordResetUsers(r)
+	if err == nil && len(users) == 0 {
+		err = errUnknownUser
+	}
+
+	if err != nil {
+		event.Success = false
+		event.Reason = err.Error()
+		if r.Email != "" {
+			event.Details = map[string]interface{}{"email": r.Email}
+		}
+		audit.Log(event)
+		return
+	}
+
+	for _, u := range users {
+		err := cApi.sendPasswordReset(u)
+		if err != nil && err != errNoEmail && err != mail.ErrRateLimited {
+			log.Print("failed to send a password reset to ", u.ID, ": ", err)
+		}
+
+		e := event
+		e.User = u.ID
+		e.Success = err == nil
+		if err != nil {
+			e.Reason = err.Error()
+		}
+		audit.Log(e)
+	}
+}
+
+// passwordResetUsers returns the users matching the request.
+func (cApi *CompanionAPI) passwordResetUsers(r *PasswordResetReq) ([]backend.User, error) {
+	if r.ID != "" {
+		user, _, err := cApi.Client.GetUser(r.ID)
+		if err == ErrMissingUser {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if r.Email != "" && !strings.EqualFold(r.Email, user.ExtraClaims.Email) {
+			return nil, nil
+		}
+
+		return []backend.User{{ID: r.ID, UserData: *user}}, nil
+	}
+
+	opts := backend.ListOptions{Email: r.Email, Limit: maxResetUsers}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	list, err := cApi.Client.ListUsers(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return list.Users, nil
+}
+
+func (cApi *CompanionAPI) sendPasswordReset(u backend.User) error {
+	if u.ExtraClaims.Email == "" {
+		return errNoEmail
+	}
+
+	expires := time.Now().Add(cApi.PasswordReset.TTL)
+
+	token, err := cApi.newActionToken(actionPasswordReset, u.ID, u.PasswordHash, expires)
+	if err != nil {
+		return err
+	}
+
+	return cApi.Mailer.Send(u.ExtraClaims.Email, actionPasswordReset, MailData{
+		ID:      u.ID,
+		Claims:  u.ExtraClaims,
+		Token:   token,
+		Link:    cApi.PasswordReset.URL + token,
+		Expires: expires,
+	})
+}
+
+func (cApi *CompanionAPI) confirmPasswordReset(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	r := &PasswordResetConfirmReq{}
+	if err := request.ReadEntity(r); err != nil {
+		response.WriteError(http.StatusBadRequest, err)
+		return
+	}
+
+	claims, err := cApi.parseActionToken(actionPasswordReset, r.Token)
+	if err != nil {
+		panic(err)
+	}
+
+	passwordHash := hashPassword(r.NewPassword)
+
+	err = cApi.Client.UpdateUser(claims.Subject, "", func(user *backend.UserData) error {
+		// the token is bound to the password it resets, so it's used once
+		if err := cApi.checkState(claims, user.PasswordHash); err != nil {
+			return err
+		}
+
+		if passwordHash == user.PasswordHash {
+			return PolicyError{[]passwordpolicy.Violation{{
+				Rule:    passwordpolicy.RuleReuse,
+				Message: "must not be the current password",
+			}}}
+		}
+
+		if err := cApi.checkPassword(r.NewPassword, claims.Subject, user); err != nil {
+			return err
+		}
+		return cApi.setPasswordHash(user, passwordHash)
+	})
+
+	if err == ErrMissingUser {
+		err = ErrInvalidToken
+	}
+
+	cApi.audit(request, audit.PasswordChanged, claims.Subject, err)
+
+	if err != nil {
+		panic(err)
+	}
+}
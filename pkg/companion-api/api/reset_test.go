@@ -0,0 +1,254 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+
+	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
+	agmail "github.com/mcluseau/autentigo/pkg/mail"
+)
+
+// memClient is an in-memory backend. Its version changes with every user.
+type memClient struct {
+	mutex   sync.Mutex
+	users   map[string]backend.UserData
+	version int
+}
+
+var _ backend.Client = &memClient{}
+
+func (c *memClient) GetUser(id string) (*backend.UserData, string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	user, ok := c.users[id]
+	if !ok {
+		return nil, "", ErrMissingUser
+	}
+	return &user, strconv.Itoa(c.version), nil
+}
+
+func (c *memClient) ListUsers(opts backend.ListOptions) (*backend.UserList, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	users := make([]backend.User, 0, len(c.users))
+	for id, user := range c.users {
+		users = append(users, backend.User{ID: id, UserData: user})
+	}
+	return backend.List(users, opts)
+}
+
+func (c *memClient) CreateUser(id string, user *backend.UserData) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.users[id]; ok {
+		return ErrUserAlreadyExist
+	}
+	c.users[id] = *user
+	c.version++
+	return nil
+}
+
+func (c *memClient) UpdateUser(id, version string, update func(user *backend.UserData) error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	user, ok := c.users[id]
+	if !ok {
+		return ErrMissingUser
+	}
+	if version != "" && version != strconv.Itoa(c.version) {
+		return ErrVersionMismatch
+	}
+	if err := update(&user); err != nil {
+		return err
+	}
+	c.users[id] = user
+	c.version++
+	return nil
+}
+
+func (c *memClient) DeleteUser(id, version string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if version != "" && version != strconv.Itoa(c.version) {
+		return ErrVersionMismatch
+	}
+	delete(c.users, id)
+	c.version++
+	return nil
+}
+
+// recordingSender records the messages instead of sending them.
+type recordingSender chan []byte
+
+func (s recordingSender) Send(from string, to []string, msg []byte) error {
+	s <- msg
+	return nil
+}
+
+var tokenRegexp = regexp.MustCompile(`token=(\S+)`)
+
+// tokenOf returns the token of the link in the mail.
+func tokenOf(t *testing.T, msg []byte) string {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(m.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match := tokenRegexp.FindSubmatch(body)
+	if match == nil {
+		t.Fatalf("no token in the mail:\n%s", body)
+	}
+	return string(match[1])
+}
+
+func testResetAPI(t *testing.T) (*httptest.Server, *memClient, recordingSender) {
+	client := &memClient{users: map[string]backend.UserData{
+		"bob": {
+			PasswordHash: hashPassword("old password"),
+			ExtraClaims:  auth.ExtraClaims{Email: "bob@example.com"},
+		},
+	}}
+
+	sender := make(recordingSender, 10)
+
+	cApi := &CompanionAPI{
+		Client: client,
+		Mailer: &agmail.Mailer{
+			Sender:    sender,
+			From:      &mail.Address{Address: "noreply@example.com"},
+			Templates: agmail.DefaultTemplates,
+		},
+		TokenKey: []byte("test key"),
+		PasswordReset: MailLinkConfig{
+			URL: "https://example.com/reset?token=",
+			TTL: time.Hour,
+		},
+	}
+
+	return serve(t, cApi), client, sender
+}
+
+func post(t *testing.T, server *httptest.Server, path string, body interface{}) (int, string) {
+	ba, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(server.URL+path, restful.MIME_JSON, bytes.NewReader(ba))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(respBody)
+}
+
+func TestPasswordResetSameResponse(t *testing.T) {
+	server, _, sender := testResetAPI(t)
+
+	code, body := post(t, server, "/password-reset", PasswordResetReq{ID: "bob"})
+	if code != http.StatusAccepted {
+		t.Fatal("unexpected status: ", code)
+	}
+
+	for _, req := range []PasswordResetReq{
+		{ID: "nobody"},
+		{Email: "nobody@example.com"},
+		{ID: "bob", Email: "other@example.com"},
+	} {
+		c, b := post(t, server, "/password-reset", req)
+		if c != code || b != body {
+			t.Errorf("%+v: expected %d %q, got %d %q", req, code, body, c, b)
+		}
+	}
+
+	select {
+	case <-sender:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail sent to bob")
+	}
+
+	select {
+	case <-sender:
+		t.Error("mail sent for an unknown user")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPasswordResetTokenUsedOnce(t *testing.T) {
+	server, client, sender := testResetAPI(t)
+
+	if code, _ := post(t, server, "/password-reset", PasswordResetReq{Email: "bob@example.com"}); code != http.StatusAccepted {
+		t.Fatal("unexpected status: ", code)
+	}
+
+	var token string
+	select {
+	case msg := <-sender:
+		token = tokenOf(t, msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail sent")
+	}
+
+	confirm := PasswordResetConfirmReq{Token: token, NewPassword: "new password"}
+
+	if code, body := post(t, server, "/password-reset/confirm", confirm); code != http.StatusOK {
+		t.Fatal("unexpected status: ", code, " ", body)
+	}
+
+	if user, _, _ := client.GetUser("bob"); user.PasswordHash != hashPassword("new password") {
+		t.Error("password not changed")
+	}
+
+	// the password changed: the token is not valid anymore
+	confirm.NewPassword = "another password"
+	if code, _ := post(t, server, "/password-reset/confirm", confirm); code != http.StatusBadRequest {
+		t.Error("token used twice, status: ", code)
+	}
+
+	if user, _, _ := client.GetUser("bob"); user.PasswordHash != hashPassword("new password") {
+		t.Error("password changed by the second use of the token")
+	}
+}
+
+func TestPasswordResetTamperedToken(t *testing.T) {
+	server, _, _ := testResetAPI(t)
+	cApi := &CompanionAPI{TokenKey: []byte("other key")}
+
+	token, err := cApi.newActionToken(actionPasswordReset, "bob", hashPassword("old password"), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	confirm := PasswordResetConfirmReq{Token: token, NewPassword: "new password"}
+	if code, _ := post(t, server, "/password-reset/confirm", confirm); code != http.StatusBadRequest {
+		t.Error("token of another key accepted, status: ", code)
+	}
+}
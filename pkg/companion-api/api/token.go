@@ -0,0 +1,77 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	restful "github.com/emicklei/go-restful"
+)
+
+// ErrInvalidToken indicates an invalid, expired or already used token.
+var ErrInvalidToken = restful.NewError(http.StatusBadRequest, "Invalid or expired token")
+
+// actionClaims are the claims of a token allowing an action (the audience) on
+// a user (the subject).
+type actionClaims struct {
+	jwt.StandardClaims
+
+	// Fingerprint (HMAC) of the user's state the token is issued for, so the
+	// token can be used only once.
+	Fingerprint string `json:"fp"`
+}
+
+// newActionToken returns a token allowing the action on the user, valid until
+// it expires and while the user's state is unchanged.
+func (cApi *CompanionAPI) newActionToken(action, id, state string, expires time.Time) (string, error) {
+	now := time.Now()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, actionClaims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  action,
+			Subject:   id,
+			ExpiresAt: expires.Unix(),
+			IssuedAt:  now.Unix(),
+		},
+		Fingerprint: cApi.fingerprint(action, state),
+	})
+
+	return token.SignedString(cApi.TokenKey)
+}
+
+// parseActionToken returns the claims of a valid token for the action.
+func (cApi *CompanionAPI) parseActionToken(action, tokenString string) (*actionClaims, error) {
+	claims := &actionClaims{}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, ErrInvalidToken
+		}
+		return cApi.TokenKey, nil
+	})
+
+	if err != nil || !token.Valid || !claims.VerifyAudience(action, true) || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// checkState returns ErrInvalidToken if the user's state changed since the token was issued.
+func (cApi *CompanionAPI) checkState(c *actionClaims, state string) error {
+	if !hmac.Equal([]byte(c.Fingerprint), []byte(cApi.fingerprint(c.Audience, state))) {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// fingerprint of the state for the action. It's keyed as the state may be
+// secret (ie: a password hash) while the token is only signed.
+func (cApi *CompanionAPI) fingerprint(action, state string) string {
+	mac := hmac.New(sha256.New, cApi.TokenKey)
+	mac.Write([]byte(action + "\x00" + state))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
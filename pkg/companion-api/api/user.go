@@ -1,10 +1,12 @@
 package api
 
 import (
-	"errors"
 	"net/http"
+	"strconv"
 
 	restful "github.com/emicklei/go-restful"
+	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/audit"
 	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
 )
 
@@ -12,45 +14,91 @@ import (
 type CreateUserReq struct {
 	ID   string           `json:"id"`
 	User backend.UserData `json:"user"`
+	// Password in clear text, checked against the password policy (instead of user.password).
+	Password string `json:"password"`
+}
+
+// UserInfo is a user as returned by the API, without its password hash
+type UserInfo struct {
+	ID          string           `json:"id"`
+	ExtraClaims auth.ExtraClaims `json:"claims"`
+}
+
+// UserListResponse is a page of users
+type UserListResponse struct {
+	Users []UserInfo `json:"users"`
+	// Continue is the token to get the next page, if any.
+	Continue string `json:"continue,omitempty"`
 }
 
 // Register provide a restful.WebService from this API
 func (cApi *CompanionAPI) usersWS() (ws *restful.WebService) {
 	ws = &restful.WebService{}
+	ws.Path("/users")
 	ws.Filter(requireRole(cApi.AdminToken, "admin"))
 	ws.Doc("Requires the admin role")
 
 	ws.
-		Route(ws.POST("/users").
+		Route(ws.GET("").
+			To(cApi.listUsers).
+			Doc("List users.").
+			Produces("application/json").
+			Param(ws.QueryParameter("prefix", "only users with an id starting with this prefix")).
+			Param(ws.QueryParameter("group", "only members of this group")).
+			Param(ws.QueryParameter("email", "only users with this email")).
+			Param(ws.QueryParameter("sort", "sort field (id, display_name or email), prefixed with - for a descending sort")).
+			Param(ws.QueryParameter("limit", "maximum number of users to return").DataType("integer")).
+			Param(ws.QueryParameter("continue", "continue token of the previous page")).
+			Writes(UserListResponse{}))
+
+	ws.
+		Route(ws.GET("/{user-id}").
+			To(cApi.getUser).
+			Doc("Get a user.").
+			Produces("application/json").
+			Param(ws.PathParameter("user-id", "identifier of the user").DataType("string")).
+			Writes(UserInfo{}))
+
+	ws.
+		Route(ws.POST("").
 			To(cApi.createUser).
 			Doc("Create a new user.").
 			Consumes("application/json").
 			Reads(CreateUserReq{}))
 
 	ws.
-		Route(ws.PUT("/users/{user-id}").
+		Route(ws.PUT("/{user-id}").
 			To(cApi.updateUser).
 			Doc("Update an existing user.").
 			Consumes("application/json").
 			Param(ws.PathParameter("user-id", "identifier of the user").DataType("string")).
+			Param(ws.HeaderParameter("If-Match", "ETag of the user's version to modify")).
 			Reads(backend.UserData{}))
 
 	ws.
-		Route(ws.PATCH("/users/{user-id}").
+		Route(ws.PATCH("/{user-id}").
 			To(cApi.patchUser).
-			Doc("Patch an existing user (json-patch format).").
-			Consumes("application/json").
-			Param(ws.PathParameter("user-id", "identifier of the user").DataType("string")))
+			Doc("Patch an existing user (JSON patch or JSON merge patch, the password can't be patched).").
+			Consumes(MimeJSONPatch, MimeMergePatch).
+			Param(ws.PathParameter("user-id", "identifier of the user").DataType("string")).
+			Param(ws.HeaderParameter("If-Match", "ETag of the user's version to modify")))
 
 	ws.
-		Route(ws.DELETE("/users/{user-id}").
+		Route(ws.DELETE("/{user-id}").
 			To(cApi.deleteUser).
 			Doc("Delete an existing user.").
 			Consumes("application/json").
+			Param(ws.PathParameter("user-id", "identifier of the user").DataType("string")).
+			Param(ws.HeaderParameter("If-Match", "ETag of the user's version to modify")))
+
+	ws.
+		Route(ws.POST("/{user-id}/email-verification").
+			To(cApi.resendUserEmailVerification).
+			Doc("Send again the verification link of a user's email.").
 			Param(ws.PathParameter("user-id", "identifier of the user").DataType("string")))
 
 	ws.
-		Route(ws.PUT("/users/{user-id}/password").
+		Route(ws.PUT("/{user-id}/password").
 			To(cApi.updateUserPassword).
 			Doc("Update an existing user's password.").
 			Consumes("application/json").
@@ -60,6 +108,71 @@ func (cApi *CompanionAPI) usersWS() (ws *restful.WebService) {
 	return
 }
 
+func (cApi *CompanionAPI) listUsers(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	opts := backend.ListOptions{
+		Prefix:   request.QueryParameter("prefix"),
+		Group:    request.QueryParameter("group"),
+		Email:    request.QueryParameter("email"),
+		Sort:     request.QueryParameter("sort"),
+		Continue: request.QueryParameter("continue"),
+	}
+
+	if limit := request.QueryParameter("limit"); limit != "" {
+		var err error
+		if opts.Limit, err = strconv.Atoi(limit); err != nil {
+			panic(restful.NewError(http.StatusBadRequest, "Invalid limit"))
+		}
+	}
+
+	if err := opts.Validate(); err != nil {
+		panic(restful.NewError(http.StatusBadRequest, err.Error()))
+	}
+
+	list, err := cApi.Client.ListUsers(opts)
+	if err != nil {
+		panic(err)
+	}
+
+	result := UserListResponse{
+		Users:    make([]UserInfo, 0, len(list.Users)),
+		Continue: list.Continue,
+	}
+
+	for _, u := range list.Users {
+		result.Users = append(result.Users, UserInfo{ID: u.ID, ExtraClaims: u.ExtraClaims})
+	}
+
+	response.WriteEntity(result)
+}
+
+func (cApi *CompanionAPI) getUser(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	id := request.PathParameter("user-id")
+
+	user, version, err := cApi.Client.GetUser(id)
+	if err == ErrMissingUser {
+		panic(ErrUnknownUser)
+	} else if err != nil {
+		panic(err)
+	}
+
+	setETag(response, version)
+	response.WriteEntity(UserInfo{ID: id, ExtraClaims: user.ExtraClaims})
+}
+
 func (cApi *CompanionAPI) createUser(request *restful.Request, response *restful.Response) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -77,14 +190,33 @@ func (cApi *CompanionAPI) createUser(request *restful.Request, response *restful
 		panic(ErrMissingUserId)
 	}
 
-	if len(userReq.User.PasswordHash) == 0 {
+	switch {
+	case len(userReq.Password) != 0:
+		if err := cApi.checkPassword(userReq.Password, userReq.ID, &userReq.User); err != nil {
+			panic(err)
+		}
+		userReq.User.PasswordHash = hashPassword(userReq.Password)
+
+	case len(userReq.User.PasswordHash) != 0:
+		if err := cApi.checkHashAllowed(); err != nil {
+			panic(err)
+		}
+
+	default:
 		panic(ErrMissingUserPassword)
 	}
 
-	if err := cApi.Client.CreateUser(userReq.ID, &userReq.User); err != nil {
+	err := cApi.Client.CreateUser(userReq.ID, &userReq.User)
+	cApi.audit(request, audit.UserCreated, userReq.ID, err)
+
+	if err != nil {
 		panic(err)
 	}
 
+	if emailToVerify(auth.ExtraClaims{}, &userReq.User) {
+		cApi.sendEmailVerification(request, userReq.ID, userReq.User)
+	}
+
 	response.WriteHeader(http.StatusCreated)
 }
 
@@ -103,21 +235,38 @@ func (cApi *CompanionAPI) updateUser(request *restful.Request, response *restful
 		panic(err)
 	}
 
-	err := cApi.Client.UpdateUser(id, func(user *backend.UserData) error {
+	var verify bool
+
+	err := cApi.Client.UpdateUser(id, cApi.ifMatch(request, id), func(user *backend.UserData) error {
+		verify = emailToVerify(user.ExtraClaims, userData)
+
+		hash := userData.PasswordHash
+		userData.PasswordHash = user.PasswordHash
+		userData.PasswordHistory = user.PasswordHistory
+
+		if hash != "" && hash != user.PasswordHash {
+			if err := cApi.checkHashAllowed(); err != nil {
+				return err
+			}
+			if err := cApi.setPasswordHash(userData, hash); err != nil {
+				return err
+			}
+		}
+
 		*user = *userData
 		return nil
 	})
+	cApi.audit(request, audit.UserUpdated, id, err)
 
 	if err != nil {
 		panic(err)
 	}
 
-	response.WriteHeader(http.StatusOK)
-}
+	if verify {
+		cApi.sendEmailVerification(request, id, *userData)
+	}
 
-func (cApi *CompanionAPI) patchUser(request *restful.Request, response *restful.Response) {
-	// TODO
-	response.WriteError(http.StatusNotImplemented, errors.New("not implemented"))
+	response.WriteHeader(http.StatusOK)
 }
 
 func (cApi *CompanionAPI) deleteUser(request *restful.Request, response *restful.Response) {
@@ -130,7 +279,10 @@ func (cApi *CompanionAPI) deleteUser(request *restful.Request, response *restful
 
 	id := request.PathParameter("user-id")
 
-	if err := cApi.Client.DeleteUser(id); err != nil {
+	err := cApi.Client.DeleteUser(id, cApi.ifMatch(request, id))
+	cApi.audit(request, audit.UserDeleted, id, err)
+
+	if err != nil {
 		panic(err)
 	}
 
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	restful "github.com/emicklei/go-restful"
+
+	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
+)
+
+const testAdminToken = "admin token"
+
+// serve serves the API and returns its server.
+func serve(t *testing.T, cApi *CompanionAPI) *httptest.Server {
+	container := restful.NewContainer()
+	for _, ws := range cApi.WebServices() {
+		container.Add(ws)
+	}
+
+	server := httptest.NewServer(container)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func testUsersAPI(t *testing.T, users map[string]backend.UserData) (*httptest.Server, *memClient) {
+	client := &memClient{users: users}
+	return serve(t, &CompanionAPI{Client: client, AdminToken: testAdminToken}), client
+}
+
+// adminRequest sends a request with the admin token, and returns the
+// response with its body.
+func adminRequest(t *testing.T, server *httptest.Server, method, path string, header http.Header, body []byte) (*http.Response, string) {
+	req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(respBody)
+}
+
+func TestListUsers(t *testing.T) {
+	users := map[string]backend.UserData{}
+	for _, id := range []string{"e", "d", "c", "b", "a"} {
+		users[id] = backend.UserData{
+			PasswordHash: hashPassword(id),
+			ExtraClaims:  auth.ExtraClaims{DisplayName: "User " + id, Email: id + "@example.com"},
+		}
+	}
+
+	server, _ := testUsersAPI(t, users)
+
+	for _, tc := range []struct {
+		name  string
+		query url.Values
+		pages [][]string
+	}{
+		{"all", url.Values{}, [][]string{{"a", "b", "c", "d", "e"}}},
+		{"pages", url.Values{"limit": {"2"}}, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		{"descending", url.Values{"limit": {"3"}, "sort": {"-email"}}, [][]string{{"e", "d", "c"}, {"b", "a"}}},
+		{"filtered", url.Values{"limit": {"1"}, "email": {"B@Example.com"}}, [][]string{{"b"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pages := [][]string{}
+			query := tc.query
+
+			for len(pages) <= len(users) {
+				resp, body := adminRequest(t, server, "GET", "/users?"+query.Encode(), nil, nil)
+				if resp.StatusCode != http.StatusOK {
+					t.Fatal("unexpected status: ", resp.StatusCode, " ", body)
+				}
+
+				list := UserListResponse{}
+				if err := json.Unmarshal([]byte(body), &list); err != nil {
+					t.Fatal(err)
+				}
+
+				page := []string{}
+				for _, u := range list.Users {
+					page = append(page, u.ID)
+				}
+				pages = append(pages, page)
+
+				if list.Continue == "" {
+					break
+				}
+				query.Set("continue", list.Continue)
+			}
+
+			if !reflect.DeepEqual(pages, tc.pages) {
+				t.Errorf("expected pages %q, got %q", tc.pages, pages)
+			}
+		})
+	}
+
+	// the password hashes are not listed
+	if _, body := adminRequest(t, server, "GET", "/users", nil, nil); bytes.Contains([]byte(body), []byte(hashPassword("a"))) {
+		t.Error("password hash listed: ", body)
+	}
+}
+
+func TestListUsersInvalidOptions(t *testing.T) {
+	server, _ := testUsersAPI(t, map[string]backend.UserData{})
+
+	for _, query := range []string{
+		"limit=x",
+		"limit=-1",
+		"sort=password",
+		"continue=!",
+	} {
+		if resp, _ := adminRequest(t, server, "GET", "/users?"+query, nil, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, resp.StatusCode)
+		}
+	}
+}
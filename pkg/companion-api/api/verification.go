@@ -0,0 +1,182 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/audit"
+	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
+	"github.com/mcluseau/autentigo/pkg/mail"
+	"github.com/mcluseau/autentigo/pkg/rbac"
+)
+
+const actionEmailVerification = "email-verification"
+
+var (
+	// ErrNoEmail indicates a user without an email to verify.
+	ErrNoEmail = restful.NewError(http.StatusUnprocessableEntity, "The user has no email")
+	// ErrEmailAlreadyVerified indicates a verification of an already verified email.
+	ErrEmailAlreadyVerified = restful.NewError(http.StatusConflict, "The email is already verified")
+	// ErrTooManyMails indicates a mail refused by the rate limit of its address.
+	ErrTooManyMails = restful.NewError(http.StatusTooManyRequests, "Too many mails to this address, retry later")
+)
+
+// EmailVerificationConfirmReq verifies an email with the token of a verification link
+type EmailVerificationConfirmReq struct {
+	Token string
+}
+
+// Register provide a restful.WebService from this API
+func (cApi *CompanionAPI) emailVerificationWS() (ws *restful.WebService) {
+	ws = &restful.WebService{}
+	ws.Path("/email-verification")
+	ws.Consumes(restful.MIME_JSON)
+	ws.Produces(restful.MIME_JSON)
+	ws.Doc("Public")
+
+	ws.
+		Route(ws.POST("/confirm").
+			To(cApi.confirmEmailVerification).
+			Doc("Verify an email with the token of a verification link.").
+			Reads(EmailVerificationConfirmReq{}))
+
+	return
+}
+
+// emailToVerify returns true if the update sets an email that is not verified.
+func emailToVerify(previous auth.ExtraClaims, user *backend.UserData) bool {
+	c := user.ExtraClaims
+	return c.Email != "" && !c.EmailVerified && c.Email != previous.Email
+}
+
+// sendEmailVerification sends a verification link to the user's email in the
+// background, if mails are configured.
+func (cApi *CompanionAPI) sendEmailVerification(request *restful.Request, id string, user backend.UserData) {
+	if cApi.Mailer == nil || cApi.EmailVerification.URL == "" {
+		return
+	}
+
+	event := cApi.auditEvent(request, audit.EmailVerification, id, nil)
+
+	go func() {
+		err := cApi.mailEmailVerification(id, user)
+		if err != nil && err != mail.ErrRateLimited {
+			log.Print("failed to send an email verification to ", id, ": ", err)
+		}
+
+		event.Success = err == nil
+		if err != nil {
+			event.Reason = err.Error()
+		}
+		audit.Log(event)
+	}()
+}
+
+func (cApi *CompanionAPI) mailEmailVerification(id string, user backend.UserData) error {
+	email := user.ExtraClaims.Email
+	expires := time.Now().Add(cApi.EmailVerification.TTL)
+
+	// the token is bound to the email it verifies
+	token, err := cApi.newActionToken(actionEmailVerification, id, email, expires)
+	if err != nil {
+		return err
+	}
+
+	return cApi.Mailer.Send(email, actionEmailVerification, MailData{
+		ID:      id,
+		Claims:  user.ExtraClaims,
+		Token:   token,
+		Link:    cApi.EmailVerification.URL + token,
+		Expires: expires,
+	})
+}
+
+func (cApi *CompanionAPI) resendMyEmailVerification(request *restful.Request, response *restful.Response) {
+	u := request.Attribute("user").(*rbac.User)
+	cApi.resendEmailVerification(u.Name, request, response)
+}
+
+func (cApi *CompanionAPI) resendUserEmailVerification(request *restful.Request, response *restful.Response) {
+	id := request.PathParameter("user-id")
+	cApi.resendEmailVerification(id, request, response)
+}
+
+func (cApi *CompanionAPI) resendEmailVerification(id string, request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	if cApi.Mailer == nil || cApi.EmailVerification.URL == "" {
+		panic(ErrNoMailer)
+	}
+
+	user, _, err := cApi.Client.GetUser(id)
+	if err == ErrMissingUser {
+		panic(ErrUnknownUser)
+	} else if err != nil {
+		panic(err)
+	}
+
+	switch {
+	case user.ExtraClaims.Email == "":
+		panic(ErrNoEmail)
+	case user.ExtraClaims.EmailVerified:
+		panic(ErrEmailAlreadyVerified)
+	}
+
+	err = cApi.mailEmailVerification(id, *user)
+	cApi.audit(request, audit.EmailVerification, id, err)
+
+	if err == mail.ErrRateLimited {
+		panic(ErrTooManyMails)
+	} else if err != nil {
+		panic(err)
+	}
+
+	response.WriteHeader(http.StatusAccepted)
+}
+
+func (cApi *CompanionAPI) confirmEmailVerification(request *restful.Request, response *restful.Response) {
+	defer func() {
+		if err := recover(); err != nil {
+			// unhandled error
+			writeError(err.(error), response)
+		}
+	}()
+
+	r := &EmailVerificationConfirmReq{}
+	if err := request.ReadEntity(r); err != nil {
+		response.WriteError(http.StatusBadRequest, err)
+		return
+	}
+
+	claims, err := cApi.parseActionToken(actionEmailVerification, r.Token)
+	if err != nil {
+		panic(err)
+	}
+
+	err = cApi.Client.UpdateUser(claims.Subject, "", func(user *backend.UserData) error {
+		if err := cApi.checkState(claims, user.ExtraClaims.Email); err != nil {
+			return err
+		}
+
+		user.ExtraClaims.EmailVerified = true
+		return nil
+	})
+
+	if err == ErrMissingUser {
+		err = ErrInvalidToken
+	}
+
+	cApi.audit(request, audit.EmailVerified, claims.Subject, err)
+
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"strings"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+// setETag sets the ETag of the response to the user's version.
+func setETag(response *restful.Response, version string) {
+	response.AddHeader("ETag", `"`+version+`"`)
+}
+
+// ifMatch returns the user's version required by the If-Match header of the
+// request, or "" if any version matches.
+func (cApi *CompanionAPI) ifMatch(request *restful.Request, id string) string {
+	header := strings.TrimSpace(request.HeaderParameter("If-Match"))
+	if header == "" || header == "*" {
+		return ""
+	}
+
+	versions := make([]string, 0, 1)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+
+		// weak tags never match (If-Match uses the strong comparison)
+		if len(tag) >= 2 && tag[0] == '"' && tag[len(tag)-1] == '"' {
+			versions = append(versions, tag[1:len(tag)-1])
+		}
+	}
+
+	switch len(versions) {
+	case 0:
+		panic(ErrVersionMismatch)
+	case 1:
+		return versions[0]
+	}
+
+	// many versions: require the current one if it's given
+	_, current, err := cApi.Client.GetUser(id)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, version := range versions {
+		if version == current {
+			return current
+		}
+	}
+
+	panic(ErrVersionMismatch)
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
+)
+
+func TestIfMatch(t *testing.T) {
+	bob := backend.UserData{
+		PasswordHash: hashPassword("secret"),
+		ExtraClaims:  auth.ExtraClaims{DisplayName: "Bob"},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		ifMatch string
+		status  int
+	}{
+		{"no header", "", http.StatusOK},
+		{"any version", "*", http.StatusOK},
+		{"current version", `"1"`, http.StatusOK},
+		{"stale version", `"0"`, http.StatusPreconditionFailed},
+		{"unquoted version", `1`, http.StatusPreconditionFailed},
+		{"weak tag", `W/"1"`, http.StatusPreconditionFailed},
+		{"current in a list", `"0", "1"`, http.StatusOK},
+		{"weak tag in a list", `W/"1", "0"`, http.StatusPreconditionFailed},
+		{"stale list", `"0", "2"`, http.StatusPreconditionFailed},
+	} {
+		for _, req := range []struct {
+			method      string
+			contentType string
+			body        string
+		}{
+			{"PUT", "application/json", `{"claims":{"display_name":"Bobby"}}`},
+			{"PATCH", MimeMergePatch, `{"claims":{"display_name":"Bobby"}}`},
+			{"DELETE", "application/json", ``},
+		} {
+			t.Run(tc.name+"/"+req.method, func(t *testing.T) {
+				server, client := testUsersAPI(t, map[string]backend.UserData{"bob": bob})
+				client.version = 1
+
+				resp, _ := adminRequest(t, server, "GET", "/users/bob", nil, nil)
+				if etag := resp.Header.Get("ETag"); etag != `"1"` {
+					t.Fatal("unexpected ETag: ", etag)
+				}
+
+				header := http.Header{"Content-Type": {req.contentType}}
+				if tc.ifMatch != "" {
+					header.Set("If-Match", tc.ifMatch)
+				}
+
+				resp, body := adminRequest(t, server, req.method, "/users/bob", header, []byte(req.body))
+				if resp.StatusCode != tc.status {
+					t.Fatalf("expected status %d, got %d %s", tc.status, resp.StatusCode, body)
+				}
+
+				_, version, err := client.GetUser("bob")
+				if modified := err != nil || version != "1"; modified != (tc.status == http.StatusOK) {
+					t.Errorf("user modified: %v (version %q, error %v)", modified, version, err)
+				}
+			})
+		}
+	}
+}
+
+func TestIfMatchConcurrentUpdate(t *testing.T) {
+	server, _ := testUsersAPI(t, map[string]backend.UserData{
+		"bob": {PasswordHash: hashPassword("secret")},
+	})
+
+	resp, _ := adminRequest(t, server, "GET", "/users/bob", nil, nil)
+	header := http.Header{
+		"Content-Type": {MimeMergePatch},
+		"If-Match":     {resp.Header.Get("ETag")},
+	}
+
+	patch := []byte(`{"claims":{"display_name":"Bob"}}`)
+
+	if resp, _ := adminRequest(t, server, "PATCH", "/users/bob", header, patch); resp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status: ", resp.StatusCode)
+	}
+
+	// the first update changed the version
+	if resp, _ := adminRequest(t, server, "PATCH", "/users/bob", header, patch); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Error("expected status 412, got ", resp.StatusCode)
+	}
+}
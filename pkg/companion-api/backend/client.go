@@ -2,17 +2,33 @@ package backend
 
 import (
 	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/health"
 )
 
 // UserData is a simple user struct with paswordhash and claims
 type UserData struct {
 	PasswordHash string           `json:"password"`
 	ExtraClaims  auth.ExtraClaims `json:"claims"`
+
+	// PasswordHistory are the previous password hashes, most recent first.
+	PasswordHistory []string `json:"password_history,omitempty"`
 }
 
-// Client is the interface for all backends clients
+// Client is the interface for all backends clients.
+//
+// Users have a version, changing each time they're modified. Updates and
+// deletes given a version fail with api.ErrVersionMismatch if it isn't the
+// user's current version; an empty version matches any version.
 type Client interface {
+	// GetUser returns the user with the given id, and its version.
+	GetUser(id string) (user *UserData, version string, err error)
+	// ListUsers returns the users matching the options, which must be validated.
+	ListUsers(opts ListOptions) (*UserList, error)
+
 	CreateUser(id string, user *UserData) error
-	UpdateUser(id string, update func(user *UserData) error) error
-	DeleteUser(id string) error
+	UpdateUser(id, version string, update func(user *UserData) error) error
+	DeleteUser(id, version string) error
 }
+
+// HealthChecker is implemented by clients able to check their backend is reachable.
+type HealthChecker = health.Checker
@@ -3,24 +3,67 @@ package etcd
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
-	"os"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/mcluseau/autentigo/pkg/companion-api/api"
 	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
+	"github.com/mcluseau/autentigo/pkg/settings"
 )
 
 type etcdClient struct {
-	prefix  string
-	client  *clientv3.Client
-	timeout time.Duration
+	prefix       string
+	groupsPrefix string
+	client       *clientv3.Client
+	timeout      time.Duration
+}
+
+// Config of the etcd backend
+type Config struct {
+	Prefix    string            `json:"prefix" env:"ETCD_PREFIX" required:"true" desc:"etcd prefix"`
+	Endpoints []string          `json:"endpoints" env:"ETCD_ENDPOINTS" required:"true" desc:"etcd endpoints"`
+	Timeout   settings.Duration `json:"timeout" env:"ETCD_TIMEOUT" desc:"etcd requests timeout"`
+
+	GroupsPrefix string `json:"groups_prefix" env:"ETCD_GROUPS_PREFIX" desc:"etcd prefix of groups metadata (not stored if empty)"`
+}
+
+func init() {
+	backend.Register("etcd", backend.Factory{
+		Description: "Manages users in etcd, with keys like prefix/user-name",
+		NewConfig: func() interface{} {
+			return &Config{Timeout: settings.Duration{Duration: 5 * time.Second}}
+		},
+		New: func(config interface{}) (backend.Client, error) {
+			c := config.(*Config)
+			if c.GroupsPrefix != "" && overlaps(c.Prefix, c.GroupsPrefix) {
+				// groups metadata would be read as users, and users as groups
+				return nil, fmt.Errorf("the groups prefix %q overlaps the users prefix %q", c.GroupsPrefix, c.Prefix)
+			}
+
+			client := New(c.Prefix, c.Endpoints, c.Timeout.Duration).(*etcdClient)
+			client.groupsPrefix = c.GroupsPrefix
+			return client, nil
+		},
+	})
+}
+
+// overlaps returns true if one of the key prefixes contains the other.
+func overlaps(prefix1, prefix2 string) bool {
+	prefix1 = strings.TrimSuffix(prefix1, "/") + "/"
+	prefix2 = strings.TrimSuffix(prefix2, "/") + "/"
+	return strings.HasPrefix(prefix1, prefix2) || strings.HasPrefix(prefix2, prefix1)
 }
 
 // New Client to manage users with an etcd backend
-func New(prefix string, endpoints []string) backend.Client {
+func New(prefix string, endpoints []string, timeout time.Duration) backend.Client {
 	client, err := clientv3.New(clientv3.Config{
 		Endpoints: endpoints,
 	})
@@ -29,14 +72,6 @@ func New(prefix string, endpoints []string) backend.Client {
 		log.Fatal("failed to connect to etcd: ", err)
 	}
 
-	timeout := 5 * time.Second
-	if timeoutEnv := os.Getenv("ETCD_TIMEOUT"); timeoutEnv != "" {
-		timeout, err = time.ParseDuration(timeoutEnv)
-		if err != nil {
-			log.Fatalf("invalid ETCD_TIMEOUT %q: %v", timeoutEnv, timeout)
-		}
-	}
-
 	return &etcdClient{
 		prefix:  prefix,
 		client:  client,
@@ -45,52 +80,314 @@ func New(prefix string, endpoints []string) backend.Client {
 }
 
 var _ backend.Client = &etcdClient{}
+var _ io.Closer = &etcdClient{}
+var _ backend.HealthChecker = &etcdClient{}
+var _ backend.UsersUpdater = &etcdClient{}
+var _ backend.GroupStore = &etcdClient{}
 
-func (e *etcdClient) CreateUser(id string, user *backend.UserData) (err error) {
-	oldUser := &backend.UserData{}
-	oldUser, err = e.getUser(id)
+func (e *etcdClient) GetUser(id string) (*backend.UserData, string, error) {
+	user, rev, err := e.getUser(id)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, versionOf(rev), nil
+}
+
+func (e *etcdClient) ListUsers(opts backend.ListOptions) (list *backend.UserList, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	prefix := strings.TrimSuffix(e.prefix, "/") + "/"
+
+	if field, desc := opts.SortField(); field != "id" || desc {
+		// not the keys order, so sort all the users
+		resp, err := e.client.Get(ctx, prefix+opts.Prefix, clientv3.WithPrefix())
+		if err != nil {
+			return nil, err
+		}
+
+		users := make([]backend.User, 0, len(resp.Kvs))
+		for _, kv := range resp.Kvs {
+			u, err := userOf(prefix, kv)
+			if err != nil {
+				return nil, err
+			}
+			users = append(users, u)
+		}
+
+		return backend.List(users, opts)
+	}
+
+	// keys order: read the range after the last listed user, by batches
+	key := prefix + opts.Prefix
+	end := clientv3.GetPrefixRangeEnd(key)
+
+	if opts.Continue != "" {
+		_, id, err := backend.DecodeContinue(opts.Continue)
+		if err != nil {
+			return nil, err
+		}
+		if next := prefix + id + "\x00"; next > key {
+			key = next
+		}
+	}
+
+	list = &backend.UserList{Users: []backend.User{}}
+
+	for {
+		resp, err := e.client.Get(ctx, key, clientv3.WithRange(end), clientv3.WithLimit(int64(opts.Limit)))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, kv := range resp.Kvs {
+			u, err := userOf(prefix, kv)
+			if err != nil {
+				return nil, err
+			}
 
-	if oldUser != nil {
+			if !opts.Match(u.ID, &u.UserData) {
+				continue
+			}
+
+			if len(list.Users) == opts.Limit {
+				list.Continue = opts.EncodeContinue(list.Users[opts.Limit-1])
+				return list, nil
+			}
+
+			list.Users = append(list.Users, u)
+		}
+
+		if !resp.More || len(resp.Kvs) == 0 {
+			return list, nil
+		}
+
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+func userOf(prefix string, kv *mvccpb.KeyValue) (u backend.User, err error) {
+	u.ID = string(kv.Key[len(prefix):])
+	err = json.Unmarshal(kv.Value, &u.UserData)
+	return
+}
+
+func (e *etcdClient) CreateUser(id string, user *backend.UserData) (err error) {
+	// revision 0 means the key doesn't exist
+	ok, err := e.putUser(id, user, 0)
+	if err == nil && !ok {
 		err = api.ErrUserAlreadyExist
-	} else if err == api.ErrMissingUser {
-		err = e.putUser(id, user)
 	}
 
 	return
 }
 
-func (e *etcdClient) UpdateUser(id string, update func(user *backend.UserData) error) (err error) {
-	user := &backend.UserData{}
-	user, err = e.getUser(id)
+func (e *etcdClient) UpdateUser(id, version string, update func(user *backend.UserData) error) (err error) {
+	for {
+		user, rev, err := e.getUser(id)
+		if err != nil {
+			return err
+		}
+
+		if version != "" && version != versionOf(rev) {
+			return api.ErrVersionMismatch
+		}
 
-	if err == nil && user != nil {
-		err = update(user)
-		if err == nil {
-			err = e.putUser(id, user)
+		if err = update(user); err != nil {
+			return err
 		}
+
+		ok, err := e.putUser(id, user, rev)
+		if err != nil || ok {
+			return err
+		}
+
+		if version != "" {
+			return api.ErrVersionMismatch
+		}
+
+		// modified since we read it, try again
+	}
+}
+
+func (e *etcdClient) DeleteUser(id, version string) (err error) {
+	_, rev, err := e.getUser(id)
+	if err != nil {
+		return
 	}
 
+	if version != "" && version != versionOf(rev) {
+		return api.ErrVersionMismatch
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	key := path.Join(e.prefix, id)
+
+	txn := e.client.Txn(ctx)
+	if version != "" {
+		txn = txn.If(clientv3.Compare(clientv3.ModRevision(key), "=", rev))
+	}
+
+	resp, err := txn.Then(clientv3.OpDelete(key)).Commit()
+	if err == nil && !resp.Succeeded {
+		err = api.ErrVersionMismatch
+	}
 	return
 }
 
-func (e *etcdClient) DeleteUser(id string) (err error) {
-	user := &backend.UserData{}
-	user, err = e.getUser(id)
+// maxTxnOps is the default maximum number of operations in an etcd transaction
+const maxTxnOps = 128
+
+// UpdateUsers is atomic for up to maxTxnOps modified users. Above, users are
+// saved by batches of maxTxnOps.
+func (e *etcdClient) UpdateUsers(update func(id string, user *backend.UserData) (bool, error)) error {
+	prefix := strings.TrimSuffix(e.prefix, "/") + "/"
 
-	if err == nil && user != nil {
+retry:
+	for {
 		ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
-		defer cancel()
+		resp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix())
+		cancel()
 
-		_, err = e.client.Delete(ctx, path.Join(e.prefix, id))
+		if err != nil {
+			return err
+		}
+
+		cmps := make([]clientv3.Cmp, 0)
+		ops := make([]clientv3.Op, 0)
+
+		for _, kv := range resp.Kvs {
+			u, err := userOf(prefix, kv)
+			if err != nil {
+				return err
+			}
+
+			modified, err := update(u.ID, &u.UserData)
+			if err != nil {
+				return err
+			} else if !modified {
+				continue
+			}
+
+			ba, err := json.Marshal(u.UserData)
+			if err != nil {
+				return err
+			}
+
+			key := string(kv.Key)
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision))
+			ops = append(ops, clientv3.OpPut(key, string(ba)))
+		}
+
+		for len(ops) != 0 {
+			n := len(ops)
+			if n > maxTxnOps {
+				n = maxTxnOps
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+			resp, err := e.client.Txn(ctx).If(cmps[:n]...).Then(ops[:n]...).Commit()
+			cancel()
+
+			if err != nil {
+				return err
+			}
+
+			if !resp.Succeeded {
+				// modified since we read them, try again
+				continue retry
+			}
+
+			cmps, ops = cmps[n:], ops[n:]
+		}
+
+		return nil
+	}
+}
+
+func (e *etcdClient) ListGroups() (groups map[string]backend.GroupMeta, err error) {
+	if e.groupsPrefix == "" {
+		return nil, api.ErrNoGroupStore
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	prefix := strings.TrimSuffix(e.groupsPrefix, "/") + "/"
+
+	resp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+
+	groups = make(map[string]backend.GroupMeta, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		meta := backend.GroupMeta{}
+		if err = json.Unmarshal(kv.Value, &meta); err != nil {
+			return nil, err
+		}
+		groups[string(kv.Key[len(prefix):])] = meta
+	}
+
 	return
 }
 
-func (e *etcdClient) getUser(id string) (user *backend.UserData, err error) {
+func (e *etcdClient) GetGroup(name string) (meta *backend.GroupMeta, err error) {
+	if e.groupsPrefix == "" {
+		return nil, api.ErrNoGroupStore
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
 	defer cancel()
 
+	resp, err := e.client.Get(ctx, path.Join(e.groupsPrefix, name))
+	if err != nil || len(resp.Kvs) == 0 {
+		return
+	}
+
+	meta = &backend.GroupMeta{}
+	err = json.Unmarshal(resp.Kvs[0].Value, meta)
+	return
+}
+
+func (e *etcdClient) PutGroup(name string, meta *backend.GroupMeta) (err error) {
+	if e.groupsPrefix == "" {
+		return api.ErrNoGroupStore
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	ba, err := json.Marshal(meta)
+	if err == nil {
+		_, err = e.client.Put(ctx, path.Join(e.groupsPrefix, name), string(ba))
+	}
+	return
+}
+
+func (e *etcdClient) DeleteGroup(name string) (err error) {
+	if e.groupsPrefix == "" {
+		return api.ErrNoGroupStore
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
+	_, err = e.client.Delete(ctx, path.Join(e.groupsPrefix, name))
+	return
+}
+
+// versionOf returns the version of a user given the ModRevision of its key
+func versionOf(rev int64) string {
+	return strconv.FormatInt(rev, 10)
+}
+
+func (e *etcdClient) getUser(id string) (user *backend.UserData, rev int64, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+
 	resp, err := e.client.Get(ctx, path.Join(e.prefix, id))
 	if err != nil {
 		return
@@ -101,20 +398,55 @@ func (e *etcdClient) getUser(id string) (user *backend.UserData, err error) {
 		return
 	}
 
+	kv := resp.Kvs[0]
+
 	user = &backend.UserData{}
-	err = json.Unmarshal(resp.Kvs[0].Value, user)
-	return
+	if err = json.Unmarshal(kv.Value, user); err != nil {
+		return nil, 0, err
+	}
+
+	return user, kv.ModRevision, nil
 }
 
-func (e *etcdClient) putUser(id string, user *backend.UserData) (err error) {
+// putUser writes the user if its key's ModRevision is still rev.
+func (e *etcdClient) putUser(id string, user *backend.UserData, rev int64) (ok bool, err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
 	defer cancel()
 
 	u, err := json.Marshal(*user)
-	if err == nil {
-		_, err = e.client.Put(ctx, path.Join(e.prefix, id), string(u))
+	if err != nil {
+		return
 	}
 
+	key := path.Join(e.prefix, id)
+
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+		Then(clientv3.OpPut(key, string(u))).
+		Commit()
+	if err != nil {
+		return
+	}
+
+	return resp.Succeeded, nil
+}
+
+// CheckHealth checks that at least one etcd endpoint answers.
+func (e *etcdClient) CheckHealth(ctx context.Context) (err error) {
+	endpoints := e.client.Endpoints()
+	if len(endpoints) == 0 {
+		return errors.New("no etcd endpoint configured")
+	}
+
+	for _, endpoint := range endpoints {
+		if _, err = e.client.Status(ctx, endpoint); err == nil {
+			return
+		}
+	}
 	return
+}
 
+// Close the etcd client.
+func (e *etcdClient) Close() error {
+	return e.client.Close()
 }
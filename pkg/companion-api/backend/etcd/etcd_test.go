@@ -0,0 +1,33 @@
+package etcd
+
+import (
+	"testing"
+
+	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
+)
+
+func TestOverlaps(t *testing.T) {
+	for _, tc := range []struct {
+		prefix1, prefix2 string
+		overlaps         bool
+	}{
+		{"/users", "/groups", false},
+		{"/users", "/users-groups", false},
+		{"/users/", "/users_groups/", false},
+		{"/users", "/users", true},
+		{"/users", "/users/groups", true},
+		{"/users/", "/users/groups/", true},
+		{"/autentigo/users/groups", "/autentigo/users", true},
+	} {
+		if o := overlaps(tc.prefix1, tc.prefix2); o != tc.overlaps {
+			t.Errorf("overlaps(%q, %q): expected %v, got %v", tc.prefix1, tc.prefix2, tc.overlaps, o)
+		}
+	}
+}
+
+func TestNewOverlappingPrefixes(t *testing.T) {
+	_, err := backend.New("etcd", &Config{Prefix: "/users", GroupsPrefix: "/users/groups"})
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,81 @@
+package backend
+
+import (
+	"errors"
+	"net/http"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+// GroupMeta is the optional metadata of a group.
+type GroupMeta struct {
+	Description string   `json:"description,omitempty"`
+	Owners      []string `json:"owners,omitempty"`
+}
+
+// GroupStore is implemented by clients storing the metadata of groups.
+type GroupStore interface {
+	// ListGroups returns the metadata of all the groups.
+	ListGroups() (map[string]GroupMeta, error)
+	// GetGroup returns the metadata of a group, or nil if it has none.
+	GetGroup(name string) (*GroupMeta, error)
+	PutGroup(name string, meta *GroupMeta) error
+	DeleteGroup(name string) error
+}
+
+// UsersUpdater is implemented by clients able to update many users atomically.
+type UsersUpdater interface {
+	// UpdateUsers calls update for each user, then saves the modified users
+	// atomically. update may be called again if the users were modified
+	// concurrently.
+	UpdateUsers(update func(id string, user *UserData) (modified bool, err error)) error
+}
+
+// ErrMissingUser indicates an inexistent user (also api.ErrMissingUser).
+var ErrMissingUser = restful.NewError(http.StatusConflict, "Missing user")
+
+var errUnmodified = errors.New("unmodified")
+
+// UpdateUsers updates the users atomically if the client supports it, or one
+// by one otherwise.
+func UpdateUsers(client Client, update func(id string, user *UserData) (modified bool, err error)) error {
+	if uu, ok := client.(UsersUpdater); ok {
+		return uu.UpdateUsers(update)
+	}
+
+	opts := ListOptions{Limit: MaxListLimit}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	for {
+		list, err := client.ListUsers(opts)
+		if err != nil {
+			return err
+		}
+
+		for _, u := range list.Users {
+			id := u.ID
+
+			err := client.UpdateUser(id, "", func(user *UserData) error {
+				modified, err := update(id, user)
+				if err == nil && !modified {
+					err = errUnmodified
+				}
+				return err
+			})
+
+			if err == errUnmodified || err == ErrMissingUser {
+				// unmodified or deleted since listed
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if list.Continue == "" {
+			return nil
+		}
+		opts.Continue = list.Continue
+	}
+}
@@ -0,0 +1,85 @@
+package backend
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/mcluseau/autentigo/auth"
+)
+
+// listClient is a client without atomic updates, deleting users after they
+// are listed.
+type listClient struct {
+	users   map[string]UserData
+	deleted []string
+	updated []string
+}
+
+func (c *listClient) GetUser(id string) (*UserData, string, error) {
+	panic("not implemented")
+}
+
+func (c *listClient) ListUsers(opts ListOptions) (*UserList, error) {
+	users := make([]User, 0, len(c.users))
+	for id, user := range c.users {
+		users = append(users, User{ID: id, UserData: user})
+	}
+
+	list, err := List(users, opts)
+
+	for _, id := range c.deleted {
+		delete(c.users, id)
+	}
+	return list, err
+}
+
+func (c *listClient) CreateUser(id string, user *UserData) error {
+	panic("not implemented")
+}
+
+func (c *listClient) UpdateUser(id, version string, update func(user *UserData) error) error {
+	user, ok := c.users[id]
+	if !ok {
+		return ErrMissingUser
+	}
+	if err := update(&user); err != nil {
+		return err
+	}
+	c.users[id] = user
+	c.updated = append(c.updated, id)
+	return nil
+}
+
+func (c *listClient) DeleteUser(id, version string) error {
+	panic("not implemented")
+}
+
+func TestUpdateUsersFallback(t *testing.T) {
+	client := &listClient{
+		users: map[string]UserData{
+			"a": {ExtraClaims: auth.ExtraClaims{Groups: []string{"dev"}}},
+			"b": {ExtraClaims: auth.ExtraClaims{Groups: []string{"dev"}}},
+			"c": {ExtraClaims: auth.ExtraClaims{Groups: []string{"ops"}}},
+			"d": {ExtraClaims: auth.ExtraClaims{Groups: []string{"dev"}}},
+		},
+		deleted: []string{"b"},
+	}
+
+	err := UpdateUsers(client, func(id string, user *UserData) (bool, error) {
+		if !reflect.DeepEqual(user.ExtraClaims.Groups, []string{"dev"}) {
+			return false, nil
+		}
+		user.ExtraClaims.Groups = []string{"developers"}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b was deleted after being listed, c was not modified
+	sort.Strings(client.updated)
+	if !reflect.DeepEqual(client.updated, []string{"a", "d"}) {
+		t.Error("unexpected updated users: ", client.updated)
+	}
+}
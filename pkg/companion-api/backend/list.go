@@ -0,0 +1,209 @@
+package backend
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultListLimit is the number of users listed when no limit is given.
+	DefaultListLimit = 100
+	// MaxListLimit is the maximum number of users listed at once.
+	MaxListLimit = 1000
+)
+
+// SortFields are the fields users can be sorted by.
+var SortFields = []string{"id", "display_name", "email"}
+
+// ErrInvalidContinue indicates a continue token that wasn't returned by a
+// previous list.
+var ErrInvalidContinue = errors.New("invalid continue token")
+
+// ListOptions are the options of a users list.
+type ListOptions struct {
+	// Prefix of the users' id.
+	Prefix string
+	// Group the users must be member of.
+	Group string
+	// Email of the users (case insensitive).
+	Email string
+
+	// Sort is the sort field (see SortFields), prefixed with "-" for a
+	// descending sort. Defaults to "id".
+	Sort string
+
+	// Limit is the maximum number of users to return.
+	Limit int
+	// Continue lists the users after those of the previous list.
+	Continue string
+}
+
+// User is a user with its id.
+type User struct {
+	ID string `json:"id"`
+	UserData
+}
+
+// UserList is a page of users.
+type UserList struct {
+	Users []User
+	// Continue is the token to give to get the next page, if any.
+	Continue string
+}
+
+// Validate checks the options and sets the defaults.
+func (o *ListOptions) Validate() error {
+	if o.Sort == "" {
+		o.Sort = "id"
+	}
+
+	field, _ := o.SortField()
+	valid := false
+	for _, f := range SortFields {
+		if f == field {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fmt.Errorf("invalid sort field: %q", field)
+	}
+
+	switch {
+	case o.Limit < 0:
+		return fmt.Errorf("invalid limit: %d", o.Limit)
+	case o.Limit == 0:
+		o.Limit = DefaultListLimit
+	case o.Limit > MaxListLimit:
+		o.Limit = MaxListLimit
+	}
+
+	if o.Continue != "" {
+		if _, _, err := DecodeContinue(o.Continue); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SortField returns the field to sort on, and if the sort is descending.
+func (o *ListOptions) SortField() (field string, desc bool) {
+	if strings.HasPrefix(o.Sort, "-") {
+		return o.Sort[1:], true
+	}
+	return o.Sort, false
+}
+
+// Match returns true if the user matches the filters of the options.
+func (o *ListOptions) Match(id string, user *UserData) bool {
+	if !strings.HasPrefix(id, o.Prefix) {
+		return false
+	}
+
+	c := user.ExtraClaims
+
+	if o.Email != "" && !strings.EqualFold(o.Email, c.Email) {
+		return false
+	}
+
+	if o.Group != "" {
+		for _, g := range c.Groups {
+			if g == o.Group {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// SortValue returns the value of the sort field of the user.
+func (o *ListOptions) SortValue(u User) string {
+	field, _ := o.SortField()
+
+	switch field {
+	case "display_name":
+		return u.ExtraClaims.DisplayName
+	case "email":
+		return u.ExtraClaims.Email
+	default:
+		return u.ID
+	}
+}
+
+// EncodeContinue returns the continue token listing users after the given one.
+func (o *ListOptions) EncodeContinue(last User) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(o.SortValue(last) + "\x00" + last.ID))
+}
+
+// DecodeContinue returns the sort value and the id of the last user of the
+// previous list.
+func DecodeContinue(token string) (value, id string, err error) {
+	ba, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", "", ErrInvalidContinue
+	}
+
+	parts := strings.SplitN(string(ba), "\x00", 2)
+	if len(parts) != 2 {
+		return "", "", ErrInvalidContinue
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// List filters, sorts and paginates the given users, for backends without
+// native support of these operations. The options must be validated.
+func List(users []User, opts ListOptions) (list *UserList, err error) {
+	filtered := make([]User, 0, len(users))
+	for _, u := range users {
+		if opts.Match(u.ID, &u.UserData) {
+			filtered = append(filtered, u)
+		}
+	}
+
+	_, desc := opts.SortField()
+
+	// less is strict in both orders, so the continue token's user isn't listed again
+	less := func(v1, id1, v2, id2 string) bool {
+		if v1 == v2 {
+			v1, v2 = id1, id2
+		}
+		if desc {
+			return v2 < v1
+		}
+		return v1 < v2
+	}
+
+	sort.Slice(filtered, func(i, j int) bool {
+		ui, uj := filtered[i], filtered[j]
+		return less(opts.SortValue(ui), ui.ID, opts.SortValue(uj), uj.ID)
+	})
+
+	if opts.Continue != "" {
+		value, id, err := DecodeContinue(opts.Continue)
+		if err != nil {
+			return nil, err
+		}
+
+		start := sort.Search(len(filtered), func(i int) bool {
+			u := filtered[i]
+			return less(value, id, opts.SortValue(u), u.ID)
+		})
+		filtered = filtered[start:]
+	}
+
+	list = &UserList{Users: filtered}
+
+	if len(filtered) > opts.Limit {
+		list.Users = filtered[:opts.Limit]
+		list.Continue = opts.EncodeContinue(list.Users[opts.Limit-1])
+	}
+
+	return
+}
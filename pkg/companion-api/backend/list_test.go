@@ -0,0 +1,129 @@
+package backend
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mcluseau/autentigo/auth"
+)
+
+var testUsers = []User{
+	{ID: "carol", UserData: UserData{ExtraClaims: auth.ExtraClaims{DisplayName: "Carol", Email: "carol@example.com", Groups: []string{"dev"}}}},
+	{ID: "alice", UserData: UserData{ExtraClaims: auth.ExtraClaims{DisplayName: "Alice", Email: "Alice@Example.com", Groups: []string{"dev", "ops"}}}},
+	{ID: "bob", UserData: UserData{ExtraClaims: auth.ExtraClaims{DisplayName: "Bob", Email: "bob@example.com"}}},
+	{ID: "bob2", UserData: UserData{ExtraClaims: auth.ExtraClaims{DisplayName: "Bob", Email: "bob@example.com", Groups: []string{"ops"}}}},
+	{ID: "dave", UserData: UserData{ExtraClaims: auth.ExtraClaims{DisplayName: "Alice", Groups: []string{"dev"}}}},
+}
+
+// listAll lists every page and returns the ids of the users of each page.
+func listAll(t *testing.T, users []User, opts ListOptions) (pages [][]string) {
+	t.Helper()
+
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		list, err := List(users, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		page := []string{}
+		for _, u := range list.Users {
+			page = append(page, u.ID)
+		}
+		pages = append(pages, page)
+
+		if list.Continue == "" {
+			return
+		}
+
+		if len(pages) > len(users) {
+			t.Fatal("too many pages: ", pages)
+		}
+		opts.Continue = list.Continue
+	}
+}
+
+func TestList(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		opts  ListOptions
+		pages [][]string
+	}{
+		{"all", ListOptions{}, [][]string{{"alice", "bob", "bob2", "carol", "dave"}}},
+		{"pages", ListOptions{Limit: 2}, [][]string{{"alice", "bob"}, {"bob2", "carol"}, {"dave"}}},
+		{"exact pages", ListOptions{Limit: 5}, [][]string{{"alice", "bob", "bob2", "carol", "dave"}}},
+		{"descending", ListOptions{Sort: "-id", Limit: 3}, [][]string{{"dave", "carol", "bob2"}, {"bob", "alice"}}},
+		// equal sort values are ordered by id, pages don't skip or repeat them
+		{"display name", ListOptions{Sort: "display_name", Limit: 1}, [][]string{{"alice"}, {"dave"}, {"bob"}, {"bob2"}, {"carol"}}},
+		{"descending display name", ListOptions{Sort: "-display_name", Limit: 2}, [][]string{{"carol", "bob2"}, {"bob", "dave"}, {"alice"}}},
+		{"email", ListOptions{Sort: "email", Limit: 2}, [][]string{{"dave", "alice"}, {"bob", "bob2"}, {"carol"}}},
+		{"prefix", ListOptions{Prefix: "bob", Limit: 1}, [][]string{{"bob"}, {"bob2"}}},
+		{"group", ListOptions{Group: "ops"}, [][]string{{"alice", "bob2"}}},
+		{"email filter", ListOptions{Email: "alice@example.COM"}, [][]string{{"alice"}}},
+		{"no match", ListOptions{Prefix: "x"}, [][]string{{}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if pages := listAll(t, testUsers, tc.opts); !reflect.DeepEqual(pages, tc.pages) {
+				t.Errorf("expected pages %q, got %q", tc.pages, pages)
+			}
+		})
+	}
+}
+
+func TestListContinueAfterDelete(t *testing.T) {
+	opts := ListOptions{Limit: 2}
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := List(testUsers, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last user of the page is deleted before the next page is listed
+	users := make([]User, 0, len(testUsers))
+	for _, u := range testUsers {
+		if u.ID != "bob" {
+			users = append(users, u)
+		}
+	}
+
+	opts.Continue = list.Continue
+	if list, err = List(users, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Users) != 2 || list.Users[0].ID != "bob2" || list.Users[1].ID != "carol" {
+		t.Error("unexpected users: ", list.Users)
+	}
+}
+
+func TestListOptionsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		opts  ListOptions
+		limit int
+		err   bool
+	}{
+		{ListOptions{}, DefaultListLimit, false},
+		{ListOptions{Limit: 10, Sort: "-email"}, 10, false},
+		{ListOptions{Limit: MaxListLimit + 1}, MaxListLimit, false},
+		{ListOptions{Limit: -1}, 0, true},
+		{ListOptions{Sort: "password"}, 0, true},
+		{ListOptions{Sort: "-"}, 0, true},
+		{ListOptions{Continue: "!"}, 0, true},
+		{ListOptions{Continue: "YWxpY2U"}, 0, true}, // no separator
+	} {
+		opts := tc.opts
+		err := opts.Validate()
+
+		if (err != nil) != tc.err {
+			t.Errorf("%+v: unexpected error: %v", tc.opts, err)
+		} else if err == nil && opts.Limit != tc.limit {
+			t.Errorf("%+v: expected limit %d, got %d", tc.opts, tc.limit, opts.Limit)
+		}
+	}
+}
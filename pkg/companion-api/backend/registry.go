@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/mcluseau/autentigo/pkg/settings"
+)
+
+// Factory creates the Clients of a backend.
+type Factory struct {
+	// Description of the backend.
+	Description string
+
+	// NewConfig returns a pointer to the configuration struct of the backend,
+	// filled with its default values (see the settings package for tags).
+	NewConfig func() interface{}
+
+	// New creates a Client from a configuration given by NewConfig.
+	New func(config interface{}) (Client, error)
+}
+
+var factories = map[string]Factory{}
+
+// Register registers a backend factory under the given name.
+func Register(name string, factory Factory) {
+	if _, exists := factories[name]; exists {
+		panic("backend already registered: " + name)
+	}
+	factories[name] = factory
+}
+
+// Names returns the sorted names of the registered backends.
+func Names() (names []string) {
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// FactoryFor returns the factory registered under the given name.
+func FactoryFor(name string) (factory Factory, ok bool) {
+	factory, ok = factories[name]
+	return
+}
+
+// Config returns the configuration of the named backend, read from its raw
+// configuration section then from the environment.
+func Config(name string, raw json.RawMessage) (config interface{}, err error) {
+	factory, ok := factories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend: %q", name)
+	}
+
+	config = factory.NewConfig()
+	if err = settings.Load(config, raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return
+}
+
+// New creates a Client of the named backend.
+func New(name string, config interface{}) (Client, error) {
+	factory, ok := factories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend: %q", name)
+	}
+	return factory.New(config)
+}
@@ -0,0 +1,422 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/mcluseau/autentigo/pkg/companion-api/api"
+	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
+
+	_ "github.com/lib/pq"
+)
+
+// Config of the sql backend
+type Config struct {
+	Driver    string `json:"driver" env:"SQL_DRIVER" required:"true" desc:"SQL driver (ex: postgres)"`
+	DSN       string `json:"dsn" env:"SQL_DSN" required:"true" desc:"SQL destination"`
+	UserTable string `json:"user_table" env:"SQL_USER_TABLE" required:"true" desc:"SQL table with stored users"`
+
+	GroupTable string `json:"group_table" env:"SQL_GROUP_TABLE" desc:"SQL table with groups metadata (not stored if empty)"`
+}
+
+func init() {
+	backend.Register("sql", backend.Factory{
+		Description: "Manages users in an SQL database",
+		NewConfig:   func() interface{} { return &Config{} },
+		New: func(config interface{}) (backend.Client, error) {
+			c := config.(*Config)
+			client := New(c.Driver, c.DSN, c.UserTable).(*sqlClient)
+			client.groupTable = c.GroupTable
+			return client, nil
+		},
+	})
+}
+
+type sqlClient struct {
+	db         *sql.DB
+	table      string
+	groupTable string
+}
+
+// New Client to manage users with an SQL backend
+func New(driver, dsn, table string) backend.Client {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		log.Fatal("failed to open database: ", err)
+	}
+
+	return &sqlClient{
+		db:    db,
+		table: table,
+	}
+}
+
+var _ backend.Client = &sqlClient{}
+var _ backend.HealthChecker = &sqlClient{}
+var _ io.Closer = &sqlClient{}
+var _ backend.UsersUpdater = &sqlClient{}
+var _ backend.GroupStore = &sqlClient{}
+
+func (sc *sqlClient) GetUser(id string) (*backend.UserData, string, error) {
+	user, version, err := sc.getUser(sc.db, id, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, versionOf(version), nil
+}
+
+func (sc *sqlClient) CreateUser(id string, user *backend.UserData) (err error) {
+	tx, err := sc.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, _, err = sc.getUser(tx, id, false); err == nil {
+		return api.ErrUserAlreadyExist
+	} else if err != api.ErrMissingUser {
+		return
+	}
+
+	query := fmt.Sprintf("insert into %s (id, password_hash, display_name, email, email_verified, groups, password_history, version) values ($1, $2, $3, $4, $5, $6, $7, 1);", sc.table)
+
+	c := user.ExtraClaims
+	if _, err = tx.Exec(query, id, user.PasswordHash, c.DisplayName, c.Email, c.EmailVerified, strings.Join(c.Groups, ","), strings.Join(user.PasswordHistory, ",")); err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+func (sc *sqlClient) UpdateUser(id, version string, update func(user *backend.UserData) error) (err error) {
+	tx, err := sc.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	user, currentVersion, err := sc.getUser(tx, id, true)
+	if err != nil {
+		return
+	}
+
+	if version != "" && version != versionOf(currentVersion) {
+		return api.ErrVersionMismatch
+	}
+
+	if err = update(user); err != nil {
+		return
+	}
+
+	if err = sc.writeUser(tx, id, user); err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+func (sc *sqlClient) UpdateUsers(update func(id string, user *backend.UserData) (bool, error)) (err error) {
+	tx, err := sc.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("select id, password_hash, display_name, email, email_verified, groups, password_history from %s for update;", sc.table)
+
+	rows, err := tx.Query(query)
+	if err != nil {
+		return
+	}
+
+	users := make([]backend.User, 0)
+	for rows.Next() {
+		u := backend.User{}
+		if err = scanUser(rows, &u.UserData, &u.ID); err != nil {
+			rows.Close()
+			return
+		}
+		users = append(users, u)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for _, u := range users {
+		modified, err := update(u.ID, &u.UserData)
+		if err != nil {
+			return err
+		}
+
+		if modified {
+			if err = sc.writeUser(tx, u.ID, &u.UserData); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// writeUser updates the user, incrementing its version.
+func (sc *sqlClient) writeUser(tx *sql.Tx, id string, user *backend.UserData) (err error) {
+	query := fmt.Sprintf("update %s set password_hash=$2, display_name=$3, email=$4, email_verified=$5, groups=$6, password_history=$7, version=version+1 where id=$1;", sc.table)
+
+	c := user.ExtraClaims
+	_, err = tx.Exec(query, id, user.PasswordHash, c.DisplayName, c.Email, c.EmailVerified, strings.Join(c.Groups, ","), strings.Join(user.PasswordHistory, ","))
+	return
+}
+
+func (sc *sqlClient) ListGroups() (groups map[string]backend.GroupMeta, err error) {
+	if sc.groupTable == "" {
+		return nil, api.ErrNoGroupStore
+	}
+
+	rows, err := sc.db.Query(fmt.Sprintf("select name, description, owners from %s;", sc.groupTable))
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	groups = map[string]backend.GroupMeta{}
+	for rows.Next() {
+		name := ""
+		meta := &backend.GroupMeta{}
+		if err = scanGroup(rows, meta, &name); err != nil {
+			return nil, err
+		}
+		groups[name] = *meta
+	}
+
+	err = rows.Err()
+	return
+}
+
+func (sc *sqlClient) GetGroup(name string) (meta *backend.GroupMeta, err error) {
+	if sc.groupTable == "" {
+		return nil, api.ErrNoGroupStore
+	}
+
+	query := fmt.Sprintf("select description, owners from %s where name=$1;", sc.groupTable)
+
+	meta = &backend.GroupMeta{}
+	err = scanGroup(sc.db.QueryRow(query, name), meta)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (sc *sqlClient) PutGroup(name string, meta *backend.GroupMeta) (err error) {
+	if sc.groupTable == "" {
+		return api.ErrNoGroupStore
+	}
+
+	query := fmt.Sprintf("insert into %s (name, description, owners) values ($1, $2, $3) on conflict (name) do update set description=$2, owners=$3;", sc.groupTable)
+
+	_, err = sc.db.Exec(query, name, meta.Description, strings.Join(meta.Owners, ","))
+	return
+}
+
+func (sc *sqlClient) DeleteGroup(name string) (err error) {
+	if sc.groupTable == "" {
+		return api.ErrNoGroupStore
+	}
+
+	_, err = sc.db.Exec(fmt.Sprintf("delete from %s where name=$1;", sc.groupTable), name)
+	return
+}
+
+// scanGroup scans the given columns, then the group's fields.
+func scanGroup(row scanner, meta *backend.GroupMeta, columns ...interface{}) (err error) {
+	owners := ""
+
+	if err = row.Scan(append(columns, &meta.Description, &owners)...); err != nil {
+		return
+	}
+
+	if owners != "" {
+		meta.Owners = strings.Split(owners, ",")
+	}
+	return
+}
+
+func (sc *sqlClient) DeleteUser(id, version string) (err error) {
+	tx, err := sc.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	_, currentVersion, err := sc.getUser(tx, id, true)
+	if err != nil {
+		return
+	}
+
+	if version != "" && version != versionOf(currentVersion) {
+		return api.ErrVersionMismatch
+	}
+
+	query := fmt.Sprintf("delete from %s where id=$1;", sc.table)
+
+	if _, err = tx.Exec(query, id); err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+// versionOf returns the version of a user given its version column
+func versionOf(version int64) string {
+	return strconv.FormatInt(version, 10)
+}
+
+// queryRower is a *sql.DB or a *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// scanner is a *sql.Row or *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (sc *sqlClient) getUser(q queryRower, id string, forUpdate bool) (user *backend.UserData, version int64, err error) {
+	query := fmt.Sprintf("select version, password_hash, display_name, email, email_verified, groups, password_history from %s where id=$1", sc.table)
+	if forUpdate {
+		query += " for update"
+	}
+
+	user = &backend.UserData{}
+	err = scanUser(q.QueryRow(query, id), user, &version)
+	if err == sql.ErrNoRows {
+		return nil, 0, api.ErrMissingUser
+	} else if err != nil {
+		return nil, 0, err
+	}
+	return
+}
+
+// scanUser scans the given columns, then the user's fields.
+func scanUser(row scanner, user *backend.UserData, columns ...interface{}) (err error) {
+	groups, history := "", ""
+	c := &user.ExtraClaims
+
+	dest := append(columns, &user.PasswordHash, &c.DisplayName, &c.Email, &c.EmailVerified, &groups, &history)
+
+	if err = row.Scan(dest...); err != nil {
+		return
+	}
+
+	if groups != "" {
+		c.Groups = strings.Split(groups, ",")
+	}
+	if history != "" {
+		user.PasswordHistory = strings.Split(history, ",")
+	}
+	return
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (sc *sqlClient) ListUsers(opts backend.ListOptions) (list *backend.UserList, err error) {
+	where := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if opts.Prefix != "" {
+		where = append(where, "id like "+arg(likeEscaper.Replace(opts.Prefix)+"%"))
+	}
+	if opts.Email != "" {
+		where = append(where, "lower(email) = lower("+arg(opts.Email)+")")
+	}
+	if opts.Group != "" {
+		where = append(where, "(',' || groups || ',') like "+arg("%,"+likeEscaper.Replace(opts.Group)+",%"))
+	}
+
+	// the sort fields are validated column names
+	field, desc := opts.SortField()
+
+	op, order := ">", "asc"
+	if desc {
+		op, order = "<", "desc"
+	}
+
+	if opts.Continue != "" {
+		value, id, err := backend.DecodeContinue(opts.Continue)
+		if err != nil {
+			return nil, err
+		}
+
+		if field == "id" {
+			where = append(where, fmt.Sprintf("id %s %s", op, arg(id)))
+		} else {
+			where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)", field, op, arg(value), arg(id)))
+		}
+	}
+
+	query := fmt.Sprintf("select id, password_hash, display_name, email, email_verified, groups, password_history from %s", sc.table)
+	if len(where) != 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+
+	if field == "id" {
+		query += fmt.Sprintf(" order by id %s", order)
+	} else {
+		query += fmt.Sprintf(" order by %s %s, id %s", field, order, order)
+	}
+
+	// one more to know if there's a next page
+	query += fmt.Sprintf(" limit %d;", opts.Limit+1)
+
+	rows, err := sc.db.Query(query, args...)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	list = &backend.UserList{Users: []backend.User{}}
+	for rows.Next() {
+		u := backend.User{}
+		if err = scanUser(rows, &u.UserData, &u.ID); err != nil {
+			return nil, err
+		}
+		list.Users = append(list.Users, u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(list.Users) > opts.Limit {
+		list.Users = list.Users[:opts.Limit]
+		list.Continue = opts.EncodeContinue(list.Users[opts.Limit-1])
+	}
+
+	return
+}
+
+// CheckHealth checks the database connection.
+func (sc *sqlClient) CheckHealth(ctx context.Context) error {
+	return sc.db.PingContext(ctx)
+}
+
+// Close the database.
+func (sc *sqlClient) Close() error {
+	return sc.db.Close()
+}
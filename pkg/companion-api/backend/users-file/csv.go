@@ -52,7 +52,7 @@ func (ufw *usersFileWriter) save(filePath string) (err error) {
 	ufw.flush()
 	ufw.tmpFile.Close()
 
-	if err = os.Remove(filePath); err != nil {
+	if err = os.Remove(filePath); err != nil && !os.IsNotExist(err) {
 		return
 	}
 
@@ -75,6 +75,7 @@ func newUsersFileReader(fileName string) (ufr *usersFileReader, err error) {
 
 	reader := csv.NewReader(f)
 	reader.Comma = ':'
+	reader.FieldsPerRecord = -1
 
 	ufr = &usersFileReader{
 		reader: reader,
@@ -1,12 +1,17 @@
 package usersfile
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"io"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 
-	"github.com/mcluseau/autentigo/auth"
 	"github.com/mcluseau/autentigo/pkg/companion-api/api"
 	"github.com/mcluseau/autentigo/pkg/companion-api/backend"
 )
@@ -21,7 +26,30 @@ var toBool = map[string]bool{
 }
 
 type fileClient struct {
-	filePath string
+	filePath   string
+	groupsPath string
+	// mutex serializes the modifications of the file
+	mutex sync.Mutex
+}
+
+// Config of the file backend
+type Config struct {
+	Path string `json:"path" env:"AUTH_FILE" required:"true" desc:"file containing the users"`
+
+	GroupsPath string `json:"groups_path" env:"AUTH_GROUPS_FILE" desc:"file containing the groups metadata (name:description:owners, not stored if empty)"`
+}
+
+func init() {
+	backend.Register("file", backend.Factory{
+		Description: "Manages users in a file (user:sha256 hash:display name:email:email verified:groups)",
+		NewConfig:   func() interface{} { return &Config{} },
+		New: func(config interface{}) (backend.Client, error) {
+			c := config.(*Config)
+			client := New(c.Path).(*fileClient)
+			client.groupsPath = c.GroupsPath
+			return client, nil
+		},
+	})
 }
 
 // New Client to manage users with a csv file backend
@@ -32,8 +60,13 @@ func New(filePath string) backend.Client {
 }
 
 var _ backend.Client = &fileClient{}
+var _ backend.HealthChecker = &fileClient{}
+var _ backend.UsersUpdater = &fileClient{}
+var _ backend.GroupStore = &fileClient{}
 
 func (fc *fileClient) CreateUser(id string, user *backend.UserData) (err error) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
 
 	oldUser := &backend.UserData{}
 	oldUser, err = fc.getUser(id)
@@ -41,27 +74,47 @@ func (fc *fileClient) CreateUser(id string, user *backend.UserData) (err error)
 	if oldUser != nil {
 		err = api.ErrUserAlreadyExist
 	} else if err == api.ErrMissingUser {
-		err = fc.putUser(id, user.PasswordHash, user.ExtraClaims)
+		err = fc.putUser(id, user)
 	}
 
 	return
 }
 
-func (fc *fileClient) UpdateUser(id string, update func(user *backend.UserData) error) (err error) {
+func (fc *fileClient) UpdateUser(id, version string, update func(user *backend.UserData) error) (err error) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
 	user := &backend.UserData{}
 	user, err = fc.getUser(id)
 
+	if err == nil && version != "" && version != versionOf(user) {
+		err = api.ErrVersionMismatch
+	}
+
 	if err == nil && user != nil {
 		err = update(user)
 		if err == nil {
-			err = fc.putUser(id, user.PasswordHash, user.ExtraClaims)
+			err = fc.putUser(id, user)
 		}
 	}
 
 	return
 }
 
-func (fc *fileClient) DeleteUser(id string) error {
+func (fc *fileClient) DeleteUser(id, version string) error {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	if version != "" {
+		user, err := fc.getUser(id)
+		if err != nil {
+			return err
+		}
+
+		if version != versionOf(user) {
+			return api.ErrVersionMismatch
+		}
+	}
 
 	var wg sync.WaitGroup
 
@@ -106,7 +159,45 @@ func (fc *fileClient) DeleteUser(id string) error {
 	return nil
 }
 
-func (fc *fileClient) putUser(id, passwordHash string, claims auth.ExtraClaims) error {
+func (fc *fileClient) UpdateUsers(update func(id string, user *backend.UserData) (bool, error)) (err error) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	users := make([]backend.User, 0)
+	err = fc.readUsers(func(id string, user *backend.UserData) bool {
+		users = append(users, backend.User{ID: id, UserData: *user})
+		return true
+	})
+	if err != nil {
+		return
+	}
+
+	modified := false
+	for i := range users {
+		m, err := update(users[i].ID, &users[i].UserData)
+		if err != nil {
+			return err
+		}
+		modified = modified || m
+	}
+
+	if !modified {
+		return
+	}
+
+	writer, err := newUsersFileWriter()
+	if err != nil {
+		return
+	}
+
+	for _, u := range users {
+		writer.write(userRecord(u.ID, &u.UserData))
+	}
+
+	return writer.save(fc.filePath)
+}
+
+func (fc *fileClient) putUser(id string, user *backend.UserData) error {
 	var wg sync.WaitGroup
 
 	reader, err := newUsersFileReader(fc.filePath)
@@ -131,11 +222,7 @@ func (fc *fileClient) putUser(id, passwordHash string, claims auth.ExtraClaims)
 		}
 
 		if id == record[0] {
-			record[1] = passwordHash
-			record[2] = claims.DisplayName
-			record[3] = claims.Email
-			record[4] = strconv.FormatBool(claims.EmailVerified)
-			record[5] = strings.Join(claims.Groups, ",")
+			record = userRecord(id, user)
 			recordExist = true
 		}
 
@@ -149,25 +236,78 @@ func (fc *fileClient) putUser(id, passwordHash string, claims auth.ExtraClaims)
 
 	wg.Wait()
 	if !recordExist {
-		writer.write([]string{
-			id,
-			passwordHash,
-			claims.DisplayName,
-			claims.Email,
-			strconv.FormatBool(claims.EmailVerified),
-			strings.Join(claims.Groups, ","),
-		})
+		writer.write(userRecord(id, user))
 	}
 
 	return nil
 }
 
-func (fc *fileClient) getUser(id string) (*backend.UserData, error) {
+func (fc *fileClient) GetUser(id string) (*backend.UserData, string, error) {
+	user, err := fc.getUser(id)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, versionOf(user), nil
+}
 
-	reader, err := newUsersFileReader(fc.filePath)
+// versionOf returns the version of a user: a hash of its content, as the file
+// has no revisions.
+func versionOf(user *backend.UserData) string {
+	ba, _ := json.Marshal(user)
+	h := sha256.Sum256(ba)
+	return hex.EncodeToString(h[:16])
+}
+
+func (fc *fileClient) ListUsers(opts backend.ListOptions) (*backend.UserList, error) {
+	users := make([]backend.User, 0)
+
+	err := fc.readUsers(func(id string, user *backend.UserData) bool {
+		users = append(users, backend.User{ID: id, UserData: *user})
+		return true
+	})
 	if err != nil {
 		return nil, err
 	}
+
+	return backend.List(users, opts)
+}
+
+// userRecord returns the record of a user in the file
+// (id:hash:display name:email:email verified:groups:password history).
+func userRecord(id string, user *backend.UserData) []string {
+	c := user.ExtraClaims
+	return []string{
+		id,
+		user.PasswordHash,
+		c.DisplayName,
+		c.Email,
+		strconv.FormatBool(c.EmailVerified),
+		strings.Join(c.Groups, ","),
+		strings.Join(user.PasswordHistory, ","),
+	}
+}
+
+func (fc *fileClient) getUser(id string) (user *backend.UserData, err error) {
+	err = fc.readUsers(func(recordID string, recordUser *backend.UserData) bool {
+		if recordID != id {
+			return true
+		}
+		user = recordUser
+		return false
+	})
+
+	if err == nil && user == nil {
+		err = api.ErrMissingUser
+	}
+	return
+}
+
+// readUsers calls next for each user of the file, until it returns false.
+func (fc *fileClient) readUsers(next func(id string, user *backend.UserData) bool) error {
+	reader, err := newUsersFileReader(fc.filePath)
+	if err != nil {
+		return err
+	}
 	defer reader.close()
 
 	for {
@@ -175,7 +315,7 @@ func (fc *fileClient) getUser(id string) (*backend.UserData, error) {
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return nil, err
+			return err
 		}
 
 		if len(record) < 2 {
@@ -183,18 +323,21 @@ func (fc *fileClient) getUser(id string) (*backend.UserData, error) {
 			continue
 		}
 
-		if id != record[0] {
-			continue
-		}
-
 		user := &backend.UserData{
 			PasswordHash: record[1],
 		}
 
 		l := len(record)
 		switch {
-		case l >= 6:
-			user.ExtraClaims.Groups = strings.Split(record[5], ",")
+		case l >= 7:
+			if record[6] != "" {
+				user.PasswordHistory = strings.Split(record[6], ",")
+			}
+			fallthrough
+		case l == 6:
+			if record[5] != "" {
+				user.ExtraClaims.Groups = strings.Split(record[5], ",")
+			}
 			fallthrough
 		case l == 5:
 			user.ExtraClaims.EmailVerified = toBool[record[4]]
@@ -206,8 +349,123 @@ func (fc *fileClient) getUser(id string) (*backend.UserData, error) {
 			user.ExtraClaims.DisplayName = record[2]
 		}
 
-		return user, nil
+		if !next(record[0], user) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (fc *fileClient) ListGroups() (groups map[string]backend.GroupMeta, err error) {
+	if fc.groupsPath == "" {
+		return nil, api.ErrNoGroupStore
+	}
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	return fc.readGroups()
+}
+
+func (fc *fileClient) GetGroup(name string) (*backend.GroupMeta, error) {
+	groups, err := fc.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	if meta, ok := groups[name]; ok {
+		return &meta, nil
+	}
+	return nil, nil
+}
+
+func (fc *fileClient) PutGroup(name string, meta *backend.GroupMeta) error {
+	return fc.updateGroups(func(groups map[string]backend.GroupMeta) {
+		groups[name] = *meta
+	})
+}
+
+func (fc *fileClient) DeleteGroup(name string) error {
+	return fc.updateGroups(func(groups map[string]backend.GroupMeta) {
+		delete(groups, name)
+	})
+}
+
+func (fc *fileClient) readGroups() (groups map[string]backend.GroupMeta, err error) {
+	groups = map[string]backend.GroupMeta{}
+
+	reader, err := newUsersFileReader(fc.groupsPath)
+	if os.IsNotExist(err) {
+		return groups, nil
+	} else if err != nil {
+		return
 	}
+	defer reader.close()
+
+	for {
+		record, err := reader.read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
 
-	return nil, api.ErrMissingUser
+		if len(record) < 3 {
+			// record too short
+			continue
+		}
+
+		meta := backend.GroupMeta{Description: record[1]}
+		if record[2] != "" {
+			meta.Owners = strings.Split(record[2], ",")
+		}
+
+		groups[record[0]] = meta
+	}
+
+	return
+}
+
+func (fc *fileClient) updateGroups(update func(groups map[string]backend.GroupMeta)) (err error) {
+	if fc.groupsPath == "" {
+		return api.ErrNoGroupStore
+	}
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	groups, err := fc.readGroups()
+	if err != nil {
+		return
+	}
+
+	update(groups)
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writer, err := newUsersFileWriter()
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		meta := groups[name]
+		writer.write([]string{name, meta.Description, strings.Join(meta.Owners, ",")})
+	}
+
+	return writer.save(fc.groupsPath)
+}
+
+// CheckHealth checks the users file is readable.
+func (fc *fileClient) CheckHealth(ctx context.Context) error {
+	reader, err := newUsersFileReader(fc.filePath)
+	if err != nil {
+		return err
+	}
+	return reader.close()
 }
@@ -0,0 +1,157 @@
+package exporter
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	yaml "github.com/projectcalico/go-yaml-wrapper"
+
+	"github.com/mcluseau/autentigo/pkg/settings"
+)
+
+// Config of an exporter.
+type Config struct {
+	Source SourceConfig `json:"source"`
+	Sinks  []Sink       `json:"sinks"`
+
+	// Debounce delays writes after an update (1s by default).
+	Debounce settings.Duration `json:"debounce"`
+}
+
+// SourceConfig selects and configures the source of users.
+type SourceConfig struct {
+	// Type of the source: etcd, sql or file.
+	Type string `json:"type"`
+
+	Etcd struct {
+		Endpoints []string `json:"endpoints"`
+		Prefix    string   `json:"prefix"`
+	} `json:"etcd"`
+
+	SQL struct {
+		Driver    string            `json:"driver"`
+		DSN       string            `json:"dsn"`
+		UserTable string            `json:"user_table"`
+		Interval  settings.Duration `json:"interval"`
+	} `json:"sql"`
+
+	File struct {
+		Path     string            `json:"path"`
+		Interval settings.Duration `json:"interval"`
+	} `json:"file"`
+}
+
+// ConfigFromFile reads a YAML configuration file.
+func ConfigFromFile(path string) (config *Config, err error) {
+	ba, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	config = &Config{}
+	if err = yaml.UnmarshalStrict(ba, config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return
+}
+
+// Validate checks the configuration.
+func (c *Config) Validate() error {
+	required := func(value, name string) error {
+		if value == "" {
+			return fmt.Errorf("source.%s is required", name)
+		}
+		return nil
+	}
+
+	src := c.Source
+	var errs []error
+	switch src.Type {
+	case "etcd":
+		if len(src.Etcd.Endpoints) == 0 {
+			return fmt.Errorf("source.etcd.endpoints is required")
+		}
+		errs = []error{required(src.Etcd.Prefix, "etcd.prefix")}
+	case "sql":
+		errs = []error{
+			required(src.SQL.Driver, "sql.driver"),
+			required(src.SQL.DSN, "sql.dsn"),
+			required(src.SQL.UserTable, "sql.user_table"),
+		}
+	case "file":
+		errs = []error{required(src.File.Path, "file.path")}
+	default:
+		return fmt.Errorf("unknown source type: %q", src.Type)
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(c.Sinks) == 0 {
+		return fmt.Errorf("at least one sink is required")
+	}
+
+	for i := range c.Sinks {
+		if err := c.Sinks[i].Validate(); err != nil {
+			return fmt.Errorf("sinks[%d]: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// New returns the exporter described by the configuration. The closer
+// releases the source's resources.
+func (c *Config) New() (e *Exporter, closer io.Closer, err error) {
+	e = &Exporter{Debounce: interval(c.Debounce, time.Second)}
+
+	src := c.Source
+	switch src.Type {
+	case "etcd":
+		var client *clientv3.Client
+		client, err = clientv3.New(clientv3.Config{Endpoints: src.Etcd.Endpoints})
+		if err != nil {
+			return
+		}
+		e.Source = &EtcdSource{Client: client, Prefix: src.Etcd.Prefix}
+		closer = client
+
+	case "sql":
+		var db *sql.DB
+		db, err = sql.Open(src.SQL.Driver, src.SQL.DSN)
+		if err != nil {
+			return
+		}
+		e.Source = &SQLSource{DB: db, Table: src.SQL.UserTable, Interval: interval(src.SQL.Interval, time.Minute)}
+		closer = db
+
+	case "file":
+		e.Source = &UsersFileSource{Path: src.File.Path, Interval: interval(src.File.Interval, 10*time.Second)}
+		closer = ioutil.NopCloser(nil)
+
+	default:
+		err = fmt.Errorf("unknown source type: %q", src.Type)
+		return
+	}
+
+	for i := range c.Sinks {
+		e.Sinks = append(e.Sinks, &c.Sinks[i])
+	}
+
+	return
+}
+
+func interval(d settings.Duration, defaultValue time.Duration) time.Duration {
+	if d.Duration <= 0 {
+		return defaultValue
+	}
+	return d.Duration
+}
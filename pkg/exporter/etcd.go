@@ -0,0 +1,179 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+var errWatchClosed = errors.New("watch closed")
+
+// EtcdSource reads users from etcd, with keys like prefix/user-name, and
+// watches their changes.
+//
+// Watch errors are retried from the last seen revision, with an exponential
+// backoff. When this revision has been compacted, the users are fully read
+// again.
+type EtcdSource struct {
+	Client *clientv3.Client
+	Prefix string
+}
+
+var _ Source = &EtcdSource{}
+
+func (s *EtcdSource) prefix() string {
+	if s.Prefix == "" || strings.HasSuffix(s.Prefix, "/") {
+		return s.Prefix
+	}
+	return s.Prefix + "/"
+}
+
+// Users implements Source.
+func (s *EtcdSource) Users(ctx context.Context) ([]User, error) {
+	users, _, err := s.sync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return usersOf(users), nil
+}
+
+// Run implements Source.
+func (s *EtcdSource) Run(ctx context.Context, update func(users []User)) error {
+	var (
+		users map[string]User
+		rev   int64
+		err   error
+		delay = minRetryDelay
+	)
+
+	for {
+		if users == nil {
+			if users, rev, err = s.sync(ctx); err == nil {
+				update(usersOf(users))
+				delay = minRetryDelay
+			}
+		}
+
+		if err == nil {
+			log.Print("etcd: following changes from revision ", rev+1)
+
+			var progress bool
+			rev, progress, err = s.watch(ctx, users, rev, update)
+			if progress {
+				delay = minRetryDelay
+			}
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err == rpctypes.ErrCompacted {
+			log.Print("etcd: revision ", rev+1, " has been compacted, resyncing")
+			users, err = nil, nil
+			continue
+		}
+
+		if users == nil {
+			log.Print("etcd: failed to read users: ", err, " (retrying in ", delay, ")")
+		} else {
+			log.Print("etcd: watch failed: ", err, " (retrying in ", delay, ")")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// sync reads all the users.
+func (s *EtcdSource) sync(ctx context.Context) (users map[string]User, rev int64, err error) {
+	prefix := s.prefix()
+
+	resp, err := s.Client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+
+	users = map[string]User{}
+	for _, kv := range resp.Kvs {
+		s.set(users, kv)
+	}
+
+	return users, resp.Header.Revision, nil
+}
+
+// watch applies the changes after rev to users, until the watch fails. It
+// returns the last seen revision, and if some changes were received.
+func (s *EtcdSource) watch(ctx context.Context, users map[string]User, rev int64, update func(users []User)) (lastRev int64, progress bool, err error) {
+	lastRev = rev
+
+	// cancel the watch when we stop following it
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	watch := s.Client.Watch(ctx, s.prefix(), clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+	for wr := range watch {
+		if err = wr.Err(); err != nil {
+			return
+		}
+
+		if len(wr.Events) == 0 {
+			continue
+		}
+
+		for _, event := range wr.Events {
+			switch event.Type {
+			case mvccpb.PUT:
+				s.set(users, event.Kv)
+			case mvccpb.DELETE:
+				s.delete(users, event.Kv)
+			}
+		}
+
+		lastRev = wr.Events[len(wr.Events)-1].Kv.ModRevision
+		progress = true
+
+		update(usersOf(users))
+	}
+
+	err = errWatchClosed
+	return
+}
+
+func (s *EtcdSource) name(kv *mvccpb.KeyValue) string {
+	return string(kv.Key[len(s.prefix()):])
+}
+
+func (s *EtcdSource) set(users map[string]User, kv *mvccpb.KeyValue) {
+	name := s.name(kv)
+
+	u := User{}
+	if err := json.Unmarshal(kv.Value, &u); err != nil {
+		log.Printf("etcd: ignoring user %s: %v", name, err)
+		delete(users, name)
+		return
+	}
+
+	u.Name = name
+	users[name] = u
+}
+
+func (s *EtcdSource) delete(users map[string]User, kv *mvccpb.KeyValue) {
+	name := s.name(kv)
+	log.Print("etcd: user ", name, " deleted")
+	delete(users, name)
+}
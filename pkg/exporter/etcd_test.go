@@ -0,0 +1,354 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	"github.com/coreos/pkg/capnslog"
+)
+
+const testPrefix = "/users"
+
+// startEtcd starts an embedded etcd server and returns a client of it.
+func startEtcd(t *testing.T) *clientv3.Client {
+	capnslog.SetGlobalLogLevel(capnslog.CRITICAL)
+
+	dir, err := ioutil.TempDir("", "exporter-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+
+	clientURL, peerURL := freeURL(t), freeURL(t)
+	cfg.LCUrls, cfg.ACUrls = []url.URL{clientURL}, []url.URL{clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("etcd didn't start")
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{clientURL.String()},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		e.Close()
+		os.RemoveAll(dir)
+	})
+
+	return client
+}
+
+// freeURL returns an URL on a free local port.
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func putUser(t *testing.T, client *clientv3.Client, name, hash string) int64 {
+	ba, err := json.Marshal(User{PasswordHash: hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Put(context.Background(), testPrefix+"/"+name, string(ba))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Header.Revision
+}
+
+// names returns the sorted names and hashes of the users (ie: "a=h1").
+func names(users []User) []string {
+	result := make([]string, 0, len(users))
+	for _, u := range users {
+		result = append(result, u.Name+"="+u.PasswordHash)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// runSource runs the source in the background and returns its updates.
+func runSource(t *testing.T, s Source) <-chan []string {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	updates := make(chan []string, 10)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- s.Run(ctx, func(users []User) { updates <- names(users) })
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Error("Run returned ", err)
+		}
+	})
+
+	return updates
+}
+
+func expectUpdate(t *testing.T, updates <-chan []string, expected ...string) {
+	t.Helper()
+
+	select {
+	case users := <-updates:
+		if len(expected) == 0 {
+			expected = []string{}
+		}
+		if !reflect.DeepEqual(users, expected) {
+			t.Fatalf("expected users %v, got %v", expected, users)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no update (expected users %v)", expected)
+	}
+}
+
+func TestEtcdSourceUsers(t *testing.T) {
+	client := startEtcd(t)
+
+	putUser(t, client, "a", "h1")
+	putUser(t, client, "b", "h2")
+	client.Put(context.Background(), testPrefix+"/bad", "{")
+	client.Put(context.Background(), "/other/c", "{}")
+
+	users, err := (&EtcdSource{Client: client, Prefix: testPrefix}).Users(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := names(users); !reflect.DeepEqual(n, []string{"a=h1", "b=h2"}) {
+		t.Error("unexpected users: ", n)
+	}
+}
+
+func TestEtcdSourceRun(t *testing.T) {
+	client := startEtcd(t)
+
+	putUser(t, client, "a", "h1")
+
+	updates := runSource(t, &EtcdSource{Client: client, Prefix: testPrefix})
+
+	// initial sync
+	expectUpdate(t, updates, "a=h1")
+
+	putUser(t, client, "b", "h2")
+	expectUpdate(t, updates, "a=h1", "b=h2")
+
+	putUser(t, client, "a", "h3")
+	expectUpdate(t, updates, "a=h3", "b=h2")
+
+	if _, err := client.Delete(context.Background(), testPrefix+"/a"); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate(t, updates, "b=h2")
+}
+
+func TestEtcdSourceResyncAfterCompaction(t *testing.T) {
+	client := startEtcd(t)
+
+	putUser(t, client, "a", "h1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &EtcdSource{Client: client, Prefix: testPrefix}
+
+	logs := &bytes.Buffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	updates := make(chan []string, 10)
+	done := make(chan error, 1)
+	first := true
+
+	go func() {
+		done <- s.Run(ctx, func(users []User) {
+			if first {
+				// changes then a compaction between the sync and the watch
+				first = false
+				putUser(t, client, "b", "h2")
+				rev := putUser(t, client, "c", "h3")
+				if _, err := client.Compact(ctx, rev, clientv3.WithCompactPhysical()); err != nil {
+					t.Error(err)
+				}
+			}
+			updates <- names(users)
+		})
+	}()
+
+	expectUpdate(t, updates, "a=h1")
+
+	// the watch can't start from the compacted revision: all the users are read again
+	expectUpdate(t, updates, "a=h1", "b=h2", "c=h3")
+
+	putUser(t, client, "d", "h4")
+	expectUpdate(t, updates, "a=h1", "b=h2", "c=h3", "d=h4")
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Error("Run returned ", err)
+	}
+
+	if !strings.Contains(logs.String(), "has been compacted, resyncing") {
+		t.Error("no resync logged:\n", logs.String())
+	}
+}
+
+// countingSink returns a JSON sink writing in a temporary directory, and a
+// function returning the number of writes.
+func countingSink(t *testing.T) (*Sink, func() int) {
+	dir, err := ioutil.TempDir("", "exporter-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	count := filepath.Join(dir, "count")
+
+	sink := &Sink{
+		Type: "json",
+		Path: filepath.Join(dir, "users.json"),
+		Hook: fmt.Sprintf("echo >> %q", count),
+	}
+
+	return sink, func() int {
+		ba, err := ioutil.ReadFile(count)
+		if os.IsNotExist(err) {
+			return 0
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(ba), "\n")
+	}
+}
+
+func readSink(t *testing.T, sink *Sink) []string {
+	ba, err := ioutil.ReadFile(sink.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := []User{}
+	if err = json.Unmarshal(ba, &users); err != nil {
+		t.Fatal(err)
+	}
+	return names(users)
+}
+
+func TestExporterDebounce(t *testing.T) {
+	client := startEtcd(t)
+
+	putUser(t, client, "a", "h1")
+
+	sink, writes := countingSink(t)
+
+	e := &Exporter{
+		Source:   &EtcdSource{Client: client, Prefix: testPrefix},
+		Sinks:    []*Sink{sink},
+		Debounce: 500 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- e.Run(ctx) }()
+
+	waitFor(t, func() bool { return writes() == 1 })
+
+	// a burst of changes gives one write
+	expected := []string{"a=h1"}
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("u%d", i)
+		putUser(t, client, name, "h")
+		expected = append(expected, name+"=h")
+	}
+
+	waitFor(t, func() bool { return writes() == 2 })
+	time.Sleep(2 * e.Debounce)
+
+	if n := writes(); n != 2 {
+		t.Error("expected 2 writes, got ", n)
+	}
+	if users := readSink(t, sink); !reflect.DeepEqual(users, expected) {
+		t.Errorf("expected users %v, got %v", expected, users)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Error("Run returned ", err)
+	}
+}
+
+func TestExporterOnce(t *testing.T) {
+	client := startEtcd(t)
+
+	putUser(t, client, "a", "h1")
+	putUser(t, client, "b", "h2")
+
+	sink, writes := countingSink(t)
+
+	e := &Exporter{
+		Source: &EtcdSource{Client: client, Prefix: testPrefix},
+		Sinks:  []*Sink{sink},
+	}
+
+	if err := e.Once(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := writes(); n != 1 {
+		t.Error("expected 1 write, got ", n)
+	}
+	if users := readSink(t, sink); !reflect.DeepEqual(users, []string{"a=h1", "b=h2"}) {
+		t.Error("unexpected users: ", users)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,140 @@
+// Package exporter exports users' credentials from a source (etcd, SQL, users
+// file) to files (Dovecot passwd, htpasswd, nginx, JSON).
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/mcluseau/autentigo/auth"
+)
+
+// Delays between retries of a failing source, doubled after each failure.
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+// User is an exported user.
+type User struct {
+	Name         string `json:"name"`
+	PasswordHash string `json:"password_hash"`
+	auth.ExtraClaims
+}
+
+// Source of users.
+type Source interface {
+	// Users returns the current list of users.
+	Users(ctx context.Context) ([]User, error)
+
+	// Run sends the full list of users on start, then each time they change,
+	// until the context is done.
+	Run(ctx context.Context, update func(users []User)) error
+}
+
+// Exporter writes the users of the source to the sinks.
+type Exporter struct {
+	Source Source
+	Sinks  []*Sink
+
+	// Debounce delays writes after an update, so a burst of updates gives
+	// only one write.
+	Debounce time.Duration
+}
+
+// Run the export until the context is done or the source fails.
+func (e *Exporter) Run(ctx context.Context) error {
+	if e.Debounce <= 0 {
+		return e.Source.Run(ctx, e.update)
+	}
+
+	updates := make(chan []User)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		e.debounce(updates)
+	}()
+
+	err := e.Source.Run(ctx, func(users []User) { updates <- users })
+
+	close(updates)
+	<-done
+
+	return err
+}
+
+// Once writes the current users to the sinks, then returns.
+func (e *Exporter) Once(ctx context.Context) error {
+	users, err := e.Source.Users(ctx)
+	if err != nil {
+		return err
+	}
+
+	return e.Write(users)
+}
+
+func (e *Exporter) update(users []User) {
+	e.Write(users)
+}
+
+// debounce writes the last received users after the debounce delay. Pending
+// users are written when the channel is closed.
+func (e *Exporter) debounce(updates <-chan []User) {
+	var (
+		pending []User
+		timer   <-chan time.Time
+	)
+
+	for {
+		select {
+		case users, ok := <-updates:
+			if !ok {
+				if timer != nil {
+					e.Write(pending)
+				}
+				return
+			}
+
+			if timer == nil {
+				timer = time.After(e.Debounce)
+			}
+			pending = users
+
+		case <-timer:
+			e.Write(pending)
+			pending, timer = nil, nil
+		}
+	}
+}
+
+// Write the users to every sink. Sink errors are logged, so one failing sink
+// doesn't block the others.
+func (e *Exporter) Write(users []User) (err error) {
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+
+	failed := 0
+	for _, sink := range e.Sinks {
+		if err := sink.Write(users); err != nil {
+			log.Printf("sink %s: %v", sink.Path, err)
+			failed++
+		}
+	}
+
+	if failed != 0 {
+		err = fmt.Errorf("%d sink(s) failed", failed)
+	}
+	return
+}
+
+// usersOf returns the users of the map.
+func usersOf(m map[string]User) []User {
+	users := make([]User, 0, len(m))
+	for _, u := range m {
+		users = append(users, u)
+	}
+	return users
+}
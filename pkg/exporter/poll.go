@@ -0,0 +1,38 @@
+package exporter
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// poll calls check every interval until the context is done. Failed checks are
+// logged and retried with an exponential backoff.
+func poll(ctx context.Context, name string, interval time.Duration, check func() error) error {
+	delay := minRetryDelay
+
+	for {
+		wait := interval
+
+		if err := check(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			log.Print(name, ": failed to read users: ", err, " (retrying in ", delay, ")")
+
+			wait = delay
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		} else {
+			delay = minRetryDelay
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
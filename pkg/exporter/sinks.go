@@ -0,0 +1,245 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/claims"
+)
+
+// Sink writes users to a file in a given format.
+type Sink struct {
+	// Type is the format of the file: dovecot, htpasswd, nginx or json.
+	Type string `json:"type"`
+	// Path of the file.
+	Path string `json:"path"`
+	// Groups of the users to export (all users if empty).
+	Groups []string `json:"groups"`
+	// Hook is a shell command run after the file is written (ie: to reload a service).
+	Hook string `json:"hook"`
+
+	// Userdb fields of the dovecot format, as templates over the user's claims
+	// (ie: home: "/var/mail/{{ .sub }}").
+	Userdb map[string]claims.Template `json:"userdb"`
+
+	written []byte
+}
+
+// Format renders the users for a sink.
+type Format func(sink *Sink, users []User) ([]byte, error)
+
+// Formats are the known sink formats.
+var Formats = map[string]Format{
+	"dovecot":  formatDovecot,
+	"htpasswd": formatHtpasswd,
+	"nginx":    formatNginx,
+	"json":     formatJSON,
+}
+
+// Validate checks the sink is well defined.
+func (s *Sink) Validate() error {
+	if _, ok := Formats[s.Type]; !ok {
+		return fmt.Errorf("unknown sink type: %q", s.Type)
+	}
+	if s.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if len(s.Userdb) != 0 && s.Type != "dovecot" {
+		return fmt.Errorf("userdb is only supported by the dovecot type")
+	}
+	return nil
+}
+
+// Write the users to the file, if it changed, then run the hook.
+func (s *Sink) Write(users []User) (err error) {
+	ba, err := Formats[s.Type](s, s.filter(users))
+	if err != nil {
+		return
+	}
+
+	if s.written != nil && bytes.Equal(ba, s.written) {
+		return
+	}
+
+	// write a new file then replace the current one
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), "."+filepath.Base(s.Path)+".")
+	if err != nil {
+		return
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(ba); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+
+	if err = os.Rename(tmp.Name(), s.Path); err != nil {
+		return
+	}
+
+	s.written = ba
+	log.Printf("sink %s: wrote %d bytes", s.Path, len(ba))
+
+	if s.Hook != "" {
+		cmd := exec.Command("sh", "-c", s.Hook)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("hook failed: %v", err)
+		}
+	}
+
+	return
+}
+
+func (s *Sink) filter(users []User) []User {
+	if len(s.Groups) == 0 {
+		return users
+	}
+
+	filtered := make([]User, 0, len(users))
+
+users:
+	for _, u := range users {
+		for _, ug := range u.Groups {
+			for _, sg := range s.Groups {
+				if ug == sg {
+					filtered = append(filtered, u)
+					continue users
+				}
+			}
+		}
+	}
+
+	return filtered
+}
+
+// dovecot schemes of crypt-style hashes
+var dovecotCryptSchemes = map[string]string{
+	"$1$":  "MD5-CRYPT",
+	"$2a$": "BLF-CRYPT",
+	"$2b$": "BLF-CRYPT",
+	"$2y$": "BLF-CRYPT",
+	"$5$":  "SHA256-CRYPT",
+	"$6$":  "SHA512-CRYPT",
+}
+
+func formatDovecot(s *Sink, users []User) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	fields := make([]string, 0, len(s.Userdb))
+	for field := range s.Userdb {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, u := range users {
+		hash := u.PasswordHash
+
+		switch {
+		case strings.HasPrefix(hash, "{"):
+			// already has a scheme
+
+		case strings.HasPrefix(hash, "$"):
+			scheme := ""
+			for prefix, s := range dovecotCryptSchemes {
+				if strings.HasPrefix(hash, prefix) {
+					scheme = s
+					break
+				}
+			}
+			if scheme == "" {
+				log.Printf("sink %s: skipping user %s: unsupported hash", s.Path, u.Name)
+				continue
+			}
+			hash = "{" + scheme + "}" + hash
+
+		default:
+			hash = "{SHA256.HEX}" + hash
+		}
+
+		// user:password:uid:gid:(gecos):home:(shell):extra_fields
+		fmt.Fprintf(buf, "%s:%s::::::", u.Name, hash)
+
+		if len(fields) != 0 {
+			data, err := templateData(u)
+			if err != nil {
+				return nil, err
+			}
+
+			for i, field := range fields {
+				value := &bytes.Buffer{}
+				if err = s.Userdb[field].Execute(value, data); err != nil {
+					return nil, fmt.Errorf("userdb %s: %v", field, err)
+				}
+
+				if i != 0 {
+					buf.WriteByte(' ')
+				}
+				fmt.Fprintf(buf, "userdb_%s=%s", field, value)
+			}
+		}
+
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes(), nil
+}
+
+func templateData(u User) (map[string]interface{}, error) {
+	m, err := claims.ToMap(auth.Claims{
+		StandardClaims: jwt.StandardClaims{Subject: u.Name},
+		ExtraClaims:    u.ExtraClaims,
+	})
+	return map[string]interface{}(m), err
+}
+
+// formatPasswd writes user:hash lines for hashes with one of the prefixes.
+func formatPasswd(s *Sink, users []User, prefixes []string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+users:
+	for _, u := range users {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(u.PasswordHash, prefix) {
+				fmt.Fprintf(buf, "%s:%s\n", u.Name, u.PasswordHash)
+				continue users
+			}
+		}
+
+		log.Printf("sink %s: skipping user %s: unsupported hash", s.Path, u.Name)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func formatHtpasswd(s *Sink, users []User) ([]byte, error) {
+	return formatPasswd(s, users, []string{"$2a$", "$2b$", "$2y$", "$apr1$", "{SHA}", "$1$", "$5$", "$6$"})
+}
+
+func formatNginx(s *Sink, users []User) ([]byte, error) {
+	return formatPasswd(s, users, []string{"$apr1$", "{SHA}", "{SSHA}", "{PLAIN}", "$1$", "$5$", "$6$"})
+}
+
+func formatJSON(s *Sink, users []User) ([]byte, error) {
+	ba, err := json.MarshalIndent(users, "", " ")
+	if err != nil {
+		return nil, err
+	}
+	return append(ba, '\n'), nil
+}
@@ -0,0 +1,68 @@
+package exporter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// SQLSource polls the users of an SQL table.
+type SQLSource struct {
+	DB       *sql.DB
+	Table    string
+	Interval time.Duration
+}
+
+var _ Source = &SQLSource{}
+
+// Run implements Source. Query errors are logged and retried.
+func (s *SQLSource) Run(ctx context.Context, update func(users []User)) error {
+	var previous []User
+
+	return poll(ctx, "sql", s.Interval, func() error {
+		users, err := s.Users(ctx)
+		if err != nil {
+			return err
+		}
+
+		if previous == nil || !reflect.DeepEqual(users, previous) {
+			update(users)
+			previous = users
+		}
+		return nil
+	})
+}
+
+// Users implements Source.
+func (s *SQLSource) Users(ctx context.Context) (users []User, err error) {
+	query := fmt.Sprintf("select id, password_hash, display_name, email, email_verified, groups from %s order by id;", s.Table)
+
+	rows, err := s.DB.QueryContext(ctx, query)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	users = make([]User, 0)
+	for rows.Next() {
+		u := User{}
+		groups := ""
+
+		if err = rows.Scan(&u.Name, &u.PasswordHash, &u.DisplayName, &u.Email, &u.EmailVerified, &groups); err != nil {
+			return
+		}
+
+		if groups != "" {
+			u.Groups = strings.Split(groups, ",")
+		}
+
+		users = append(users, u)
+	}
+
+	err = rows.Err()
+	return
+}
@@ -0,0 +1,101 @@
+package exporter
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var yesValues = map[string]bool{
+	"true": true,
+	"yes":  true,
+	"1":    true,
+}
+
+// UsersFileSource reads the users of a users file
+// (user:sha256 hash:display name:email:email verified:groups), and reads it
+// again when it's modified.
+type UsersFileSource struct {
+	Path     string
+	Interval time.Duration
+}
+
+var _ Source = &UsersFileSource{}
+
+// Run implements Source. Stat and read errors are logged and retried.
+func (s *UsersFileSource) Run(ctx context.Context, update func(users []User)) error {
+	var modTime time.Time
+
+	return poll(ctx, "file", s.Interval, func() error {
+		stat, err := os.Stat(s.Path)
+		if err != nil {
+			return err
+		}
+
+		if stat.ModTime().Equal(modTime) {
+			return nil
+		}
+
+		users, err := s.Users(ctx)
+		if err != nil {
+			return err
+		}
+
+		update(users)
+		modTime = stat.ModTime()
+		return nil
+	})
+}
+
+// Users implements Source.
+func (s *UsersFileSource) Users(ctx context.Context) (users []User, err error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comma = ':'
+	r.FieldsPerRecord = -1
+
+	users = make([]User, 0)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(record) < 2 {
+			// record too short
+			continue
+		}
+
+		u := User{Name: record[0], PasswordHash: record[1]}
+
+		l := len(record)
+		switch {
+		case l >= 6:
+			u.Groups = strings.Split(record[5], ",")
+			fallthrough
+		case l == 5:
+			u.EmailVerified = yesValues[record[4]]
+			fallthrough
+		case l == 4:
+			u.Email = record[3]
+			fallthrough
+		case l == 3:
+			u.DisplayName = record[2]
+		}
+
+		users = append(users, u)
+	}
+
+	return
+}
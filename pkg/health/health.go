@@ -0,0 +1,130 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	restful "github.com/emicklei/go-restful"
+)
+
+// Checker is the interface of components able to check their health.
+type Checker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// CheckerFunc is a function implementing Checker.
+type CheckerFunc func(ctx context.Context) error
+
+// CheckHealth calls f(ctx).
+func (f CheckerFunc) CheckHealth(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Status values
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+// Response is the response of health endpoints.
+type Response struct {
+	Status     string            `json:"status"`
+	Components []ComponentStatus `json:"components,omitempty"`
+}
+
+// ComponentStatus is the status of a checked component.
+type ComponentStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Checks provides /healthz and /readyz endpoints.
+type Checks struct {
+	// Components to check for readiness, by name.
+	Components map[string]Checker
+
+	// Timeout of the readiness checks.
+	Timeout time.Duration
+}
+
+// Register the health endpoints in the given restful.WebService
+func (c *Checks) Register(ws *restful.WebService) {
+	ws.
+		Route(ws.GET("/healthz").
+			To(c.healthz).
+			Doc("Liveness check: answers if the process is alive").
+			Produces(restful.MIME_JSON).
+			Writes(Response{}))
+
+	ws.
+		Route(ws.GET("/readyz").
+			To(c.readyz).
+			Doc("Readiness check: answers if every component is reachable").
+			Produces(restful.MIME_JSON).
+			Returns(http.StatusOK, "ready", Response{}).
+			Returns(http.StatusServiceUnavailable, "not ready", Response{}).
+			Writes(Response{}))
+}
+
+func (c *Checks) healthz(request *restful.Request, response *restful.Response) {
+	response.WriteEntity(Response{Status: StatusOK})
+}
+
+func (c *Checks) readyz(request *restful.Request, response *restful.Response) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(request.Request.Context(), timeout)
+	defer cancel()
+
+	res := c.Check(ctx)
+
+	status := http.StatusOK
+	if res.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	response.WriteHeaderAndEntity(status, res)
+}
+
+// Check runs every component's check concurrently.
+func (c *Checks) Check(ctx context.Context) (res Response) {
+	names := make([]string, 0, len(c.Components))
+	for name := range c.Components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res.Status = StatusOK
+	res.Components = make([]ComponentStatus, len(names))
+
+	done := make(chan struct{}, len(names))
+	for i, name := range names {
+		go func(i int, name string) {
+			cs := ComponentStatus{Name: name, Status: StatusOK}
+			if err := c.Components[name].CheckHealth(ctx); err != nil {
+				cs.Status = StatusError
+				cs.Error = err.Error()
+			}
+			res.Components[i] = cs
+			done <- struct{}{}
+		}(i, name)
+	}
+
+	for range names {
+		<-done
+	}
+
+	for _, cs := range res.Components {
+		if cs.Status != StatusOK {
+			res.Status = StatusError
+		}
+	}
+
+	return
+}
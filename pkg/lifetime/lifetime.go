@@ -0,0 +1,113 @@
+// Package lifetime selects the lifetime of tokens from a set of policies.
+package lifetime
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/mcluseau/autentigo/pkg/settings"
+)
+
+// DefaultPolicy is the name of the policy used when no policy matches.
+const DefaultPolicy = "default"
+
+// Policy gives the lifetime of tokens matching its criteria.
+//
+// Criteria are lists of shell patterns (ie: "kiosk-*"). An empty list matches
+// everything, and every non-empty list must have a matching pattern.
+type Policy struct {
+	Name     string            `json:"name"`
+	Users    []string          `json:"users"`
+	Groups   []string          `json:"groups"`
+	Backends []string          `json:"backends"`
+	Routes   []string          `json:"routes"`
+	Duration settings.Duration `json:"duration"`
+}
+
+// Request describes the token being emitted.
+type Request struct {
+	User    string
+	Groups  []string
+	Backend string
+	Route   string
+}
+
+// Config of the token lifetimes.
+type Config struct {
+	// Default lifetime, when no policy matches.
+	Default time.Duration
+	// Max lifetime, capping any policy's duration (no limit if 0).
+	Max time.Duration
+	// Policies, the first matching one is used.
+	Policies []Policy
+}
+
+// Lifetime returns the lifetime of the token and the name of the policy giving it.
+func (c Config) Lifetime(req Request) (policy string, d time.Duration) {
+	policy, d = DefaultPolicy, c.Default
+
+	for _, p := range c.Policies {
+		if p.Match(req) {
+			policy, d = p.Name, p.Duration.Duration
+			break
+		}
+	}
+
+	if c.Max > 0 && d > c.Max {
+		d = c.Max
+	}
+	return
+}
+
+// Match returns true if the policy applies to the request.
+func (p Policy) Match(req Request) bool {
+	return matchAny(p.Users, req.User) &&
+		matchAny(p.Groups, req.Groups...) &&
+		matchAny(p.Backends, req.Backend) &&
+		matchAny(p.Routes, req.Route)
+}
+
+func matchAny(patterns []string, values ...string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Validate checks the policies are well formed.
+func Validate(policies []Policy) error {
+	names := map[string]bool{}
+
+	for i, p := range policies {
+		if p.Name == "" {
+			return fmt.Errorf("policy %d: name is required", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("policy %s: duplicate name", p.Name)
+		}
+		names[p.Name] = true
+
+		if p.Duration.Duration <= 0 {
+			return fmt.Errorf("policy %s: duration must be positive", p.Name)
+		}
+
+		for _, patterns := range [][]string{p.Users, p.Groups, p.Backends, p.Routes} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("policy %s: invalid pattern %q: %v", p.Name, pattern, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
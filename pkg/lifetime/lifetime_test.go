@@ -0,0 +1,80 @@
+package lifetime
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcluseau/autentigo/pkg/settings"
+)
+
+func duration(d time.Duration) settings.Duration {
+	return settings.Duration{Duration: d}
+}
+
+func TestLifetime(t *testing.T) {
+	c := Config{
+		Default: time.Hour,
+		Max:     24 * time.Hour,
+		Policies: []Policy{
+			{Name: "kiosk", Users: []string{"kiosk-*"}, Duration: duration(10 * time.Minute)},
+			{Name: "admins-cli", Groups: []string{"admins"}, Routes: []string{"/basic", "/simple"}, Duration: duration(5 * time.Minute)},
+			{Name: "ldap", Backends: []string{"ldap*"}, Duration: duration(8 * time.Hour)},
+			{Name: "services", Groups: []string{"svc", "robots"}, Duration: duration(30 * 24 * time.Hour)},
+		},
+	}
+
+	for _, tc := range []struct {
+		req      Request
+		policy   string
+		duration time.Duration
+	}{
+		{Request{User: "bob"}, DefaultPolicy, time.Hour},
+		{Request{User: "kiosk-1", Groups: []string{"admins"}, Route: "/basic"}, "kiosk", 10 * time.Minute},
+		{Request{User: "bob", Groups: []string{"dev", "admins"}, Route: "/simple"}, "admins-cli", 5 * time.Minute},
+		// every criterion must match
+		{Request{User: "bob", Groups: []string{"admins"}, Route: "/mtls"}, DefaultPolicy, time.Hour},
+		{Request{User: "bob", Backend: "ldap-bind"}, "ldap", 8 * time.Hour},
+		// the first matching policy wins
+		{Request{User: "bob", Groups: []string{"admins"}, Route: "/basic", Backend: "ldap"}, "admins-cli", 5 * time.Minute},
+		// capped by the max lifetime
+		{Request{User: "svc-a", Groups: []string{"robots"}}, "services", 24 * time.Hour},
+	} {
+		policy, d := c.Lifetime(tc.req)
+		if policy != tc.policy || d != tc.duration {
+			t.Errorf("%+v: expected %s %v, got %s %v", tc.req, tc.policy, tc.duration, policy, d)
+		}
+	}
+}
+
+func TestLifetimeNoMax(t *testing.T) {
+	c := Config{
+		Default:  time.Hour,
+		Policies: []Policy{{Name: "long", Duration: duration(1000 * time.Hour)}},
+	}
+
+	if policy, d := c.Lifetime(Request{User: "bob"}); policy != "long" || d != 1000*time.Hour {
+		t.Errorf("expected long 1000h, got %s %v", policy, d)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		policies []Policy
+		err      string
+	}{
+		{[]Policy{{Duration: duration(time.Hour)}}, "policy 0: name is required"},
+		{[]Policy{{Name: "a", Duration: duration(time.Hour)}, {Name: "a", Duration: duration(time.Hour)}}, "policy a: duplicate name"},
+		{[]Policy{{Name: "a"}}, "policy a: duration must be positive"},
+		{[]Policy{{Name: "a", Duration: duration(time.Hour), Groups: []string{"[a"}}}, `policy a: invalid pattern "[a"`},
+	} {
+		err := Validate(tc.policies)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected error %q, got %v", tc.err, err)
+		}
+	}
+
+	if err := Validate([]Policy{{Name: "a", Users: []string{"kiosk-*"}, Duration: duration(time.Hour)}}); err != nil {
+		t.Error("unexpected error: ", err)
+	}
+}
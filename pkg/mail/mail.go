@@ -0,0 +1,172 @@
+// Package mail sends mails rendered from templates through SMTP.
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mcluseau/autentigo/pkg/settings"
+)
+
+// ErrRateLimited indicates a mail not sent because the address received one too recently.
+var ErrRateLimited = errors.New("too many mails to this address")
+
+// Config of the mails.
+type Config struct {
+	Server    string            `json:"server" env:"SMTP_SERVER" desc:"SMTP server (host:port), mails are disabled if not set"`
+	Username  string            `json:"username" env:"SMTP_USERNAME" desc:"SMTP user (no authentication if not set)"`
+	Password  string            `json:"password" env:"SMTP_PASSWORD" desc:"SMTP password"`
+	From      string            `json:"from" env:"MAIL_FROM" desc:"Sender of the mails"`
+	Templates string            `json:"templates" env:"MAIL_TEMPLATES" desc:"Directory of templates (<name>.tmpl) replacing the default ones"`
+	Interval  settings.Duration `json:"interval" env:"MAIL_INTERVAL" desc:"Minimum delay between mails to the same address"`
+}
+
+// DefaultConfig returns the default configuration.
+func DefaultConfig() *Config {
+	return &Config{
+		From:     "autentigo@localhost",
+		Interval: settings.Duration{Duration: time.Minute},
+	}
+}
+
+// Sender sends messages.
+type Sender interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// SMTPSender sends messages to an SMTP server.
+type SMTPSender struct {
+	Server   string
+	Username string
+	Password string
+}
+
+// Send the message (STARTTLS is used when the server supports it).
+func (s SMTPSender) Send(from string, to []string, msg []byte) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Server)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	return smtp.SendMail(s.Server, auth, from, to, msg)
+}
+
+// Mailer renders the templates and sends the mails, at most one per Interval
+// to each address.
+type Mailer struct {
+	Sender    Sender
+	From      *mail.Address
+	Templates Templates
+	Interval  time.Duration
+
+	mutex sync.Mutex
+	last  map[string]time.Time
+}
+
+// New returns a mailer sending to the SMTP server of the configuration, or nil
+// if no server is configured.
+func New(config *Config) (*Mailer, error) {
+	if config.Server == "" {
+		return nil, nil
+	}
+
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from: %v", err)
+	}
+
+	templates := DefaultTemplates
+	if config.Templates != "" {
+		if templates, err = TemplatesFromDir(config.Templates, DefaultTemplates); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Mailer{
+		Sender: SMTPSender{
+			Server:   config.Server,
+			Username: config.Username,
+			Password: config.Password,
+		},
+		From:      from,
+		Templates: templates,
+		Interval:  config.Interval.Duration,
+	}, nil
+}
+
+// Send renders the named template with data and sends it to the address.
+func (m *Mailer) Send(to, name string, data interface{}) error {
+	toAddr, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", to, err)
+	}
+
+	subject, body, err := m.Templates.Render(name, data)
+	if err != nil {
+		return err
+	}
+
+	if !m.allow(toAddr.Address) {
+		return ErrRateLimited
+	}
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", m.From)
+	fmt.Fprintf(msg, "To: %s\r\n", toAddr)
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	msg.WriteString("\r\n")
+
+	w := quotedprintable.NewWriter(msg)
+	w.Write([]byte(strings.Replace(body, "\n", "\r\n", -1)))
+	w.Close()
+
+	return m.Sender.Send(m.From.Address, []string{toAddr.Address}, msg.Bytes())
+}
+
+// allow records a mail to the address, if it's not too soon after the previous one.
+func (m *Mailer) allow(address string) bool {
+	if m.Interval <= 0 {
+		return true
+	}
+
+	address = strings.ToLower(address)
+	now := time.Now()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.last == nil {
+		m.last = map[string]time.Time{}
+	}
+
+	if last, ok := m.last[address]; ok && now.Sub(last) < m.Interval {
+		return false
+	}
+
+	// forget addresses that can receive mails again
+	for a, last := range m.last {
+		if now.Sub(last) >= m.Interval {
+			delete(m.last, a)
+		}
+	}
+
+	m.last[address] = now
+	return true
+}
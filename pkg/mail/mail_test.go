@@ -0,0 +1,234 @@
+package mail
+
+import (
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcluseau/autentigo/auth"
+	"github.com/mcluseau/autentigo/pkg/settings"
+)
+
+// received is a mail received by the fake SMTP server.
+type received struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// startSMTP starts a fake SMTP server, accepting every mail.
+func startSMTP(t *testing.T) (addr string, mails <-chan received) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	ch := make(chan received, 10)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, ch)
+		}
+	}()
+
+	return l.Addr().String(), ch
+}
+
+func serveSMTP(conn net.Conn, mails chan<- received) {
+	c := textproto.NewConn(conn)
+	defer c.Close()
+
+	m := received{}
+	c.PrintfLine("220 localhost ESMTP")
+
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			c.PrintfLine("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			m.From = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			c.PrintfLine("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			m.To = append(m.To, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			c.PrintfLine("250 OK")
+		case cmd == "DATA":
+			c.PrintfLine("354 end with .")
+			if m.Data, err = c.ReadDotBytes(); err != nil {
+				return
+			}
+			c.PrintfLine("250 OK")
+			mails <- m
+			m = received{}
+		case cmd == "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("250 OK")
+		}
+	}
+}
+
+func testMailer(t *testing.T, server string) *Mailer {
+	m, err := New(&Config{
+		Server:   server,
+		From:     "Autentigo <noreply@example.com>",
+		Interval: settings.Duration{Duration: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSend(t *testing.T) {
+	addr, mails := startSMTP(t)
+	m := testMailer(t, addr)
+
+	link := "https://example.com/reset-password?token=" + strings.Repeat("x", 100)
+
+	err := m.Send("Bob <bob@example.com>", "password-reset", map[string]interface{}{
+		"ID":      "bob",
+		"Claims":  auth.ExtraClaims{DisplayName: "Bób"},
+		"Link":    link,
+		"Expires": time.Date(2020, 1, 2, 3, 4, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r received
+	select {
+	case r = <-mails:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+	}
+
+	if r.From != "noreply@example.com" {
+		t.Error("unexpected sender: ", r.From)
+	}
+	if len(r.To) != 1 || r.To[0] != "bob@example.com" {
+		t.Error("unexpected recipients: ", r.To)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(r.Data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for header, expected := range map[string]string{
+		"From":                      `"Autentigo" <noreply@example.com>`,
+		"To":                        `"Bob" <bob@example.com>`,
+		"Subject":                   "Password reset",
+		"Mime-Version":              "1.0",
+		"Content-Type":              "text/plain; charset=utf-8",
+		"Content-Transfer-Encoding": "quoted-printable",
+	} {
+		if v := msg.Header.Get(header); v != expected {
+			t.Errorf("header %s: expected %q, got %q", header, expected, v)
+		}
+	}
+
+	if _, err := msg.Header.Date(); err != nil {
+		t.Error("invalid date: ", err)
+	}
+
+	raw, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// (the line endings were converted by ReadDotBytes)
+	for _, line := range strings.Split(string(raw), "\n") {
+		if len(line) > 76 {
+			t.Errorf("line longer than 76 characters: %q", line)
+		}
+	}
+
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(string(raw))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"Hello Bób,\n",
+		"your account bob.",
+		"before 2020-01-02 03:04 UTC:",
+		"\n" + link + "\n",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("body doesn't contain %q:\n%s", expected, body)
+		}
+	}
+}
+
+func TestSendRateLimited(t *testing.T) {
+	addr, mails := startSMTP(t)
+	m := testMailer(t, addr)
+
+	data := map[string]interface{}{"ID": "bob", "Claims": auth.ExtraClaims{}, "Expires": time.Now()}
+
+	if err := m.Send("bob@example.com", "password-reset", data); err != nil {
+		t.Fatal(err)
+	}
+	<-mails
+
+	if err := m.Send("BOB@example.com", "password-reset", data); err != ErrRateLimited {
+		t.Fatal("expected ErrRateLimited, got ", err)
+	}
+
+	select {
+	case <-mails:
+		t.Error("rate limited mail sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAllow(t *testing.T) {
+	m := &Mailer{Interval: time.Minute}
+
+	for _, step := range []struct {
+		address string
+		allowed bool
+	}{
+		{"a@example.com", true},
+		{"a@example.com", false},
+		{"A@Example.com", false}, // addresses are case insensitive
+		{"b@example.com", true},
+	} {
+		if allowed := m.allow(step.address); allowed != step.allowed {
+			t.Errorf("allow(%q): expected %v, got %v", step.address, step.allowed, allowed)
+		}
+	}
+
+	// after the interval
+	m.last["a@example.com"] = time.Now().Add(-m.Interval)
+
+	if !m.allow("a@example.com") {
+		t.Error("a@example.com not allowed after the interval")
+	}
+	if m.allow("a@example.com") {
+		t.Error("a@example.com allowed twice after the interval")
+	}
+
+	// no limit
+	m = &Mailer{}
+	if !m.allow("a@example.com") || !m.allow("a@example.com") {
+		t.Error("not allowed without interval")
+	}
+}
@@ -0,0 +1,86 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Templates of mails, by name. A template renders a "Subject: ..." line, an
+// empty line then the body.
+type Templates map[string]*template.Template
+
+// DefaultTemplates are the built-in templates.
+var DefaultTemplates = Templates{
+	"password-reset": template.Must(template.New("password-reset").Parse(`Subject: Password reset
+
+Hello {{ or .Claims.DisplayName .ID }},
+
+A password reset was requested for your account {{ .ID }}. To choose a new
+password, follow this link before {{ .Expires.Format "2006-01-02 15:04 MST" }}:
+
+{{ .Link }}
+
+If you didn't request it, you can ignore this mail.
+`)),
+
+	"email-verification": template.Must(template.New("email-verification").Parse(`Subject: Email verification
+
+Hello {{ or .Claims.DisplayName .ID }},
+
+To verify {{ .Claims.Email }} is the email of your account {{ .ID }}, follow
+this link before {{ .Expires.Format "2006-01-02 15:04 MST" }}:
+
+{{ .Link }}
+
+If you don't have this account, you can ignore this mail.
+`)),
+}
+
+// TemplatesFromDir returns the templates, replaced by the <name>.tmpl files of
+// the directory when they exist.
+func TemplatesFromDir(dir string, templates Templates) (Templates, error) {
+	result := make(Templates, len(templates))
+
+	for name, tmpl := range templates {
+		path := filepath.Join(dir, name+".tmpl")
+
+		ba, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			result[name] = tmpl
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if result[name], err = template.New(name).Parse(string(ba)); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	return result, nil
+}
+
+// Render the named template, returning the subject and the body of the mail.
+func (t Templates) Render(name string, data interface{}) (subject, body string, err error) {
+	tmpl, ok := t[name]
+	if !ok {
+		return "", "", fmt.Errorf("unknown mail template: %q", name)
+	}
+
+	buf := &bytes.Buffer{}
+	if err = tmpl.Execute(buf, data); err != nil {
+		return "", "", fmt.Errorf("template %s: %v", name, err)
+	}
+
+	parts := strings.SplitN(buf.String(), "\n\n", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "Subject: ") || strings.Contains(parts[0], "\n") {
+		return "", "", fmt.Errorf("template %s: must start with a \"Subject: ...\" line then an empty line", name)
+	}
+
+	return strings.TrimPrefix(parts[0], "Subject: "), parts[1], nil
+}
@@ -0,0 +1,232 @@
+// Package passwordpolicy checks passwords against a configurable policy.
+package passwordpolicy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode"
+
+	yaml "github.com/projectcalico/go-yaml-wrapper"
+)
+
+// Rules of the policy, as given in violations.
+const (
+	RuleMinLength        = "min_length"
+	RuleCharacterClasses = "character_classes"
+	RuleDenyList         = "deny_list"
+	RuleUserInfo         = "user_info"
+	RuleReuse            = "reuse"
+	RuleHashed           = "hashed"
+)
+
+// Character classes
+const (
+	ClassLower  = "lower"
+	ClassUpper  = "upper"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+// Policy of passwords. The zero value accepts any non-empty password.
+type Policy struct {
+	// MinLength is the minimum number of characters.
+	MinLength int `json:"min_length"`
+	// MinClasses is the minimum number of character classes used (lower,
+	// upper, digit, symbol).
+	MinClasses int `json:"min_classes"`
+	// RequiredClasses are the character classes that must be used.
+	RequiredClasses []string `json:"required_classes"`
+	// History is the number of last passwords (including the current one)
+	// that can't be reused.
+	History int `json:"history"`
+	// DenyListFile is a file of forbidden passwords, one per line
+	// (case insensitive).
+	DenyListFile string `json:"deny_list_file"`
+	// ForbidUserInfo forbids passwords containing the user's id or email.
+	ForbidUserInfo bool `json:"forbid_user_info"`
+	// AllowHashed allows clients to give already hashed passwords, that can't
+	// be checked.
+	AllowHashed bool `json:"allow_hashed"`
+
+	denyList map[string]bool
+}
+
+// Default is the policy used when none is configured: it accepts any non-empty
+// password, even hashed ones.
+var Default = &Policy{AllowHashed: true}
+
+// Violation of a policy rule.
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// User the password is checked for.
+type User struct {
+	ID    string
+	Email string
+}
+
+// FromFile reads a policy from a YAML file, and its deny list.
+func FromFile(path string) (p *Policy, err error) {
+	ba, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	p = &Policy{}
+	if err = yaml.UnmarshalStrict(ba, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if err = p.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if p.DenyListFile != "" {
+		if err = p.loadDenyList(); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+// Validate checks the policy is well defined.
+func (p *Policy) Validate() error {
+	if p.MinClasses > len(classes) {
+		return fmt.Errorf("min_classes can't be more than %d", len(classes))
+	}
+
+	for _, class := range p.RequiredClasses {
+		if _, ok := classes[class]; !ok {
+			return fmt.Errorf("unknown character class: %q", class)
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) loadDenyList() error {
+	f, err := os.Open(p.DenyListFile)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	p.denyList = map[string]bool{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			p.denyList[strings.ToLower(line)] = true
+		}
+	}
+
+	return scanner.Err()
+}
+
+var classes = map[string]func(r rune) bool{
+	ClassLower: unicode.IsLower,
+	ClassUpper: unicode.IsUpper,
+	ClassDigit: unicode.IsDigit,
+	ClassSymbol: func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	},
+}
+
+// Check returns the rules the password violates.
+func (p *Policy) Check(password string, user User) (violations []Violation) {
+	violations = make([]Violation, 0)
+
+	violate := func(rule, format string, args ...interface{}) {
+		violations = append(violations, Violation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if n := len([]rune(password)); n == 0 {
+		violate(RuleMinLength, "must not be empty")
+	} else if n < p.MinLength {
+		violate(RuleMinLength, "must have at least %d characters", p.MinLength)
+	}
+
+	used := map[string]bool{}
+	for _, r := range password {
+		for class, is := range classes {
+			if is(r) {
+				used[class] = true
+			}
+		}
+	}
+
+	if len(used) < p.MinClasses {
+		violate(RuleCharacterClasses, "must use at least %d of lower case letters, upper case letters, digits and symbols", p.MinClasses)
+	}
+
+	for _, class := range p.RequiredClasses {
+		if !used[class] {
+			violate(RuleCharacterClasses, "must have a %s character", class)
+		}
+	}
+
+	lower := strings.ToLower(password)
+
+	if p.denyList[lower] {
+		violate(RuleDenyList, "is too common")
+	}
+
+	if p.ForbidUserInfo {
+		infos := []string{user.ID, user.Email}
+		if at := strings.LastIndex(user.Email, "@"); at > 0 {
+			infos = append(infos, user.Email[:at])
+		}
+
+		for _, info := range infos {
+			if info != "" && strings.Contains(lower, strings.ToLower(info)) {
+				violate(RuleUserInfo, "must not contain the user's id or email")
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// CheckReuse returns a violation if the password hash is the current one or
+// in the history (most recent first).
+func (p *Policy) CheckReuse(hash, current string, history []string) []Violation {
+	if p.History <= 0 {
+		return nil
+	}
+
+	previous := append([]string{current}, history...)
+	if len(previous) > p.History {
+		previous = previous[:p.History]
+	}
+
+	for _, h := range previous {
+		if h != "" && h == hash {
+			return []Violation{{Rule: RuleReuse, Message: fmt.Sprintf("must not be one of the last %d passwords", p.History)}}
+		}
+	}
+	return nil
+}
+
+// PushHistory returns the history after the current hash is replaced, keeping
+// only what the policy needs.
+func (p *Policy) PushHistory(history []string, current string) []string {
+	if p.History <= 1 {
+		return nil
+	}
+
+	if current != "" {
+		history = append([]string{current}, history...)
+	}
+	if len(history) > p.History-1 {
+		history = history[:p.History-1]
+	}
+	return history
+}
@@ -0,0 +1,148 @@
+package passwordpolicy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rules returns the rules of the violations.
+func rules(violations []Violation) []string {
+	result := make([]string, 0, len(violations))
+	for _, v := range violations {
+		result = append(result, v.Rule)
+	}
+	return result
+}
+
+func TestCheck(t *testing.T) {
+	policy := &Policy{
+		MinLength:       8,
+		MinClasses:      3,
+		RequiredClasses: []string{ClassDigit},
+		ForbidUserInfo:  true,
+		denyList:        map[string]bool{"password1!": true},
+	}
+
+	bob := User{ID: "bob", Email: "robert@example.com"}
+
+	for _, tc := range []struct {
+		password string
+		rules    []string
+	}{
+		{"Correct-h0rse", []string{}},
+		{"", []string{RuleMinLength, RuleCharacterClasses, RuleCharacterClasses}},
+		{"Sh0rt!", []string{RuleMinLength}},
+		{"éèàç-ÉÈ1", []string{}}, // characters, not bytes
+		{"lowercase-only", []string{RuleCharacterClasses, RuleCharacterClasses}},
+		{"Lower-and-upper", []string{RuleCharacterClasses}},
+		{"lower-and-1234", []string{}},
+		{"PASSWORD1!", []string{RuleDenyList}},
+		{"my-Bob-1234", []string{RuleUserInfo}},
+		{"Robert-1234", []string{RuleUserInfo}},
+		{"x-robert@example.COM-1", []string{RuleUserInfo}},
+	} {
+		if r := rules(policy.Check(tc.password, bob)); !reflect.DeepEqual(r, tc.rules) {
+			t.Errorf("%q: expected violations %q, got %q", tc.password, tc.rules, r)
+		}
+	}
+}
+
+func TestCheckZeroPolicy(t *testing.T) {
+	policy := &Policy{}
+
+	if v := policy.Check("a", User{ID: "a"}); len(v) != 0 {
+		t.Error("unexpected violations: ", v)
+	}
+	if r := rules(policy.Check("", User{})); !reflect.DeepEqual(r, []string{RuleMinLength}) {
+		t.Error("unexpected violations of an empty password: ", r)
+	}
+}
+
+func TestCheckReuse(t *testing.T) {
+	history := []string{"h2", "h3", "h4"}
+
+	for _, tc := range []struct {
+		history int
+		hash    string
+		reused  bool
+	}{
+		{0, "h1", false},
+		{1, "h1", true},
+		{1, "h2", false},
+		{3, "h3", true},
+		{3, "h4", false},
+		{10, "h4", true},
+		{10, "h5", false},
+	} {
+		v := (&Policy{History: tc.history}).CheckReuse(tc.hash, "h1", history)
+		if reused := len(v) != 0; reused != tc.reused {
+			t.Errorf("history %d, hash %s: expected reused %v, got %v", tc.history, tc.hash, tc.reused, v)
+		}
+	}
+
+	// no current password
+	if v := (&Policy{History: 2}).CheckReuse("", "", nil); len(v) != 0 {
+		t.Error("unexpected violations: ", v)
+	}
+}
+
+func TestPushHistory(t *testing.T) {
+	for _, tc := range []struct {
+		history  int
+		previous []string
+		current  string
+		expected []string
+	}{
+		{0, []string{"h2"}, "h1", nil},
+		{1, []string{"h2"}, "h1", nil},
+		{2, nil, "h1", []string{"h1"}},
+		{3, []string{"h2", "h3", "h4"}, "h1", []string{"h1", "h2"}},
+		{3, []string{"h2"}, "", []string{"h2"}},
+	} {
+		if h := (&Policy{History: tc.history}).PushHistory(tc.previous, tc.current); !reflect.DeepEqual(h, tc.expected) {
+			t.Errorf("history %d: expected %q, got %q", tc.history, tc.expected, h)
+		}
+	}
+}
+
+func TestFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "password-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	denyList := write("deny-list", "123456\n  Qwerty \n\n")
+
+	p, err := FromFile(write("policy.yaml", "min_length: 6\ndeny_list_file: "+denyList+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := rules(p.Check("QWERTY", User{})); !reflect.DeepEqual(r, []string{RuleDenyList}) {
+		t.Error("unexpected violations: ", r)
+	}
+
+	for content, expected := range map[string]string{
+		"min_classes: 5\n":              "min_classes can't be more than 4",
+		"required_classes: [ emoji ]\n": `unknown character class: "emoji"`,
+		"max_length: 3\n":               "max_length",
+	} {
+		_, err := FromFile(write("invalid.yaml", content))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected error %q, got %v", content, expected, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package rbac
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Decision of an authorization.
+type Decision int
+
+const (
+	// NoOpinion means no rule matched.
+	NoOpinion Decision = iota
+	// Allow means an allow rule matched and no deny rule did.
+	Allow
+	// Deny means a deny rule matched.
+	Deny
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	default:
+		return "no-opinion"
+	}
+}
+
+// Attributes of a request to authorize, following Kubernetes' authorization
+// attributes.
+type Attributes struct {
+	User *User
+
+	Verb string
+
+	// ResourceRequest is true for requests on resources, false for requests on
+	// non-resource paths.
+	ResourceRequest bool
+
+	Namespace   string
+	APIGroup    string
+	Resource    string
+	Subresource string
+	Name        string
+
+	Path string
+}
+
+// Authorizer is implemented by RBAC backends able to authorize requests.
+type Authorizer interface {
+	Authorize(attrs Attributes) (decision Decision, reason string)
+}
+
+// AccessRule is a Kubernetes-style authorization rule.
+//
+// Empty lists match everything, except users and groups which must match the
+// user if any is given. "*" matches anything, and as in Kubernetes, a
+// non-resource URL ending with "*" matches every path with that prefix (ie:
+// "/api/*" matches "/api/v1/pods").
+type AccessRule struct {
+	Name string `json:"name"`
+
+	// Deny makes this rule deny the requests it matches.
+	Deny bool `json:"deny"`
+
+	Users  []string `json:"users"`
+	Groups []string `json:"groups"`
+
+	Verbs []string `json:"verbs"`
+
+	APIGroups     []string `json:"apiGroups"`
+	Resources     []string `json:"resources"` // "pods" or "pods/log"
+	ResourceNames []string `json:"resourceNames"`
+	Namespaces    []string `json:"namespaces"`
+
+	NonResourceURLs []string `json:"nonResourceURLs"`
+}
+
+// Match returns true if the rule applies to the attributes.
+func (r AccessRule) Match(attrs Attributes) bool {
+	if !r.matchUser(attrs.User) {
+		return false
+	}
+
+	if !matchValue(r.Verbs, attrs.Verb) {
+		return false
+	}
+
+	if !attrs.ResourceRequest {
+		if len(r.NonResourceURLs) == 0 {
+			return false
+		}
+
+		for _, url := range r.NonResourceURLs {
+			if matchURL(url, attrs.Path) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(r.NonResourceURLs) != 0 && len(r.Resources) == 0 {
+		// non-resource only rule
+		return false
+	}
+
+	resource := attrs.Resource
+	if attrs.Subresource != "" {
+		resource += "/" + attrs.Subresource
+	}
+
+	return matchValue(r.APIGroups, attrs.APIGroup) &&
+		matchValue(r.Resources, resource) &&
+		matchValue(r.ResourceNames, attrs.Name) &&
+		matchValue(r.Namespaces, attrs.Namespace)
+}
+
+func (r AccessRule) matchUser(user *User) bool {
+	if len(r.Users) == 0 && len(r.Groups) == 0 {
+		return true
+	}
+
+	if user == nil {
+		return false
+	}
+
+	for _, u := range r.Users {
+		if u == "*" || u == user.Name {
+			return true
+		}
+	}
+
+	for _, ug := range user.Groups {
+		for _, rg := range r.Groups {
+			if rg == "*" || ug == rg {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func matchURL(url, path string) bool {
+	if strings.HasSuffix(url, "*") {
+		return strings.HasPrefix(path, strings.TrimSuffix(url, "*"))
+	}
+	return url == path
+}
+
+func matchValue(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, v := range values {
+		if v == "*" || v == value {
+			return true
+		}
+
+		// "pods/*" matches every subresource of pods
+		if strings.HasSuffix(v, "/*") && strings.HasPrefix(value, strings.TrimSuffix(v, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+var _ Authorizer = &Config{}
+
+// Authorize the request with the access rules. Deny rules take precedence
+// over allow rules.
+func (c *Config) Authorize(attrs Attributes) (decision Decision, reason string) {
+	allowedBy := ""
+
+	for i, rule := range c.Access {
+		if !rule.Match(attrs) {
+			continue
+		}
+
+		name := rule.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i)
+		}
+
+		if rule.Deny {
+			return Deny, "denied by rule " + name
+		}
+
+		if allowedBy == "" {
+			allowedBy = name
+		}
+	}
+
+	if allowedBy != "" {
+		return Allow, "allowed by rule " + allowedBy
+	}
+
+	return NoOpinion, "no rule matches"
+}
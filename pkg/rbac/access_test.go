@@ -0,0 +1,77 @@
+package rbac
+
+import "testing"
+
+func TestAccessRuleMatch(t *testing.T) {
+	bob := &User{Name: "bob", Groups: []string{"dev"}}
+
+	pods := Attributes{User: bob, Verb: "get", ResourceRequest: true, Namespace: "dev", Resource: "pods", Name: "web"}
+	podLogs := pods
+	podLogs.Subresource = "log"
+
+	nonResource := func(path string) Attributes {
+		return Attributes{User: bob, Verb: "get", Path: path}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		rule  AccessRule
+		attrs Attributes
+		match bool
+	}{
+		{"empty rule", AccessRule{}, pods, true},
+		{"user", AccessRule{Users: []string{"bob"}}, pods, true},
+		{"other user", AccessRule{Users: []string{"alice"}}, pods, false},
+		{"group", AccessRule{Groups: []string{"dev"}}, pods, true},
+		{"any group", AccessRule{Groups: []string{"*"}}, pods, true},
+		{"anonymous", AccessRule{Groups: []string{"*"}}, Attributes{Verb: "get", ResourceRequest: true}, false},
+		{"verb", AccessRule{Verbs: []string{"list", "get"}}, pods, true},
+		{"other verb", AccessRule{Verbs: []string{"delete"}}, pods, false},
+		{"namespace", AccessRule{Namespaces: []string{"prod"}}, pods, false},
+		{"api group", AccessRule{APIGroups: []string{""}}, pods, true},
+		{"other api group", AccessRule{APIGroups: []string{"apps"}}, pods, false},
+		{"resource name", AccessRule{ResourceNames: []string{"web"}}, pods, true},
+		{"resource", AccessRule{Resources: []string{"pods"}}, pods, true},
+		{"resource without subresource", AccessRule{Resources: []string{"pods"}}, podLogs, false},
+		{"subresource", AccessRule{Resources: []string{"pods/log"}}, podLogs, true},
+		{"every subresource", AccessRule{Resources: []string{"pods/*"}}, podLogs, true},
+		{"non-resource rule on a resource", AccessRule{NonResourceURLs: []string{"*"}}, pods, false},
+		{"resource rule on a non-resource", AccessRule{Resources: []string{"*"}}, nonResource("/healthz"), false},
+		{"url", AccessRule{NonResourceURLs: []string{"/healthz"}}, nonResource("/healthz"), true},
+		{"url is not a prefix", AccessRule{NonResourceURLs: []string{"/healthz"}}, nonResource("/healthz/ping"), false},
+		{"any url", AccessRule{NonResourceURLs: []string{"*"}}, nonResource("/api/v1/pods"), true},
+		{"url prefix", AccessRule{NonResourceURLs: []string{"/api/*"}}, nonResource("/api/v1/pods"), true},
+		{"url prefix itself", AccessRule{NonResourceURLs: []string{"/api/*"}}, nonResource("/api/"), true},
+		{"url prefix without slash", AccessRule{NonResourceURLs: []string{"/api*"}}, nonResource("/apis/apps"), true},
+		{"other url prefix", AccessRule{NonResourceURLs: []string{"/api/*"}}, nonResource("/apis/apps"), false},
+		{"url prefix and verb", AccessRule{NonResourceURLs: []string{"/api/*"}, Verbs: []string{"post"}}, nonResource("/api/v1"), false},
+	} {
+		if match := tc.rule.Match(tc.attrs); match != tc.match {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.match, match)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	c := &Config{Access: []AccessRule{
+		{Name: "dev", Groups: []string{"dev"}},
+		{Groups: []string{"dev"}, Resources: []string{"secrets"}, Deny: true},
+	}}
+
+	dev := &User{Name: "bob", Groups: []string{"dev"}}
+
+	for _, tc := range []struct {
+		attrs    Attributes
+		decision Decision
+		reason   string
+	}{
+		{Attributes{User: dev, ResourceRequest: true, Resource: "pods"}, Allow, "allowed by rule dev"},
+		{Attributes{User: dev, ResourceRequest: true, Resource: "secrets"}, Deny, "denied by rule #1"},
+		{Attributes{User: &User{Name: "alice"}, ResourceRequest: true, Resource: "pods"}, NoOpinion, "no rule matches"},
+	} {
+		decision, reason := c.Authorize(tc.attrs)
+		if decision != tc.decision || reason != tc.reason {
+			t.Errorf("%+v: expected %v (%s), got %v (%s)", tc.attrs, tc.decision, tc.reason, decision, reason)
+		}
+	}
+}
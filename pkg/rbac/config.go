@@ -14,9 +14,16 @@ type Config struct {
 
 	// Rules to determine a user's roles.
 	Rules []Rule
+
+	// Access rules to authorize requests (ie: Kubernetes' SubjectAccessReviews).
+	Access []AccessRule `json:"access"`
+
+	// Repositories rules to authorize container registry accesses.
+	Repositories []RepositoryRule `json:"repositories"`
 }
 
 var _ Interface = &Config{}
+var _ RoleLister = &Config{}
 
 func FromFile(path string) (config *Config, err error) {
 	ba, err := ioutil.ReadFile(path)
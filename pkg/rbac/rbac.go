@@ -8,6 +8,11 @@ type Interface interface {
 	MatchRequest(role string, req *http.Request, validationCrt []byte) (authn, authz bool)
 }
 
+// RoleLister is implemented by RBAC backends able to list a user's roles.
+type RoleLister interface {
+	RolesOf(user *User) []string
+}
+
 // User describes a user for the simple RBAC backend
 type User struct {
 	Name   string
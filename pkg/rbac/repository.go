@@ -0,0 +1,58 @@
+package rbac
+
+import "path"
+
+// RepositoryAuthorizer is implemented by RBAC backends able to authorize
+// actions on container image repositories.
+type RepositoryAuthorizer interface {
+	// RepositoryActions returns the actions the user (nil if anonymous) is
+	// allowed on the repository.
+	RepositoryActions(user *User, repository string) []string
+}
+
+// RepositoryRule gives actions (ie: pull, push) on repositories.
+//
+// Names are shell patterns (ie: "team-a/*"). A rule without users and groups
+// applies to everyone, including anonymous users.
+type RepositoryRule struct {
+	Users   []string `json:"users"`
+	Groups  []string `json:"groups"`
+	Names   []string `json:"names"`
+	Actions []string `json:"actions"`
+}
+
+// Match returns true if the rule applies to the user and repository.
+func (r RepositoryRule) Match(user *User, repository string) bool {
+	if !(AccessRule{Users: r.Users, Groups: r.Groups}).matchUser(user) {
+		return false
+	}
+
+	for _, pattern := range r.Names {
+		if ok, _ := path.Match(pattern, repository); ok {
+			return true
+		}
+	}
+	return false
+}
+
+var _ RepositoryAuthorizer = &Config{}
+
+// RepositoryActions returns the union of the actions of the matching rules.
+func (c *Config) RepositoryActions(user *User, repository string) (actions []string) {
+	seen := map[string]bool{}
+
+	for _, rule := range c.Repositories {
+		if !rule.Match(user, repository) {
+			continue
+		}
+
+		for _, action := range rule.Actions {
+			if !seen[action] {
+				seen[action] = true
+				actions = append(actions, action)
+			}
+		}
+	}
+
+	return
+}
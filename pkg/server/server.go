@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Options of the HTTP servers.
+type Options struct {
+	ReadTimeout   time.Duration
+	WriteTimeout  time.Duration
+	IdleTimeout   time.Duration
+	ShutdownGrace time.Duration
+}
+
+// BindFlags binds the options to flags in the given flag set.
+func (o *Options) BindFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&o.ReadTimeout, "read-timeout", 30*time.Second, "Maximum duration for reading an entire request")
+	fs.DurationVar(&o.WriteTimeout, "write-timeout", 30*time.Second, "Maximum duration before timing out writes of a response")
+	fs.DurationVar(&o.IdleTimeout, "idle-timeout", 2*time.Minute, "Maximum time to wait for the next request on keep-alive connections")
+	fs.DurationVar(&o.ShutdownGrace, "shutdown-grace", 30*time.Second, "Time given to in-flight requests to finish on shutdown")
+}
+
+// Server is an HTTP(S) server.
+type Server struct {
+	*http.Server
+}
+
+// New returns a Server listening on addr with the given options.
+func (o Options) New(addr string, handler http.Handler) *Server {
+	return &Server{
+		Server: &http.Server{
+			Addr:         addr,
+			Handler:      handler,
+			ReadTimeout:  o.ReadTimeout,
+			WriteTimeout: o.WriteTimeout,
+			IdleTimeout:  o.IdleTimeout,
+		},
+	}
+}
+
+func (s *Server) serve() error {
+	if s.TLSConfig != nil {
+		log.Print("TLS listening on ", s.Addr)
+		return s.ListenAndServeTLS("", "")
+	}
+
+	log.Print("listening on ", s.Addr)
+	return s.ListenAndServe()
+}
+
+// Run the servers until a termination signal is received or one of them
+// fails, then gracefully shutdown all of them and close the closers.
+func Run(opts Options, servers []*Server, closers ...io.Closer) (err error) {
+	errs := make(chan error, len(servers))
+
+	for _, srv := range servers {
+		go func(srv *Server) {
+			if err := srv.serve(); err != http.ErrServerClosed {
+				errs <- err
+			}
+		}(srv)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	select {
+	case s := <-sig:
+		log.Print("received ", s, ", shutting down")
+	case err = <-errs:
+		log.Print("server failed, shutting down: ", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.ShutdownGrace)
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Print("shutdown of ", srv.Addr, " failed: ", err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	for _, c := range closers {
+		if cerr := c.Close(); cerr != nil {
+			log.Print("close failed: ", cerr)
+		}
+	}
+
+	log.Print("shutdown complete")
+	return
+}
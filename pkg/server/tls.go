@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig returns a TLS configuration serving the key pair in certFile and
+// keyFile, reloaded when the files change. If clientCAFile is not empty,
+// client certificates are requested and, when given, must be signed by one of
+// the CAs it contains.
+func TLSConfig(certFile, keyFile, clientCAFile string) (config *tls.Config, err error) {
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return
+	}
+
+	config = &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + clientCAFile)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return
+}
+
+// ClientCertificate returns the verified client certificate of the request,
+// or nil if the client did not present a valid certificate.
+func ClientCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+// CertificateReloader serves a key pair from files, reloading them when they
+// change (ie: when cert-manager renews them).
+type CertificateReloader struct {
+	CertFile string
+	KeyFile  string
+
+	// CheckInterval is the minimum interval between checks of the files.
+	CheckInterval time.Duration
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+// NewCertificateReloader loads the key pair and returns its reloader.
+func NewCertificateReloader(certFile, keyFile string) (r *CertificateReloader, err error) {
+	r = &CertificateReloader{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		CheckInterval: 10 * time.Second,
+	}
+
+	if err = r.reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// GetCertificate is a tls.Config.GetCertificate callback.
+func (r *CertificateReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.lastCheck) >= r.CheckInterval {
+		r.lastCheck = time.Now()
+
+		if r.changed() {
+			if err := r.reload(); err != nil {
+				log.Print("failed to reload TLS certificate, keeping the current one: ", err)
+			}
+		}
+	}
+
+	return r.cert, nil
+}
+
+func (r *CertificateReloader) changed() bool {
+	certStat, err := os.Stat(r.CertFile)
+	if err != nil {
+		return false
+	}
+
+	keyStat, err := os.Stat(r.KeyFile)
+	if err != nil {
+		return false
+	}
+
+	return !certStat.ModTime().Equal(r.certMod) || !keyStat.ModTime().Equal(r.keyMod)
+}
+
+func (r *CertificateReloader) reload() (err error) {
+	certStat, err := os.Stat(r.CertFile)
+	if err != nil {
+		return
+	}
+
+	keyStat, err := os.Stat(r.KeyFile)
+	if err != nil {
+		return
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return
+	}
+
+	if r.cert != nil {
+		log.Print("reloaded TLS certificate from ", r.CertFile)
+	}
+
+	r.cert = &cert
+	r.certMod = certStat.ModTime()
+	r.keyMod = keyStat.ModTime()
+	return
+}
@@ -0,0 +1,203 @@
+package settings
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Setting describes a field of a configuration struct.
+//
+// Fields are described by their tags:
+//
+//	Prefix string `json:"prefix" env:"ETCD_PREFIX" required:"true" desc:"etcd prefix"`
+type Setting struct {
+	Name        string
+	Env         string
+	Description string
+	Required    bool
+	Value       string
+}
+
+// Describe returns the settings of the configuration struct pointed by config.
+func Describe(config interface{}) (settings []Setting) {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		s := Setting{
+			Name:        name,
+			Env:         f.Tag.Get("env"),
+			Description: f.Tag.Get("desc"),
+			Required:    f.Tag.Get("required") == "true",
+		}
+
+		if fv := v.Field(i); !isZero(fv) {
+			s.Value = format(fv)
+		}
+
+		settings = append(settings, s)
+	}
+
+	return
+}
+
+// Load decodes the raw JSON section into config, rejecting unknown fields, then
+// applies the environment and checks required fields are set.
+func Load(config interface{}, raw json.RawMessage) (err error) {
+	if len(raw) != 0 && string(raw) != "null" {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(config); err != nil {
+			return
+		}
+	}
+
+	if err = FromEnv(config); err != nil {
+		return
+	}
+
+	for _, s := range Describe(config) {
+		if s.Required && s.Value == "" {
+			if s.Env != "" {
+				return fmt.Errorf("%s (or env %s) is required: %s", s.Name, s.Env, s.Description)
+			}
+			return fmt.Errorf("%s is required: %s", s.Name, s.Description)
+		}
+	}
+
+	return
+}
+
+// FromEnv sets the fields of config from the environment variables named in
+// their `env` tag, when set.
+func FromEnv(config interface{}) error {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+
+		if err := set(v.Field(i), value); err != nil {
+			return fmt.Errorf("invalid env %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func set(v reflect.Value, value string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type: %s", v.Type())
+		}
+		v.Set(reflect.ValueOf(strings.Split(value, ",")))
+
+	default:
+		return fmt.Errorf("unsupported type: %s", v.Type())
+	}
+
+	return nil
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+func format(v reflect.Value) string {
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		ba, _ := m.MarshalText()
+		return string(ba)
+	}
+
+	if v.Kind() == reflect.Slice {
+		parts := make([]string, v.Len())
+		for i := range parts {
+			parts[i] = fmt.Sprint(v.Index(i).Interface())
+		}
+		return strings.Join(parts, ",")
+	}
+
+	return fmt.Sprint(v.Interface())
+}
+
+// Duration is a time.Duration read from strings like "5s".
+type Duration struct {
+	time.Duration
+}
+
+var _ encoding.TextUnmarshaler = &Duration{}
+
+// UnmarshalText parses the duration.
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
+}
+
+// MarshalText formats the duration.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// Fprint writes the description of the settings to out, in a format like
+// flag.PrintDefaults, with names prefixed by prefix.
+func Fprint(out io.Writer, prefix string, settings []Setting) {
+	for _, s := range settings {
+		fmt.Fprintf(out, "    %s%s", prefix, s.Name)
+		if s.Env != "" {
+			fmt.Fprintf(out, " (env %s)", s.Env)
+		}
+
+		fmt.Fprintf(out, "\n    \t%s", s.Description)
+		if s.Required {
+			fmt.Fprint(out, " (required)")
+		} else if s.Value != "" {
+			fmt.Fprintf(out, " (default %s)", s.Value)
+		}
+		fmt.Fprintln(out)
+	}
+}